@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// batchEndpoint, built by configBatchModeServers()
+//
+// one configured batch listener and the http.Server attached to it. tcp listeners bind ip:port ([ipv6]:port for v6),
+// unix listeners bind a socket path for a co-located reverse proxy.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type batchEndpoint struct {
+	listener batchListener
+	server   *http.Server
+}
+
+func (e *batchEndpoint) String() string {
+	s := e.listener.network() + "://" + e.listener.Address
+	switch {
+	case e.listener.UseTLS:
+		s += " (TLS)"
+	case e.listener.RedirectTLSPort != "":
+		s += " (redirect to TLS port " + e.listener.RedirectTLSPort + ")"
+	}
+	return s
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// listen(), called by startBatchModeServer()
+//
+// opens the listener before anything is served, so a bad address or a port in use stops the mode from starting. a
+// stale unix socket left behind by an unclean exit is removed first, otherwise the bind fails with "address already
+// in use".
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (e *batchEndpoint) listen() (net.Listener, error) {
+	network := e.listener.network()
+
+	if network == "unix" {
+		if fi, err := os.Stat(e.listener.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(e.listener.Address)
+		}
+	}
+
+	ln, err := net.Listen(network, e.listener.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		// reverse proxy and batcher usually run as different users in the same group
+		if err := os.Chmod(e.listener.Address, 0660); err != nil {
+			logger.Warn("batcher: unable to set permissions on ", e.listener.Address)
+			logger.Warn("batcher: ", err.Error())
+		}
+	}
+	return ln, nil
+}
+
+// serve serves on the listener from listen() until the server is shut down
+func (e *batchEndpoint) serve(ln net.Listener) error {
+	if e.listener.UseTLS {
+		// certificate comes from the reloader via TLSConfig.GetCertificate
+		return e.server.ServeTLS(ln, "", "")
+	}
+	return e.server.Serve(ln)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// redirectToTLS(), called by configBatchModeServers()
+//
+// redirects to the same host on the TLS port. the host is taken from the request so the redirect works for whatever
+// address the router used to reach us, ipv6 hosts are bracketed by net.JoinHostPort.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func redirectToTLS(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "close")
+
+		host := req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			host = options.Batch.ServerIP
+		}
+
+		url := "https://" + net.JoinHostPort(host, tlsPort) + req.URL.String()
+		http.Redirect(w, req, url, http.StatusMovedPermanently)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// forwardedFor(), called by startBatchModeServer()
+//
+// requests on a unix socket have no remote address, the router IP has to come from the reverse proxy in front of us.
+// X-Real-IP is used if set, otherwise the last X-Forwarded-For hop (the one our proxy appended). only ever attached to
+// unix listeners, anything that can reach a tcp listener could forge these headers.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func forwardedFor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+		if ip == "" {
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				hops := strings.Split(xff, ",")
+				ip = strings.TrimSpace(hops[len(hops)-1])
+			}
+		}
+
+		if net.ParseIP(ip) != nil {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBatchListeners(t *testing.T) {
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	options.Batch.Listeners = nil
+	options.Batch.ServerIP = "2001:db8::10"
+	options.Batch.HttpServerPort = "80"
+	options.Batch.TlsServerPort = "443"
+	options.Batch.IsTLSEnabled = true
+	options.Batch.TlsLegacyPort = "8443"
+
+	l := batchListeners()
+	if len(l) != 3 {
+		t.Fatalf("expected 3 listeners from single address settings, got %v", len(l))
+	}
+	if l[0].Address != "[2001:db8::10]:80" || l[0].RedirectTLSPort != "443" {
+		t.Errorf("redirect listener, got %+v", l[0])
+	}
+	if l[1].Address != "[2001:db8::10]:443" || !l[1].UseTLS {
+		t.Errorf("TLS listener, got %+v", l[1])
+	}
+	if l[2].Address != "[2001:db8::10]:8443" || l[2].TlsProfile != "legacy" {
+		t.Errorf("legacy listener, got %+v", l[2])
+	}
+
+	// redirect keeps ipv6 hosts bracketed
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/dhcp_assignments?expired=0", nil)
+	req.Host = "[2001:db8::10]:80"
+	redirectToTLS("443").ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "https://[2001:db8::10]:443/api/dhcp_assignments?expired=0" {
+		t.Errorf("redirect location, got %v", loc)
+	}
+}
+
+func TestBatchEndpoint_UnixSocket(t *testing.T) {
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	dir, err := ioutil.TempDir("", "batcher-unix")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "batcher.sock")
+	options.Batch.Listeners = []batchListener{{Address: socket, Network: "unix"}}
+	options.Batch.Routers = []batchRouterAuth{
+		{
+			Username: "test",
+			Password: "test",
+			RouterIP: "2001:db8::1",
+		},
+	}
+	batchTable.initTable()
+
+	endpoints, err := configBatchModeServers(nil)
+	if err != nil {
+		t.Fatalf("configBatchModeServers: %v", err)
+	}
+	e := endpoints[0]
+	e.server.Handler = forwardedFor(http.HandlerFunc(BatchModeEndpointRouter))
+
+	ln, err := e.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go e.serve(ln)
+	defer e.server.Shutdown(context.Background())
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	// give the listener a moment to come up
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		forwarded string
+		status    int
+	}{
+		{"2001:db8:0:0::1", http.StatusOK},
+		{"192.0.2.1, 2001:db8::1", http.StatusOK},
+		{"", http.StatusBadRequest},
+	}
+
+	for k, v := range tests {
+		req, _ := http.NewRequest("GET", "http://batcher/api/dhcp_assignments?ip_address=192.168.1.10&leased_mac_address=AA:BB:CC:DD:EE:F0&expired=0", nil)
+		req.SetBasicAuth("test", "test")
+		if v.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", v.forwarded)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v - request over unix socket: %v", k, err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.status {
+			t.Errorf("%v - unix listener returned wrong status code: got %v want %v", k, res.StatusCode, v.status)
+		}
+	}
+}
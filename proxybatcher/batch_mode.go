@@ -2,14 +2,12 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
 	"time"
@@ -30,10 +28,13 @@ type endpointBatchRequest struct {
 	LeasedMacAddress string `json:"leased_mac_address"`
 	IPAddress        string `json:"ip_address"`
 	RemoteID         string `json:"remote_id"`
+	RelayAgentInfo   string `json:"relay_agent_info"`
 	Expired          string `json:"expired"`
+	Timestamp        string `json:"timestamp"`
 }
 
 func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 	endpointURI, err := url.Parse(r.RequestURI)
 	var mode string
 
@@ -44,6 +45,10 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+	// link-local ipv6 routers come in with a zone (fe80::1%eth0), compare on the address only
+	if i := strings.IndexByte(remoteHost, '%'); i >= 0 {
+		remoteHost = remoteHost[:i]
+	}
 	routerIP := net.ParseIP(remoteHost)
 
 	if routerIP == nil {
@@ -57,7 +62,8 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 	routerPassword := ""
 	for _, v := range options.Batch.Routers {
 		logger.Info(v.RouterIP)
-		if v.RouterIP == remoteHost {
+		// compare parsed addresses, ipv6 can be written more than one way
+		if ip := net.ParseIP(v.RouterIP); ip != nil && ip.Equal(routerIP) {
 			found = true
 			routerUsername = v.Username
 			routerPassword = v.Password
@@ -131,6 +137,8 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 				} else {
 					leaseInformation.RemoteID = ""
 				}
+				leaseInformation.Timestamp = q.Get("timestamp")
+				leaseInformation.RelayAgentInfo = q.Get("relay_agent_info")
 			}
 
 			// leased_mac sanity checks
@@ -182,6 +190,19 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			//// relay_agent_info (raw option 82, hex) fills in remote_id when the router didn't pull it out
+			if leaseInformation.RelayAgentInfo != "" {
+				info, err := parseRelayAgentInfoHex(leaseInformation.RelayAgentInfo)
+				if err != nil {
+					endpointLogger("/api/dhcp_assignments", "unable to parse 'relay_agent_info'", remoteHost, endpointURI.RawQuery, err, mode)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if leaseInformation.RemoteID == "" {
+					leaseInformation.RemoteID = string(info.remoteID)
+				}
+			}
+
 			//// remote_id sanity checks
 			if !(len(leaseInformation.RemoteID) >= 0 && len(leaseInformation.RemoteID) <= 246) {
 				endpointLogger("/api/dhcp_assignments", "'remote_id' parameter length exceeds 246 bytes", remoteHost, leaseInformation.RemoteID[0:80]+"..."+leaseInformation.RemoteID[len(leaseInformation.RemoteID)-20:], nil, mode)
@@ -189,10 +210,24 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// timestamp sanity checks
+			seen, err := parseUpdateTimestamp(leaseInformation.Timestamp, received)
+			if err != nil {
+				endpointLogger("/api/dhcp_assignments", "unable to parse 'timestamp'", remoteHost, endpointURI.RawQuery, err, mode)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
 			mac, err := net.ParseMAC(leaseInformation.LeasedMacAddress)
 			ip := net.ParseIP(leaseInformation.IPAddress)
 
-			go batchTable.UpdateBatchTable(leaseInformation.Expired, routerIP, mac, ip, leaseInformation.RemoteID)
+			// wait for the assignment to be recorded, the response tells the router whether to retry
+			if _, err := ingest.submit(r.Context(), seen, leaseInformation.Expired, routerIP, mac, ip, leaseInformation.RemoteID); err != nil {
+				endpointLogger("/api/dhcp_assignments", "unable to record assignment", remoteHost, endpointURI.RawQuery, err, mode)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 
@@ -211,117 +246,146 @@ func BatchModeEndpointRouter(w http.ResponseWriter, r *http.Request) {
 // startBatchModeServer, called by main()
 //
 // responsible for loading TLS configuration and server parameters into the endpoint listeners, also assigns the
-// Batch handler endpoint to the servers. Server will either spin up single http instance, or an http listener as
-// a redirect along with a TLS listener for batching. ridirect is automatically provisioned. routines are concurrent
-// and will run until stop signal is sent.
+// Batch handler endpoint to the servers. one server is started per batch listener (see batchListeners()), with the
+// single address settings this is either a single http instance, or an http listener as a redirect along with a TLS
+// listener for batching. routines are concurrent and will run until stop signal is sent. returns an error without
+// serving anything when the TLS keypair won't load or a listener won't bind.
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func startBatchModeServer(ctl chan bool) {
+func startBatchModeServer(ctl chan bool) error {
 	logger.SetOutput(os.Stderr)
 	logger.Info("starting batcher...https://test.test.test")
 
-	// load endpoints
-	var TLSConfig tls.Config
-	if options.Batch.IsTLSEnabled {
-		TLSConfig = configBatchModeTLS()
-		logger.Info("batcher: TLS + HTTP redirect configuration loaded")
-	} else {
-		logger.Info("batcher: HTTP configuration loaded")
+	// load the TLS keypair if any listener needs it
+	usesTLS := false
+	for _, l := range batchListeners() {
+		if l.UseTLS {
+			usesTLS = true
+		}
 	}
 
-	redirectServer, endpointServer, err := configBatchModeServers(&TLSConfig)
-	if err != nil {
-		logger.Error("batcher: ", err.Error())
-	} else {
-		if options.Batch.IsTLSEnabled {
-			logger.Info("batcher: TLS + HTTP redirect endpoints configured")
-		} else {
-			logger.Info("batcher: HTTP endpoint configured")
+	var reloader *certReloader
+	reloaderStop := make(chan bool, 1)
+	if usesTLS {
+		warnDays := options.Batch.TlsExpiryWarnDays
+		if warnDays == 0 {
+			warnDays = 30
+		}
+		var err error
+		reloader, err = newCertReloader(options.Batch.TlsCert, options.Batch.TlsKey, warnDays)
+		if err != nil {
+			logger.Error("batcher: unable to load TLS certificate and key")
+			logger.Error("batcher: ", err.Error())
+			return err
 		}
-	}
 
-	// assign handler
-	endpointServer.Handler = http.HandlerFunc(BatchModeEndpointRouter)
+		reloadInterval := time.Duration(options.Batch.TlsReloadInterval) * time.Second
+		if reloadInterval == 0 {
+			reloadInterval = 60 * time.Second
+		}
+		go reloader.watch(reloadInterval, reloaderStop)
 
-	if endpointServer.Handler != nil {
-		logger.Info("batcher: handler attached")
+		logger.Info("batcher: TLS configuration loaded")
 	} else {
-		logger.Error("batcher: handler has experienced an error")
-		return
+		logger.Info("batcher: HTTP configuration loaded")
 	}
 
-	// start endpoints
-	if options.Batch.IsTLSEnabled {
-		logger.Info("batcher: starting TLS + HTTP redirect endpoint servers")
-
-		go func() {
+	// load endpoints
+	endpoints, err := configBatchModeServers(reloader)
+	if err != nil {
+		logger.Error("batcher: ", err.Error())
+		reloaderStop <- true
+		return err
+	}
 
-			if err := redirectServer.ListenAndServe(); err != nil {
-				if err == http.ErrServerClosed {
-					logger.Debug("batcher: HTTP redirect endpoint closed")
-					logger.Debug("batcher: ", err.Error())
-					return
-				}
-				logger.Error("batcher: HTTP redirector error")
-				logger.Error("batcher: ", err.Error())
+	// bind every endpoint before serving any, one that can't listen stops the mode from starting
+	listeners := make([]net.Listener, len(endpoints))
+	for i, e := range endpoints {
+		ln, err := e.listen()
+		if err != nil {
+			logger.Error("batcher: unable to listen on ", e)
+			logger.Error("batcher: ", err.Error())
+			for _, l := range listeners[:i] {
+				l.Close()
 			}
+			reloaderStop <- true
+			return err
+		}
+		listeners[i] = ln
+	}
 
-		}()
-
-		go func() {
-
-			if err := endpointServer.ListenAndServeTLS(options.Batch.TlsCert, options.Batch.TlsKey); err != nil {
-				if err == http.ErrServerClosed {
-					logger.Debug("batcher: TLS endpoint closed")
-					logger.Debug("batcher: ", err.Error())
-					return
-				}
-				logger.Error("batcher: TLS endpoint error)")
-				logger.Error("batcher: ", err.Error())
-			}
+	// updates from the endpoints go through a single worker
+	ingest = newIngestQueue(options.Batch.QueueSize)
+	ingest.start(&batchTable)
 
-		}()
+	// assign handler
+	var handler http.Handler = http.HandlerFunc(BatchModeEndpointRouter)
+	if options.Events.Enabled {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/events", EventStreamHandler)
+		mux.HandleFunc("/api/held_ips", HeldIPHandler)
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	for _, e := range endpoints {
+		if e.server.Handler != nil {
+			// redirector
+			continue
+		}
+		if e.listener.network() == "unix" {
+			e.server.Handler = forwardedFor(handler)
+		} else {
+			e.server.Handler = handler
+		}
+		logger.Info("batcher: handler attached to ", e)
+	}
 
-	} else {
+	// start endpoints
+	for i, e := range endpoints {
+		if !e.listener.UseTLS && e.listener.RedirectTLSPort == "" && e.listener.network() != "unix" {
+			logger.Warn("batcher: starting HTTP endpoint server on ", e.listener.Address, " [highly recommended you use TLS!]")
+		} else {
+			logger.Info("batcher: starting endpoint server ", e)
+		}
 
-		logger.Warn("batcher: starting HTTP endpoint server [highly recommended you use TLS!]")
-		go func() {
+		go func(e *batchEndpoint, ln net.Listener) {
 
-			if err := endpointServer.ListenAndServe(); err != nil {
+			if err := e.serve(ln); err != nil {
 				if err == http.ErrServerClosed {
-					logger.Debug("batcher: HTTP endpoint closed")
+					logger.Debug("batcher: endpoint ", e, " closed")
 					logger.Debug("batcher: ", err.Error())
 					return
 				}
-				logger.Debug("batcher: HTTP endpoint error")
+				logger.Error("batcher: endpoint ", e, " error")
 				logger.Error("batcher: ", err.Error())
 			}
 
-		}()
-
+		}(e, listeners[i])
 	}
 
-	// listen for stop signals
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
 
-	<-stop
+	if reloader != nil {
+		reloaderStop <- true
+	}
 
-	// true, exit batchScheduler
-	ctl <- true
+	events.closeAll()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := redirectServer.Shutdown(ctx); err != nil {
-		logger.Error("batcher: HTTP redirect endpoint shutdown error")
-		logger.Error("batcher: ", err.Error())
-	}
-	if err := endpointServer.Shutdown(ctx); err != nil {
-		logger.Error("batcher: TLS/HTTP endpoint error")
-		logger.Error("batcher: ", err.Error())
+	for _, e := range endpoints {
+		if err := e.server.Shutdown(ctx); err != nil {
+			logger.Error("batcher: endpoint ", e, " shutdown error")
+			logger.Error("batcher: ", err.Error())
+		}
 	}
+	ingest.stop()
+
+	// true, exit batchScheduler
+	ctl <- true
 
 	logger.Println()
 	logger.Info("batcher: exit..")
-	return
+	return nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// per-MAC ordering. updates reach the batch table concurrently, so an assignment and its expiry sent close together
+// can arrive either way around. every update carries a timestamp (receipt, or the router's own "timestamp"), the
+// last one applied per MAC is kept in lastSeen for batch_order_window and anything older is dropped -- last writer
+// wins by timestamp, not by arrival.
+//
+// a MAC that's active on one router and then reported by another is a conflict, logged and published as a
+// "conflict" event. batch_conflict_policy decides who wins:
+//
+// newest  the newest update wins whichever router sent it (default)
+// owner   the router holding the active assignment keeps it until it expires it, or goes quiet for
+//         batch_order_window
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type macSeen struct {
+	at      time.Time
+	router  string
+	ip      string
+	expired string
+}
+
+const (
+	orderApplied = iota
+	orderStale
+	orderConflictReplaced
+	orderConflictKept
+)
+
+// order decides what happens to update x from router, called with the table locked. the previous update is returned
+// for conflicts.
+func (b *recordTable) order(x Assignment, router string, seen time.Time) (int, macSeen) {
+	last, ok := b.lastSeen[x.MacAddress]
+	if ok && seen.Sub(last.at) > b.orderWindow {
+		ok = false
+	}
+
+	if ok && seen.Before(last.at) {
+		b.stale++
+		return orderStale, last
+	}
+
+	result := orderApplied
+	if ok && last.router != router && last.expired == "0" {
+		b.conflicts++
+		if b.conflictMode == "owner" {
+			return orderConflictKept, last
+		}
+		result = orderConflictReplaced
+	}
+
+	b.lastSeen[x.MacAddress] = macSeen{at: seen, router: router, ip: x.IpAddress, expired: x.Expired}
+	return result, last
+}
+
+// pruneSeen forgets MACs that haven't been updated within batch_order_window, called with the table locked. MACs
+// with a held claim are kept, pruneIPIndex() releases them once their holder is forgotten.
+func (b *recordTable) pruneSeen(now time.Time) {
+	for k, v := range b.lastSeen {
+		if _, ok := b.held[k]; ok {
+			continue
+		}
+		if now.Sub(v.at) > b.orderWindow {
+			delete(b.lastSeen, k)
+		}
+	}
+}
+
+func (b *recordTable) publishConflict(x Assignment, routerIP net.IP, prev macSeen, result int) {
+	status := "replaced"
+	if result == orderConflictKept {
+		status = "kept"
+	}
+
+	logger.Warn("scheduler updater: ", x.MacAddress, " reported by router ", routerIP.String(), " is active on router ", prev.router, " (", prev.ip, "), ", status, " by batch_conflict_policy")
+
+	events.publish(batchEvent{
+		Type:       eventConflict,
+		RouterIP:   eventIP(routerIP),
+		MacAddress: x.MacAddress,
+		IpAddress:  x.IpAddress,
+		RemoteID:   x.RemoteID,
+		Expired:    x.Expired,
+		PrevRouter: prev.router,
+		Status:     status,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseUpdateTimestamp(), called by batchModeEndpointRouter()
+//
+// the optional "timestamp" parameter, unix seconds or RFC 3339. an empty timestamp is the time of receipt, and so is
+// one from the future -- a router with its clock ahead would otherwise win every conflict.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseUpdateTimestamp(v string, received time.Time) (time.Time, error) {
+	if v == "" {
+		return received, nil
+	}
+
+	var ts time.Time
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		ts = time.Unix(secs, 0)
+	} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+		ts = t
+	} else {
+		return received, errors.New("timestamp " + v + " is neither unix seconds nor RFC 3339")
+	}
+
+	if ts.After(received) {
+		return received, nil
+	}
+	return ts, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdateOrdering(t *testing.T) {
+	routerA := net.ParseIP("192.0.2.1")
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	ip := net.ParseIP("192.168.1.10")
+	now := time.Now()
+
+	batchTable.initTable()
+
+	// the expiry is received first but the assignment is older, the expiry stands
+	if !batchTable.UpdateBatchTableAt(now, "1", routerA, mac, ip, "") {
+		t.Errorf("expected the expiry to be applied")
+	}
+	if batchTable.UpdateBatchTableAt(now.Add(-time.Second), "0", routerA, mac, ip, "") {
+		t.Errorf("expected the older assignment to be dropped")
+	}
+	if e := batchTable.entry["aa:bb:cc:dd:ee:f0"]; e.Expired != "1" {
+		t.Errorf("expected the expiry to win, got %+v", e)
+	}
+
+	// ordering survives the batch going out
+	batchTable.takeEntries()
+	if batchTable.UpdateBatchTableAt(now.Add(-time.Second), "0", routerA, mac, ip, "") {
+		t.Errorf("expected the older assignment to be dropped after the batch")
+	}
+	if !batchTable.UpdateBatchTableAt(now.Add(time.Second), "0", routerA, mac, ip, "") {
+		t.Errorf("expected the newer assignment to be applied")
+	}
+
+	// lastSeen is forgotten after batch_order_window
+	batchTable.pruneSeen(now.Add(2 * time.Hour))
+	if len(batchTable.lastSeen) != 0 {
+		t.Errorf("expected lastSeen to be pruned, got %+v", batchTable.lastSeen)
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	routerA := net.ParseIP("192.0.2.1")
+	routerB := net.ParseIP("192.0.2.2")
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	now := time.Now()
+
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	c := events.subscribe(eventFilter{types: map[string]bool{eventConflict: true}})
+	defer events.unsubscribe(c)
+
+	tests := []struct {
+		policy string
+		want   string
+		status string
+	}{
+		{"", "192.168.2.10", "replaced"},
+		{"newest", "192.168.2.10", "replaced"},
+		{"owner", "192.168.1.10", "kept"},
+	}
+
+	for _, v := range tests {
+		options.Batch.ConflictPolicy = v.policy
+		batchTable.initTable()
+
+		batchTable.UpdateBatchTableAt(now, "0", routerA, mac, net.ParseIP("192.168.1.10"), "")
+		batchTable.UpdateBatchTableAt(now.Add(time.Second), "0", routerB, mac, net.ParseIP("192.168.2.10"), "")
+
+		if e := batchTable.entry["aa:bb:cc:dd:ee:f0"]; e.IpAddress != v.want {
+			t.Errorf("%q - expected %v in the batch table, got %+v", v.policy, v.want, e)
+		}
+		if batchTable.conflicts != 1 {
+			t.Errorf("%q - expected 1 conflict, got %v", v.policy, batchTable.conflicts)
+		}
+
+		select {
+		case ev := <-c:
+			if ev.Status != v.status || ev.RouterIP != "192.0.2.2" || ev.PrevRouter != "192.0.2.1" {
+				t.Errorf("%q - unexpected conflict event %+v", v.policy, ev)
+			}
+		default:
+			t.Errorf("%q - expected a conflict event", v.policy)
+		}
+	}
+
+	// once the owner expires the MAC another router can take it
+	batchTable.UpdateBatchTableAt(now.Add(2*time.Second), "1", routerA, mac, net.ParseIP("192.168.1.10"), "")
+	if !batchTable.UpdateBatchTableAt(now.Add(3*time.Second), "0", routerB, mac, net.ParseIP("192.168.2.10"), "") {
+		t.Errorf("expected the MAC to move once the owner expired it")
+	}
+	if batchTable.conflicts != 1 {
+		t.Errorf("expected no new conflict, got %v", batchTable.conflicts)
+	}
+}
+
+func TestParseUpdateTimestamp(t *testing.T) {
+	received := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{"", received, false},
+		{"1767322800", time.Unix(1767322800, 0), false},
+		{"2026-01-02T03:00:00Z", time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC), false},
+		{"2027-01-01T00:00:00Z", received, false},
+		{"yesterday", received, true},
+	}
+
+	for _, v := range tests {
+		got, err := parseUpdateTimestamp(v.in, received)
+		if (err != nil) != v.err {
+			t.Errorf("%q - expected error %v, got %v", v.in, v.err, err)
+		}
+		if !got.Equal(v.want) {
+			t.Errorf("%q - expected %v, got %v", v.in, v.want, got)
+		}
+	}
+}
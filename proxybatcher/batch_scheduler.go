@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,13 +34,59 @@ type recordTable struct {
 	currentID     batchID
 	skippedID     batchID
 	entry         map[string]Assignment
+	dispatches    sync.WaitGroup
+	failed        map[string]bool
+	oldest        time.Time
+	flushSize     int
+	flushExpiry   bool
+	flushNow      chan bool
+	flushExpired  chan bool
+	lastSeen      map[string]macSeen
+	orderWindow   time.Duration
+	conflictMode  string
+	conflicts     int
+	stale         int
+	ipIndex       map[string]string
+	held          map[string]Assignment
+	dupPolicy     string
+	duplicates    int
 }
 
 var batchTable recordTable
 
+// sonarClient posts the batches, requests are bounded by the context passed to sendBatch(): sonar_timeout for a
+// dispatch, what's left of batch_shutdown_timeout for the drain
+var sonarClient = &http.Client{}
+
+// sonarTimeout is sonar_timeout with its default
+func sonarTimeout() time.Duration {
+	if options.Sonar.Timeout > 0 {
+		return time.Duration(options.Sonar.Timeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
 func (b *recordTable) initTable() {
 	logger.Info("initializing Batch scheduler.")
 	b.entry = make(map[string]Assignment)
+	b.flushNow = make(chan bool, 1)
+	b.flushExpired = make(chan bool, 1)
+	b.rwTableMutex.Lock()
+	b.flushSize = options.Batch.FlushSize
+	b.flushExpiry = options.Batch.ImmediateExpiry
+	b.lastSeen = make(map[string]macSeen)
+	b.conflicts, b.stale = 0, 0
+	b.ipIndex = make(map[string]string)
+	b.held = make(map[string]Assignment)
+	b.failed = make(map[string]bool)
+	b.dupPolicy = duplicateIPPolicy()
+	b.duplicates = 0
+	b.orderWindow = time.Duration(options.Batch.OrderWindow) * time.Second
+	if b.orderWindow == 0 {
+		b.orderWindow = time.Hour
+	}
+	b.conflictMode = strings.ToLower(options.Batch.ConflictPolicy)
+	b.rwTableMutex.Unlock()
 	b.currentID = batchID(0)
 	b.skippedID = batchID(0)
 	b.sonarAPIKey = options.Sonar.ApiKey
@@ -54,12 +104,23 @@ func (b *recordTable) initTable() {
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-// updateBatchTable, called by batchModeEndpointRouter()
+// updateBatchTable, called by the lease sources
 //
-// responsible for adding entries to the Batch table.
+// responsible for adding entries to the Batch table, the update is timestamped on receipt.
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 func (b *recordTable) UpdateBatchTable(expired string, routerIP net.IP, hostAddr net.HardwareAddr, hostIP net.IP, remoteID string) {
+	b.UpdateBatchTableAt(time.Now(), expired, routerIP, hostAddr, hostIP, remoteID)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// updateBatchTableAt, called by the ingestion queue worker and UpdateBatchTable()
+//
+// adds an entry timestamped at seen (receipt, or the router's own timestamp) to the Batch table. updates older than
+// the last one applied for the MAC are dropped, see batch_order.go. returns false when the update was dropped.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (b *recordTable) UpdateBatchTableAt(seen time.Time, expired string, routerIP net.IP, hostAddr net.HardwareAddr, hostIP net.IP, remoteID string) bool {
 	x := Assignment{
 		Expired:    expired,
 		MacAddress: hostAddr.String(),
@@ -71,12 +132,57 @@ func (b *recordTable) UpdateBatchTable(expired string, routerIP net.IP, hostAddr
 	// race conditions
 
 	b.rwTableMutex.Lock()
-	b.entry[hostAddr.String()] = x
+	result, prev := b.order(x, routerIP.String(), seen)
+	var dup duplicateIP
+	if result != orderStale && result != orderConflictKept {
+		dup = b.indexIP(x, prev)
+		if dup.status != "held" {
+			b.insert(x)
+		}
+		for _, a := range dup.send {
+			b.insert(a)
+		}
+	}
 	b.rwTableMutex.Unlock()
 
+	if dup.holder != "" {
+		publishDuplicateIP(routerIP, x.MacAddress, x.IpAddress, x.RemoteID, dup.holder, dup.status)
+	}
+
+	switch result {
+	case orderStale:
+		logger.Debug("scheduler updater: dropped out of order update for ", x.MacAddress, " from router ", routerIP.String(), ", a newer update was already applied")
+		return false
+	case orderConflictKept, orderConflictReplaced:
+		b.publishConflict(x, routerIP, prev, result)
+		if result == orderConflictKept {
+			return false
+		}
+	}
+
+	events.publish(batchEvent{
+		Type:       eventAssignment,
+		RouterIP:   eventIP(routerIP),
+		MacAddress: x.MacAddress,
+		IpAddress:  x.IpAddress,
+		RemoteID:   x.RemoteID,
+		Expired:    x.Expired,
+	})
+
 	if logger.GetLevel() == logrus.DebugLevel {
 		logger.Debug("scheduler updater: updated record ", x.IpAddress, "[", x.MacAddress, "] expiry is ", x.Expired, " .. record updated by router with ip ", routerIP.String())
 	}
+	return true
+}
+
+// insert puts x in the batch table, called with the table locked
+func (b *recordTable) insert(x Assignment) {
+	if len(b.entry) == 0 {
+		b.oldest = time.Now()
+	}
+	b.entry[x.MacAddress] = x
+	persist.put(x)
+	b.checkTriggers(x, len(b.entry))
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -94,37 +200,61 @@ func (b *recordTable) RunBatchScheduler(ctl chan bool) {
 	logger.Info("scheduler started")
 	logger.Info("press ctrl+c to terminate")
 
-	t := time.NewTicker(b.cycleTime)
+	cycle := time.NewTimer(withJitter(b.cycleTime))
+
+	// the age trigger is checked every second, a timer per entry isn't worth it
+	var age <-chan time.Time
+	if options.Batch.FlushAge > 0 && !leaseTableMode() {
+		ageCheck := time.NewTicker(time.Second)
+		defer ageCheck.Stop()
+		age = ageCheck.C
+	}
+
+	// triggered flushes wait out the jitter, anything else triggered in the meantime goes in the same batch. a size or
+	// age trigger flushes the whole table, an expiry trigger just the expiries.
+	var triggered <-chan time.Time
+	var reason string
+	trigger := func(r string) {
+		if reason == "" || reason == "expiry" {
+			reason = r
+		}
+		if triggered == nil {
+			triggered = time.After(withJitter(0))
+		}
+	}
 
 	for {
 		select {
 		case <-ctl:
 			logger.Info("scheduler: exit..")
 			return
-		case <-t.C:
+		case <-b.flushNow:
+			trigger("size")
+		case <-b.flushExpired:
+			trigger("expiry")
+		case <-age:
+			if b.oldestAge() >= time.Duration(options.Batch.FlushAge)*time.Second {
+				trigger("age")
+			}
+		case <-triggered:
+			if reason == "expiry" {
+				b.flushExpiries()
+			} else {
+				b.flushEntries(reason)
+			}
+			triggered, reason = nil, ""
+		case <-cycle.C:
+			cycle.Reset(withJitter(b.cycleTime))
 			logger.Info("scheduler: running scheduled batch, batch number is ", b.currentID)
 
-			var t []Assignment
-
-			if options.OperationMode == "proxy" {
+			if leaseTableMode() {
 				if len(leaseTable.entry) > 0 {
-					logger.Info("scheduler: mode is proxy")
-					leaseTable.mutex.Lock()
-					for _, v := range leaseTable.entry {
-						x := Assignment{
-							Expired:    v.isExpired,
-							IpAddress:  v.ip,
-							MacAddress: v.mac,
-							RemoteID:   v.rid,
-						}
-						t = append(t, x)
-						//delete(leaseTable.entry, k)
-					}
-					//leaseTable.entry = make(map[string]lease)
-					leaseTable.mutex.Unlock()
+					logger.Info("scheduler: mode is ", options.OperationMode)
+					t := proxyAssignments()
 
+					// the lease table is sent whole every cycle, there's nothing to track in the persistence log
 					b.currentID++
-					go sendBatch(t)
+					b.dispatch(0, t)
 				} else {
 					b.skippedID++
 					logger.Info("batch scheduler: proxy table is empty.. skipping (", b.skippedID, ")")
@@ -133,22 +263,10 @@ func (b *recordTable) RunBatchScheduler(ctl chan bool) {
 				if len(b.entry) > 0 {
 
 					logger.Info("scheduler: mode is batch")
-					// map operations aren't thread safe -- put any map changes within the mutex locks to avoid read/write
-					// race conditions
-
-					b.rwTableMutex.Lock()
-					for k, v := range b.entry {
-						t = append(t, v)
-						delete(b.entry, k)
-					}
-					b.entry = make(map[string]Assignment)
-					b.rwTableMutex.Unlock()
-
-					// increment the Batch number as the Batch table is now cleared
-					b.currentID++
+					id, t := b.takeEntries()
 
-					// send it off to Sonar!
-					go sendBatch(t)
+					// send it off to Sonar! the batch stays in the persistence log until Sonar has it
+					b.dispatch(id, t)
 				} else {
 					b.skippedID++
 					logger.Info("batch scheduler: batch table is empty.. skipping (", b.skippedID, ")")
@@ -158,13 +276,296 @@ func (b *recordTable) RunBatchScheduler(ctl chan bool) {
 	}
 }
 
-func sendBatch(t []Assignment) {
+// leaseTableMode reports whether the mode keeps its assignments in leaseTable rather than the batch table, proxy mode
+// and snoop mode
+func leaseTableMode() bool {
+	return options.OperationMode == "proxy" || options.OperationMode == "snoop"
+}
+
+// proxyAssignments converts the proxy mode lease table into assignments
+func proxyAssignments() []Assignment {
+	var leases []lease
+
+	leaseTable.mutex.Lock()
+	for _, v := range leaseTable.entry {
+		leases = append(leases, v)
+	}
+	leaseTable.mutex.Unlock()
+
+	return resolveDuplicateIPs(leases)
+}
+
+// takeEntries empties the batch table into a new batch
+func (b *recordTable) takeEntries() (batchID, []Assignment) {
+	var t []Assignment
+
+	// map operations aren't thread safe -- put any map changes within the mutex locks to avoid read/write
+	// race conditions
+
+	b.rwTableMutex.Lock()
+	// claims held against a holder that has gone quiet go out with this batch
+	b.pruneSeen(time.Now())
+	for _, x := range b.pruneIPIndex() {
+		b.insert(x)
+	}
+
+	for _, v := range b.entry {
+		t = append(t, v)
+	}
+	b.entry = make(map[string]Assignment)
+
+	b.oldest = time.Time{}
+	stale, conflicts, duplicates := b.stale, b.conflicts, b.duplicates
+	b.stale, b.conflicts, b.duplicates = 0, 0, 0
+
+	// increment the Batch number as the Batch table is now cleared
+	b.currentID++
+	id := b.currentID
+	persist.batch(id)
+	b.rwTableMutex.Unlock()
+
+	if stale > 0 || conflicts > 0 || duplicates > 0 {
+		logger.Info("scheduler: ", stale, " out of order update(s) dropped, ", conflicts, " router conflict(s), ", duplicates, " duplicate IP(s) since the last batch")
+	}
+
+	return id, t
+}
+
+// takeExpired moves just the expiries from the batch table into a new batch
+func (b *recordTable) takeExpired() (batchID, []Assignment) {
+	var t []Assignment
+	var macs []string
+
+	b.rwTableMutex.Lock()
+	defer b.rwTableMutex.Unlock()
+
+	for k, v := range b.entry {
+		if v.Expired == "1" {
+			t = append(t, v)
+			macs = append(macs, k)
+			delete(b.entry, k)
+		}
+	}
+	if len(t) == 0 {
+		return 0, nil
+	}
+	if len(b.entry) == 0 {
+		b.oldest = time.Time{}
+	}
+
+	b.currentID++
+	persist.batchOf(b.currentID, macs)
+	return b.currentID, t
+}
+
+// checkTriggers wakes the scheduler early when batch_flush_size is reached or for an expiry with
+// batch_immediate_expiry set, a flush that's already waiting covers it. called with the table locked, it doesn't block.
+func (b *recordTable) checkTriggers(x Assignment, pending int) {
+	if b.flushSize > 0 && pending >= b.flushSize {
+		signalFlush(b.flushNow)
+	} else if b.flushExpiry && x.Expired == "1" {
+		signalFlush(b.flushExpired)
+	}
+}
+
+func signalFlush(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
+
+// oldestAge is how long the oldest assignment in the batch table has been waiting, 0 when the table is empty
+func (b *recordTable) oldestAge() time.Duration {
+	b.rwTableMutex.Lock()
+	defer b.rwTableMutex.Unlock()
+
+	if b.oldest.IsZero() {
+		return 0
+	}
+	return time.Since(b.oldest)
+}
+
+// withJitter adds up to batch_jitter seconds to d, so a fleet of batchers restarted together doesn't hit Sonar in
+// lockstep
+func withJitter(d time.Duration) time.Duration {
+	if options.Batch.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(options.Batch.Jitter)*int64(time.Second)))
+}
+
+// flushEntries sends the whole batch table ahead of the cycle
+func (b *recordTable) flushEntries(reason string) {
+	b.rwTableMutex.Lock()
+	pending := len(b.entry)
+	b.rwTableMutex.Unlock()
+
+	if pending == 0 {
+		return
+	}
+	id, t := b.takeEntries()
+	logger.Info("scheduler: ", reason, " flush of ", len(t), " assignment(s), batch number is ", id)
+	b.dispatch(id, t)
+}
+
+// flushExpiries sends just the expiries ahead of the cycle, the assignments wait for their batch
+func (b *recordTable) flushExpiries() {
+	id, t := b.takeExpired()
+	if len(t) == 0 {
+		return
+	}
+	logger.Info("scheduler: expiry flush of ", len(t), " assignment(s), batch number is ", id)
+	b.dispatch(id, t)
+}
+
+// dispatch sends a batch in the background, tracked so drain() can wait for it. id 0 isn't in the persistence log,
+// it's the lease table that goes out whole every cycle anyway. a batch that fails is put back in the batch table.
+func (b *recordTable) dispatch(id batchID, t []Assignment) {
+	b.dispatches.Add(1)
+	go func() {
+		defer b.dispatches.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), sonarTimeout())
+		err := sendBatch(ctx, t)
+		cancel()
+		b.settle(t, err)
+		if id == 0 {
+			return
+		}
+		if err != nil {
+			b.requeue(id, t)
+		}
+		persist.sent(id)
+	}()
+}
+
+// requeue puts the assignments of failed batch id back in the batch table to go out with the next batch, leaving out
+// the ones a newer update has replaced. they're logged again, so the failed batch can be marked sent. the triggers
+// aren't checked, a Sonar that's down is retried on the cycle rather than on every update.
+func (b *recordTable) requeue(id batchID, t []Assignment) {
+	n := 0
+	b.rwTableMutex.Lock()
+	for _, x := range t {
+		if _, ok := b.entry[x.MacAddress]; ok {
+			continue
+		}
+		if last, ok := b.lastSeen[x.MacAddress]; ok && (last.ip != x.IpAddress || last.expired != x.Expired) {
+			continue
+		}
+		if len(b.entry) == 0 {
+			b.oldest = time.Now()
+		}
+		b.entry[x.MacAddress] = x
+		persist.put(x)
+		n++
+	}
+	b.rwTableMutex.Unlock()
+
+	logger.Warn("scheduler dispatch: batch ", id, " failed, ", n, " of ", len(t), " assignment(s) put back for the next batch")
+}
+
+// settle records the outcome of sending t, the MACs of a failed send are undelivered until a later send has them
+func (b *recordTable) settle(t []Assignment, err error) {
+	b.rwTableMutex.Lock()
+	for _, x := range t {
+		if err != nil {
+			b.failed[x.MacAddress] = true
+		} else {
+			delete(b.failed, x.MacAddress)
+		}
+	}
+	b.rwTableMutex.Unlock()
+}
+
+// failures is how many MACs went out in a failed dispatch and haven't been sent since
+func (b *recordTable) failures() int {
+	b.rwTableMutex.Lock()
+	defer b.rwTableMutex.Unlock()
+	return len(b.failed)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// drain, called by main() once the mode has stopped taking in assignments and the scheduler has exited
+//
+// waits for the dispatches already on their way, then sends whatever is left in the batch table (or the lease table
+// in proxy mode), all within timeout. returns the exit code, exitUndelivered if anything didn't make it to Sonar --
+// the last send, or an earlier dispatch that failed for a MAC nothing has been sent for since.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (b *recordTable) drain(timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	inflight := make(chan bool)
+	go func() {
+		b.dispatches.Wait()
+		close(inflight)
+	}()
+
+	select {
+	case <-inflight:
+	case <-ctx.Done():
+		logger.Error("scheduler drain: dispatches still in progress after ", timeout.String())
+		b.rwTableMutex.Lock()
+		pending := len(b.entry) + len(b.failed)
+		b.rwTableMutex.Unlock()
+		return b.undelivered(pending)
+	}
+
+	b.rwTableMutex.Lock()
+	pending := len(b.entry)
+	b.rwTableMutex.Unlock()
+
+	var id batchID
+	var t []Assignment
+	if leaseTableMode() {
+		t = proxyAssignments()
+	} else if pending > 0 {
+		id, t = b.takeEntries()
+	}
+
+	if len(t) == 0 {
+		logger.Info("scheduler drain: nothing left to send")
+	} else {
+		logger.Info("scheduler drain: sending the last ", len(t), " assignment(s)")
+		err := sendBatch(ctx, t)
+		b.settle(t, err)
+		if err != nil {
+			return b.undelivered(b.failures())
+		}
+		if id != 0 {
+			persist.sent(id)
+		}
+	}
+
+	if failed := b.failures(); failed > 0 {
+		logger.Error("scheduler drain: ", failed, " assignment(s) from earlier dispatches never made it to Sonar")
+		return b.undelivered(failed)
+	}
+
+	logger.Info("scheduler drain: done")
+	return exitOK
+}
+
+// undelivered logs where the assignments Sonar didn't get have gone
+func (b *recordTable) undelivered(entries int) int {
+	if persist != nil {
+		logger.Warn("scheduler drain: undelivered assignments are kept in ", persist.path, " for the next start")
+	} else if entries > 0 {
+		logger.Warn("scheduler drain: ", entries, " assignment(s) lost, enable persistence_path to keep them")
+	}
+	return exitUndelivered
+}
+
+func sendBatch(ctx context.Context, t []Assignment) error {
 
 	data, err := json.Marshal(map[string][]Assignment{"data": t})
 
 	if err != nil {
 		logger.Error("scheduler dispatch: error marshalling entry table to JSON")
 		logger.Error(err.Error())
+		publishDispatch(len(t), err.Error())
+		return err
 	}
 
 	if logger.GetLevel() == logrus.DebugLevel {
@@ -179,31 +580,34 @@ func sendBatch(t []Assignment) {
 
 	if options.Sonar.Version == 1 {
 
-		client := http.Client{}
-
-		req, err := http.NewRequest("post", "https://"+options.Sonar.InstanceName+"/api/v1/network/ipam/batch_dynamic_ip_assignment", bytes.NewBuffer(data))
+		req, err := http.NewRequestWithContext(ctx, "post", "https://"+options.Sonar.InstanceName+"/api/v1/network/ipam/batch_dynamic_ip_assignment", bytes.NewBuffer(data))
 		if err != nil {
 			logger.Error("error posting to sonar instance ", options.Sonar.InstanceName)
 			logger.Error(err.Error())
+			publishDispatch(len(t), err.Error())
+			return err
 		}
 
 		req.SetBasicAuth(options.Sonar.ApiUsername, options.Sonar.ApiKey)
 		req.Header.Set("Content-Type", "application/json")
 
-		response, err := client.Do(req)
+		response, err := sonarClient.Do(req)
 
 		if err != nil {
 			logger.Error("scheduler dispatch: sonar response error")
 			logger.Error(err.Error())
-			return
+			publishDispatch(len(t), err.Error())
+			return err
 		}
+		defer response.Body.Close()
 
 		responseData, err := ioutil.ReadAll(response.Body)
 
 		if err != nil {
 			logger.Error("scheduler dispatch: unable to read response body")
 			logger.Error(err.Error())
-			return
+			publishDispatch(len(t), err.Error())
+			return err
 		}
 
 		if logger.GetLevel() == logrus.DebugLevel {
@@ -214,6 +618,12 @@ func sendBatch(t []Assignment) {
 			logger.Println()
 		}
 
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			publishDispatch(len(t), "sonar responded with "+response.Status)
+			return errors.New("sonar responded with " + response.Status)
+		}
+		publishDispatch(len(t), "")
+
 	}
 
 	// add v2 endpoint code here
@@ -221,5 +631,19 @@ func sendBatch(t []Assignment) {
 
 	}
 
-	return
+	return nil
+}
+
+// publishDispatch sends the outcome of a batch dispatch to the event stream, an empty reason means success
+func publishDispatch(entries int, reason string) {
+	ev := batchEvent{
+		Type:    eventDispatch,
+		Entries: entries,
+		Status:  "ok",
+	}
+	if reason != "" {
+		ev.Status = "failed"
+		ev.Error = reason
+	}
+	events.publish(ev)
 }
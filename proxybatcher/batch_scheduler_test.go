@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -111,6 +117,211 @@ func TestRecordTable_UpdateBatchTable(t *testing.T) {
 	logger.Println()
 }
 
+func TestFlushTriggers(t *testing.T) {
+	router := net.ParseIP("192.168.1.1")
+	mac := func(i int) net.HardwareAddr {
+		m, _ := net.ParseMAC("AA:BB:CC:DD:EE:F" + strconv.Itoa(i))
+		return m
+	}
+	ip := net.ParseIP("192.168.1.100")
+
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	triggered := func(c chan bool) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// size trigger
+	options.Batch.FlushSize = 2
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac(0), ip, "")
+	if triggered(batchTable.flushNow) {
+		t.Errorf("size trigger fired below batch_flush_size")
+	}
+	batchTable.UpdateBatchTable("0", router, mac(1), ip, "")
+	if !triggered(batchTable.flushNow) {
+		t.Errorf("expected the size trigger at batch_flush_size")
+	}
+	if batchTable.oldestAge() <= 0 {
+		t.Errorf("expected the oldest entry to be tracked")
+	}
+
+	// immediate expiry only takes the expiries
+	options.Batch.FlushSize = 0
+	options.Batch.ImmediateExpiry = true
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac(0), ip, "")
+	if triggered(batchTable.flushExpired) {
+		t.Errorf("expiry trigger fired for an assignment")
+	}
+	batchTable.UpdateBatchTable("1", router, mac(1), ip, "")
+	if !triggered(batchTable.flushExpired) {
+		t.Errorf("expected the expiry trigger")
+	}
+
+	id, expired := batchTable.takeExpired()
+	if id == 0 || len(expired) != 1 || expired[0].MacAddress != "aa:bb:cc:dd:ee:f1" {
+		t.Errorf("expected just the expiry to be taken, got %v %+v", id, expired)
+	}
+	if len(batchTable.entry) != 1 || batchTable.oldestAge() <= 0 {
+		t.Errorf("expected the assignment to stay in the batch table, got %+v", batchTable.entry)
+	}
+	if id, _ := batchTable.takeExpired(); id != 0 {
+		t.Errorf("expected no batch without expiries, got %v", id)
+	}
+
+	// jitter stays within batch_jitter
+	options.Batch.Jitter = 2
+	for i := 0; i < 100; i++ {
+		if d := withJitter(time.Second); d < time.Second || d >= 3*time.Second {
+			t.Fatalf("jitter out of range, got %v", d)
+		}
+	}
+}
+
+func TestSchedulerTriggeredFlush(t *testing.T) {
+	var mutex sync.Mutex
+	var received []Assignment
+	cleanup := fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string][]Assignment
+		json.NewDecoder(r.Body).Decode(&body)
+		mutex.Lock()
+		received = append(received, body["data"]...)
+		mutex.Unlock()
+	})
+	defer cleanup()
+
+	saved, savedMode := options.Batch, options.OperationMode
+	defer func() { options.Batch, options.OperationMode = saved, savedMode }()
+	options.OperationMode = "batch"
+	options.Batch.FlushSize = 2
+
+	batchTable.initTable()
+	batchTable.cycleTime = time.Hour
+
+	ctl := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		batchTable.RunBatchScheduler(ctl)
+		close(done)
+	}()
+
+	router := net.ParseIP("192.168.1.1")
+	for i := 0; i < 2; i++ {
+		m, _ := net.ParseMAC("AA:BB:CC:DD:EE:F" + strconv.Itoa(i))
+		batchTable.UpdateBatchTable("0", router, m, net.ParseIP("192.168.1.10"+strconv.Itoa(i)), "")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		macs := make(map[string]bool)
+		for _, a := range received {
+			macs[a.MacAddress] = true
+		}
+		mutex.Unlock()
+		if macs["aa:bb:cc:dd:ee:f0"] && macs["aa:bb:cc:dd:ee:f1"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a size triggered flush, got %+v", macs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctl <- true
+	<-done
+	batchTable.dispatches.Wait()
+}
+
+func TestDispatchRequeue(t *testing.T) {
+	router := net.ParseIP("192.168.1.1")
+	macA, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	macB, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+
+	// Sonar refuses the batch once the table has moved on
+	refuse := make(chan bool)
+	cleanup := fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		<-refuse
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "batcher-requeue")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	persist, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("openWalStore: %v", err)
+	}
+	defer func() {
+		persist.close()
+		persist = nil
+	}()
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, macA, net.ParseIP("192.168.1.10"), "")
+	batchTable.UpdateBatchTable("0", router, macB, net.ParseIP("192.168.1.11"), "")
+	batchTable.flushEntries("size")
+
+	// f0 moves while the batch is out, the failed batch doesn't put the old IP back
+	batchTable.UpdateBatchTable("0", router, macA, net.ParseIP("192.168.1.20"), "")
+	close(refuse)
+	batchTable.dispatches.Wait()
+
+	if e := batchTable.entry["aa:bb:cc:dd:ee:f0"]; e.IpAddress != "192.168.1.20" {
+		t.Errorf("expected the newer f0 to be kept, got %+v", e)
+	}
+	if e, ok := batchTable.entry["aa:bb:cc:dd:ee:f1"]; !ok || e.IpAddress != "192.168.1.11" {
+		t.Errorf("expected f1 to be put back, got %+v", batchTable.entry)
+	}
+	if len(persist.state.inflight) != 0 || len(persist.state.pending) != 2 {
+		t.Errorf("expected the failed batch to be pending again, got %+v %+v", persist.state.inflight, persist.state.pending)
+	}
+	if batchTable.failures() != 2 {
+		t.Errorf("expected 2 undelivered MACs, got %v", batchTable.failures())
+	}
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+
+	// Sonar never answers, the dispatch gives up after sonar_timeout and the batch is put back
+	release := make(chan bool)
+	cleanup := fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer cleanup()
+	defer close(release)
+
+	saved := options.Sonar.Timeout
+	defer func() { options.Sonar.Timeout = saved }()
+	options.Sonar.Timeout = 1
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", net.ParseIP("192.168.1.1"), mac, net.ParseIP("192.168.1.10"), "")
+
+	start := time.Now()
+	batchTable.flushEntries("size")
+	batchTable.dispatches.Wait()
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("dispatch ignored sonar_timeout, took %v", time.Since(start))
+	}
+	if _, ok := batchTable.entry["aa:bb:cc:dd:ee:f0"]; !ok {
+		t.Errorf("expected the timed out batch to be put back, got %+v", batchTable.entry)
+	}
+}
+
 func BenchmarkRecordTable_UpdateBatchTable(b *testing.B) {
 	// 3 adds
 
@@ -140,3 +351,21 @@ func BenchmarkRecordTable_UpdateBatchTable(b *testing.B) {
 	}
 
 }
+
+func BenchmarkRecordTable_UpdateBatchTableParallel(b *testing.B) {
+	level := logger.GetLevel()
+	logger.SetLevel(logrus.WarnLevel)
+	defer logger.SetLevel(level)
+
+	batchTable.initTable()
+	router := net.ParseIP("192.168.1.1")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mac := make(net.HardwareAddr, 6)
+		for i := 0; pb.Next(); i++ {
+			mac[4], mac[5] = byte(i>>8), byte(i)
+			batchTable.UpdateBatchTable("0", router, mac, net.IPv4(10, 0, mac[4], mac[5]), "")
+		}
+	})
+}
@@ -126,17 +126,17 @@ func configurator(loadYaml bool) {
 	operationMode := tview.NewDropDown()
 	operationMode.SetLabel("Operation Mode")
 
-	operationMode.SetOptions([]string{"batch", "proxy"}, nil)
+	operationModes := []string{"batch", "proxy", "leasefile", "syslog", "kea", "radius", "routeros", "snoop"}
+	operationMode.SetOptions(operationModes, nil)
 	operationModeForm.AddFormItem(operationMode)
 
+	operationMode.SetCurrentOption(0)
 	if loadYaml {
-		if options.OperationMode == strings.ToLower("batch") {
-			operationMode.SetCurrentOption(0)
-		} else {
-			operationMode.SetCurrentOption(1)
+		for k, v := range operationModes {
+			if strings.ToLower(options.OperationMode) == v {
+				operationMode.SetCurrentOption(k)
+			}
 		}
-	} else {
-			operationMode.SetCurrentOption(0)
 	}
 
 
@@ -4,6 +4,11 @@
 
 package main
 
+import (
+	"os"
+	"time"
+)
+
 func main() {
 
 	_ = make([]byte, 1073741824)	// chill the garbage collector out (1 gb of memory ballast)
@@ -12,7 +17,10 @@ func main() {
 	initBasicLogging()				// some logging items are in the config load -- this puts a basic
 	                        		// logging facility together to keep things visually appealing
 	if err := initConfig(); err != nil {
-		return
+		if err.Error() == "exit" {		// configurator run
+			return
+		}
+		os.Exit(exitConfig)
 	}
 
 	initLogging()					// apply the logging stuff that's loaded by initConfig() (mode, format flags etc.)
@@ -20,25 +28,72 @@ func main() {
 	if err := checkConfig(); err != nil {
 		logger.Error("An error was encountered, try 'sonarproxybatcher --help' for more info\n")
 		logger.Warn(err.Error())
-		return
+		os.Exit(exitConfig)
 	}
 
 
 
-	// start the scheduler
+	// start the scheduler, with anything left over from the last run
 	batchTable.initTable()
+	if err := initPersistence(); err != nil {
+		logger.Error(err.Error())
+		os.Exit(exitConfig)
+	}
 	batcherSchedulerSignal := make(chan bool)
 	go batchTable.RunBatchScheduler(batcherSchedulerSignal)
 
+	// event stream for modes without a batch endpoint (or a separate port for it in batch mode)
+	eventServerSignal := make(chan bool, 1)
+	if options.Events.Enabled && options.Events.Address != "" {
+		go startEventServer(eventServerSignal)
+	}
+
+	var err error
 	switch options.OperationMode {
 	case "batch":
 		logger.Info("sonarproxybatcher mode = batch")
-		startBatchModeServer(batcherSchedulerSignal)
+		err = startBatchModeServer(batcherSchedulerSignal)
 	case "proxy":
 		logger.Info("sonarproxybatcher mode = proxy")
-		startDHCPProxy(batcherSchedulerSignal)
+		err = startDHCPProxy(batcherSchedulerSignal)
+	case "leasefile":
+		logger.Info("sonarproxybatcher mode = leasefile")
+		err = startLeaseFileSource(batcherSchedulerSignal)
+	case "syslog":
+		logger.Info("sonarproxybatcher mode = syslog")
+		err = startSyslogSource(batcherSchedulerSignal)
+	case "kea":
+		logger.Info("sonarproxybatcher mode = kea")
+		err = startKeaSource(batcherSchedulerSignal)
+	case "radius":
+		logger.Info("sonarproxybatcher mode = radius")
+		err = startRadiusSource(batcherSchedulerSignal)
+	case "routeros":
+		logger.Info("sonarproxybatcher mode = routeros")
+		err = startRouterOSSource(batcherSchedulerSignal)
+	case "snoop":
+		logger.Info("sonarproxybatcher mode = snoop")
+		err = startSnoopSource(batcherSchedulerSignal)
 	default:
 		logger.Info("sonarproxybatcher mode = ?, exit")
+		os.Exit(exitConfig)
 	}
-	return
+	if err != nil {
+		// the mode never started, anything left over from the last run stays in the persistence log for the next one
+		persist.close()
+		logger.Error("sonarproxybatcher ", options.OperationMode, " mode failed to start, exit (", exitConfig, ")")
+		os.Exit(exitConfig)
+	}
+	eventServerSignal <- true
+
+	// the mode has stopped taking in assignments and the scheduler has stopped, send what's left
+	timeout := time.Duration(options.Batch.ShutdownTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	code := batchTable.drain(timeout)
+	persist.close()
+
+	logger.Info("sonarproxybatcher exit (", code, ")")
+	os.Exit(code)
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// live event stream. every accepted assignment, proxy lease, lease expiry and batch dispatch is published to the
+// eventBroker, and streamed to subscribers on /api/events as server-sent events. subscribers that can't keep up have
+// events dropped rather than holding up the batch table.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	eventAssignment  = "assignment"
+	eventLease       = "lease"
+	eventExpiry      = "expiry"
+	eventDispatch    = "dispatch"
+	eventConflict    = "conflict"
+	eventDuplicateIP = "duplicate_ip"
+)
+
+type batchEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	RouterIP   string    `json:"router_ip,omitempty"`
+	MacAddress string    `json:"mac_address,omitempty"`
+	IpAddress  string    `json:"ip_address,omitempty"`
+	RemoteID   string    `json:"remote_id,omitempty"`
+	Expired    string    `json:"expired,omitempty"`
+	PrevRouter string    `json:"previous_router_ip,omitempty"`
+	PrevMac    string    `json:"previous_mac_address,omitempty"`
+	Entries    int       `json:"entries,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type eventFilter struct {
+	types  map[string]bool
+	router net.IP
+	subnet *net.IPNet
+	mac    net.HardwareAddr
+}
+
+type eventBroker struct {
+	mutex       sync.RWMutex
+	subscribers map[chan batchEvent]eventFilter
+}
+
+var events = eventBroker{subscribers: make(map[chan batchEvent]eventFilter)}
+
+func (e *eventBroker) subscribe(f eventFilter) chan batchEvent {
+	c := make(chan batchEvent, 256)
+	e.mutex.Lock()
+	e.subscribers[c] = f
+	e.mutex.Unlock()
+	return c
+}
+
+func (e *eventBroker) unsubscribe(c chan batchEvent) {
+	e.mutex.Lock()
+	delete(e.subscribers, c)
+	e.mutex.Unlock()
+}
+
+// closeAll disconnects every subscriber, a server shutdown would otherwise wait on the streams until it times out
+func (e *eventBroker) closeAll() {
+	e.mutex.Lock()
+	for c := range e.subscribers {
+		delete(e.subscribers, c)
+		close(c)
+	}
+	e.mutex.Unlock()
+}
+
+func (e *eventBroker) count() int {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return len(e.subscribers)
+}
+
+// publish never blocks, a full subscriber buffer means the event is dropped for that subscriber
+func (e *eventBroker) publish(ev batchEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	e.mutex.RLock()
+	dropped := 0
+	for c, f := range e.subscribers {
+		if !f.match(ev) {
+			continue
+		}
+		select {
+		case c <- ev:
+		default:
+			dropped++
+		}
+	}
+	e.mutex.RUnlock()
+
+	if dropped > 0 {
+		logger.Debug("events: subscriber too slow, dropped ", dropped, " event(s)")
+	}
+}
+
+// eventIP formats an address for an event, net.IP prints "<nil>" for a missing one
+func eventIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// match applies the subscriber filters. router, subnet and mac filters only apply to per-client events, dispatch
+// outcomes go to everyone that asked for them.
+func (f eventFilter) match(ev batchEvent) bool {
+	if len(f.types) > 0 && !f.types[ev.Type] {
+		return false
+	}
+
+	if ev.Type == eventDispatch {
+		return true
+	}
+
+	if f.router != nil {
+		if r := net.ParseIP(ev.RouterIP); r == nil || !r.Equal(f.router) {
+			return false
+		}
+	}
+
+	if f.subnet != nil {
+		if ip := net.ParseIP(ev.IpAddress); ip == nil || !f.subnet.Contains(ip) {
+			return false
+		}
+	}
+
+	if f.mac != nil {
+		if mac, err := net.ParseMAC(ev.MacAddress); err != nil || mac.String() != f.mac.String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseEventFilter(), called by EventStreamHandler()
+//
+// optional query parameters: type (comma separated list of assignment, lease, expiry, dispatch, conflict,
+// duplicate_ip), router (router IP), subnet (CIDR) and mac.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseEventFilter(r *http.Request) (eventFilter, string) {
+	var f eventFilter
+	q := r.URL.Query()
+
+	if t := q.Get("type"); t != "" {
+		f.types = make(map[string]bool)
+		for _, v := range strings.Split(t, ",") {
+			v = strings.ToLower(strings.TrimSpace(v))
+			switch v {
+			case eventAssignment, eventLease, eventExpiry, eventDispatch, eventConflict, eventDuplicateIP:
+				f.types[v] = true
+			default:
+				return f, "unknown event type " + v
+			}
+		}
+	}
+
+	if router := q.Get("router"); router != "" {
+		if f.router = net.ParseIP(router); f.router == nil {
+			return f, "unable to parse 'router'"
+		}
+	}
+
+	if subnet := q.Get("subnet"); subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return f, "unable to parse 'subnet'"
+		}
+		f.subnet = n
+	}
+
+	if mac := q.Get("mac"); mac != "" {
+		m, err := net.ParseMAC(mac)
+		if err != nil {
+			return f, "unable to parse 'mac'"
+		}
+		f.mac = m
+	}
+
+	return f, ""
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// EventStreamHandler, /api/events
+//
+// authenticated with events_username / events_password, streams events until the client goes away. the batch
+// endpoint write timeouts would cut the stream off, so the write deadline is cleared for this connection.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func EventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	username, password, ok := r.BasicAuth()
+	if !ok || username != options.Events.Username || password != options.Events.Password {
+		endpointLogger("/api/events", "failure (credentials)", remoteHost, r.URL.RawQuery, nil, "auth")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	filter, reason := parseEventFilter(r)
+	if reason != "" {
+		endpointLogger("/api/events", reason, remoteHost, r.URL.RawQuery, nil, "get")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("events: unable to clear write deadline, stream may be cut short")
+		logger.Debug("events: ", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Error("events: streaming not supported by this connection")
+		return
+	}
+
+	c := events.subscribe(filter)
+	defer events.unsubscribe(c)
+	endpointLogger("/api/events", "subscriber connected", remoteHost, r.URL.RawQuery, nil, "get")
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			endpointLogger("/api/events", "subscriber disconnected", remoteHost, r.URL.RawQuery, nil, "get")
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case ev, ok := <-c:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				logger.Error("events: error marshalling event to JSON")
+				logger.Error(err.Error())
+				continue
+			}
+			if _, err := w.Write([]byte("event: " + ev.Type + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startEventServer, called by main()
+//
+// standalone listener for the event stream on events_address, for the modes that don't have a batch endpoint to
+// hang /api/events and /api/held_ips off. runs until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startEventServer(ctl chan bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/events", EventStreamHandler)
+	mux.HandleFunc("/api/held_ips", HeldIPHandler)
+
+	server := &http.Server{
+		Addr:              options.Events.Address,
+		Handler:           mux,
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	go func() {
+		logger.Info("events: starting event stream server on ", options.Events.Address)
+		if err := server.ListenAndServe(); err != nil {
+			if err == http.ErrServerClosed {
+				logger.Debug("events: event stream server closed")
+				return
+			}
+			logger.Error("events: event stream server error")
+			logger.Error("events: ", err.Error())
+		}
+	}()
+
+	<-ctl
+	server.Close()
+}
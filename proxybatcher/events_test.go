@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamHandler(t *testing.T) {
+	saved := options.Events
+	defer func() { options.Events = saved }()
+
+	options.Events.Enabled = true
+	options.Events.Username = "events"
+	options.Events.Password = "eventspassword16"
+
+	server := httptest.NewServer(http.HandlerFunc(EventStreamHandler))
+	defer server.Close()
+
+	// bad credentials
+	req, _ := http.NewRequest("GET", server.URL+"/api/events", nil)
+	req.SetBasicAuth("events", "wrong")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad credentials, got status %v want %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	// bad filter
+	req, _ = http.NewRequest("GET", server.URL+"/api/events?subnet=192.168.1.0", nil)
+	req.SetBasicAuth("events", "eventspassword16")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad filter, got status %v want %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// filtered stream
+	req, _ = http.NewRequest("GET", server.URL+"/api/events?mac=aa:bb:cc:dd:ee:f1&type=assignment,dispatch", nil)
+	req.SetBasicAuth("events", "eventspassword16")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %v", ct)
+	}
+
+	for i := 0; i < 100 && events.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	batchTable.initTable()
+	router := net.ParseIP("192.0.2.1")
+	ip := net.ParseIP("192.168.1.10")
+	skip, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	want, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+
+	batchTable.UpdateBatchTable("0", router, skip, ip, "skipped")
+	events.publish(batchEvent{Type: eventLease, MacAddress: want.String()})
+	batchTable.UpdateBatchTable("1", router, want, ip, "wanted")
+	publishDispatch(2, "")
+
+	var got []batchEvent
+	scanner := bufio.NewScanner(res.Body)
+	for len(got) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev batchEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatalf("unmarshalling event: %v", err)
+		}
+		got = append(got, ev)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %v", len(got))
+	}
+	if got[0].Type != eventAssignment || got[0].RemoteID != "wanted" || got[0].Expired != "1" {
+		t.Errorf("expected the filtered assignment first, got %+v", got[0])
+	}
+	if got[1].Type != eventDispatch || got[1].Status != "ok" || got[1].Entries != 2 {
+		t.Errorf("expected the dispatch outcome second, got %+v", got[1])
+	}
+}
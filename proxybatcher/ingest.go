@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// ingestion queue for the batch endpoint. requests are queued to a single worker that applies them to the batch
+// table in arrival order, the handler waits for the worker so a 200 means the assignment is in the batch table (and
+// in the persistence log, when it's enabled). a full queue is answered with a 503 rather than piling up goroutines.
+//
+// the worker applies whatever is queued in one go and commits the persistence log once for all of it before
+// acknowledging, so a busy endpoint doesn't cost a write per request.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+var (
+	errIngestFull    = errors.New("ingestion queue is full")
+	errIngestStopped = errors.New("ingestion queue is stopped")
+)
+
+// ingestBatchMax caps how many queued requests the worker applies per persistence commit
+const ingestBatchMax = 256
+
+type ingestRequest struct {
+	seen     time.Time
+	expired  string
+	routerIP net.IP
+	mac      net.HardwareAddr
+	ip       net.IP
+	remoteID string
+	result   chan bool
+}
+
+type ingestQueue struct {
+	requests chan ingestRequest
+	quit     chan bool
+	done     chan bool
+	once     sync.Once
+}
+
+// ingest is the batch endpoint's queue, nil (updates applied in the handler) until startBatchModeServer() starts one
+var ingest *ingestQueue
+
+func newIngestQueue(size int) *ingestQueue {
+	if size <= 0 {
+		size = 1024
+	}
+	return &ingestQueue{
+		requests: make(chan ingestRequest, size),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+// start runs the worker against the batch table b
+func (q *ingestQueue) start(b *recordTable) {
+	go q.run(b)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// submit, called by batchModeEndpointRouter()
+//
+// queues the update and waits for the worker to apply it, or for ctx (the request) to end. returns whether the
+// update was applied or dropped by the ordering and conflict policies, errIngestFull when there's no room.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (q *ingestQueue) submit(ctx context.Context, seen time.Time, expired string, routerIP net.IP, mac net.HardwareAddr, ip net.IP, remoteID string) (bool, error) {
+	if q == nil {
+		return batchTable.UpdateBatchTableAt(seen, expired, routerIP, mac, ip, remoteID), nil
+	}
+
+	select {
+	case <-q.quit:
+		return false, errIngestStopped
+	default:
+	}
+
+	r := ingestRequest{seen: seen, expired: expired, routerIP: routerIP, mac: mac, ip: ip, remoteID: remoteID, result: make(chan bool, 1)}
+	select {
+	case q.requests <- r:
+	default:
+		return false, errIngestFull
+	}
+
+	select {
+	case applied := <-r.result:
+		return applied, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-q.done:
+		return false, errIngestStopped
+	}
+}
+
+func (q *ingestQueue) run(b *recordTable) {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.quit:
+			// everything queued before the stop was accepted by the endpoint, it still goes in
+			for {
+				select {
+				case r := <-q.requests:
+					q.apply(b, []ingestRequest{r})
+				default:
+					return
+				}
+			}
+		case r := <-q.requests:
+			pending := []ingestRequest{r}
+		collect:
+			for len(pending) < ingestBatchMax {
+				select {
+				case r := <-q.requests:
+					pending = append(pending, r)
+				default:
+					break collect
+				}
+			}
+			q.apply(b, pending)
+		}
+	}
+}
+
+func (q *ingestQueue) apply(b *recordTable, pending []ingestRequest) {
+	results := make([]bool, len(pending))
+	for i, r := range pending {
+		results[i] = b.UpdateBatchTableAt(r.seen, r.expired, r.routerIP, r.mac, r.ip, r.remoteID)
+	}
+
+	if err := persist.commit(); err != nil {
+		logger.Error("ingest: unable to commit the persistence log")
+		logger.Error("ingest: ", err.Error())
+	}
+
+	for i, r := range pending {
+		r.result <- results[i]
+	}
+}
+
+// stop applies what's already queued and waits for the worker to exit, later submits get errIngestStopped
+func (q *ingestQueue) stop() {
+	if q == nil {
+		return
+	}
+	q.once.Do(func() { close(q.quit) })
+	<-q.done
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIngestQueue(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	ip := net.ParseIP("192.168.1.10")
+
+	batchTable.initTable()
+	q := newIngestQueue(16)
+	q.start(&batchTable)
+
+	// concurrent submits are all in the batch table once acknowledged
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:0" + strconv.Itoa(i))
+			if applied, err := q.submit(context.Background(), time.Now(), "0", router, mac, ip, ""); err != nil || !applied {
+				t.Errorf("%v - expected the update to be applied, got %v %v", i, applied, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	batchTable.rwTableMutex.Lock()
+	if len(batchTable.entry) != 10 {
+		t.Errorf("expected 10 entries once acknowledged, got %v", len(batchTable.entry))
+	}
+	batchTable.rwTableMutex.Unlock()
+
+	// a stale update is acknowledged as not applied
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:00")
+	if applied, err := q.submit(context.Background(), time.Now().Add(-time.Minute), "1", router, mac, ip, ""); err != nil || applied {
+		t.Errorf("expected the stale update to be dropped, got %v %v", applied, err)
+	}
+
+	q.stop()
+	if _, err := q.submit(context.Background(), time.Now(), "0", router, mac, ip, ""); err != errIngestStopped {
+		t.Errorf("expected errIngestStopped after stop, got %v", err)
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	ip := net.ParseIP("192.168.1.10")
+
+	// no worker, the first update fills the queue and times out waiting
+	batchTable.initTable()
+	q := newIngestQueue(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.submit(ctx, time.Now(), "0", router, mac, ip, ""); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+	if _, err := q.submit(context.Background(), time.Now(), "0", router, mac, ip, ""); err != errIngestFull {
+		t.Errorf("expected errIngestFull, got %v", err)
+	}
+
+	// the endpoint answers 503 with a Retry-After
+	saved := options.Batch.Routers
+	defer func() { options.Batch.Routers = saved }()
+	options.Batch.Routers = []batchRouterAuth{{Username: "test", Password: "test", RouterIP: "192.0.2.1"}}
+
+	ingest = q
+	defer func() { ingest = nil }()
+
+	payload, _ := json.Marshal(endpointBatchRequest{LeasedMacAddress: "AA:BB:CC:DD:EE:F1", IPAddress: "192.168.1.11", Expired: "0"})
+	r := httptest.NewRequest("POST", "/api/dhcp_assignments", bytes.NewBuffer(payload))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	BatchModeEndpointRouter(rr, r)
+
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After, got %v %v", rr.Code, rr.Header())
+	}
+
+	// once the worker runs, the queued update goes in
+	q.start(&batchTable)
+	q.stop()
+	if _, ok := batchTable.entry["aa:bb:cc:dd:ee:f0"]; !ok {
+		t.Errorf("expected the queued update to be applied on stop, got %+v", batchTable.entry)
+	}
+}
+
+func benchmarkIngestQueue(b *testing.B, persistence bool) {
+	level := logger.GetLevel()
+	logger.SetLevel(logrus.WarnLevel)
+	defer logger.SetLevel(level)
+
+	if persistence {
+		dir, err := ioutil.TempDir("", "batcher-bench")
+		if err != nil {
+			b.Fatalf("tempdir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		persist, err = openWalStore(dir, "interval", 1<<30)
+		if err != nil {
+			b.Fatalf("openWalStore: %v", err)
+		}
+		defer func() {
+			persist.close()
+			persist = nil
+		}()
+	}
+
+	batchTable.initTable()
+	q := newIngestQueue(4096)
+	q.start(&batchTable)
+	defer q.stop()
+
+	router := net.ParseIP("192.0.2.1")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mac := make(net.HardwareAddr, 6)
+		for i := 0; pb.Next(); i++ {
+			mac[4], mac[5] = byte(i>>8), byte(i)
+			ip := net.IPv4(10, 0, mac[4], mac[5])
+			if _, err := q.submit(context.Background(), time.Now(), "0", router, mac, ip, ""); err != nil && err != errIngestFull {
+				b.Fatalf("submit: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkIngestQueue_Submit(b *testing.B) {
+	benchmarkIngestQueue(b, false)
+}
+
+func BenchmarkIngestQueue_SubmitPersisted(b *testing.B) {
+	benchmarkIngestQueue(b, true)
+}
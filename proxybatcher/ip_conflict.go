@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// duplicate IP detection. the batch and lease tables are keyed by MAC, an IP index next to them tracks which MAC
+// holds each active IP. a second MAC claiming an IP that's still active on another is a duplicate, logged and
+// published as a "duplicate_ip" event. batch_duplicate_ip_policy decides what goes to Sonar:
+//
+// send_both    both assignments are sent, whichever Sonar applies last wins (default, the behaviour without an index)
+// send_newest  the new claim is sent along with an expiry for the previous holder
+// hold         the new claim is held back until the previous holder expires, moves or goes quiet for
+//              batch_order_window, then it's sent
+//
+// held claims are persisted with the batch table. they're listed on /api/held_ips, where one can be released (sent
+// alongside the holder) or dropped. a held claim leaving the hold is published as a "duplicate_ip" event with status
+// released or dropped.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	dupIPSendBoth   = "send_both"
+	dupIPSendNewest = "send_newest"
+	dupIPHold       = "hold"
+)
+
+// duplicateIPPolicy is batch_duplicate_ip_policy with its default
+func duplicateIPPolicy() string {
+	if p := strings.ToLower(options.Batch.DuplicateIPPolicy); p != "" {
+		return p
+	}
+	return dupIPSendBoth
+}
+
+type duplicateIP struct {
+	holder string
+	status string
+	send   []Assignment
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// indexIP(), called by UpdateBatchTableAt() with the table locked
+//
+// updates the IP index for x, prev is what lastSeen held for the MAC before x. returns the duplicate (holder is empty
+// when there's none) and any extra assignments to send: the previous holder's expiry for send_newest, or held claims
+// released by an expiry.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (b *recordTable) indexIP(x Assignment, prev macSeen) duplicateIP {
+	var dup duplicateIP
+
+	// the MAC moved, its old IP is free
+	if prev.ip != "" && prev.ip != x.IpAddress && b.ipIndex[prev.ip] == x.MacAddress {
+		delete(b.ipIndex, prev.ip)
+		dup.send = append(dup.send, b.releaseHeld(prev.ip)...)
+	}
+
+	if x.Expired == "1" {
+		b.dropHeld(x.MacAddress, "the MAC expired")
+		if b.ipIndex[x.IpAddress] == x.MacAddress {
+			delete(b.ipIndex, x.IpAddress)
+			dup.send = append(dup.send, b.releaseHeld(x.IpAddress)...)
+		}
+		return dup
+	}
+
+	holder := b.ipIndex[x.IpAddress]
+	if h, ok := b.lastSeen[holder]; holder == "" || holder == x.MacAddress || !ok || h.ip != x.IpAddress || h.expired != "0" {
+		b.ipIndex[x.IpAddress] = x.MacAddress
+		b.dropHeld(x.MacAddress, "superseded by a newer assignment")
+		return dup
+	}
+
+	b.duplicates++
+	dup.holder = holder
+
+	switch b.dupPolicy {
+	case dupIPHold:
+		b.held[x.MacAddress] = x
+		persist.hold(x, b.lastSeen[x.MacAddress], holder, b.lastSeen[holder])
+		dup.status = "held"
+	case dupIPSendNewest:
+		h := b.lastSeen[holder]
+		h.expired = "1"
+		b.lastSeen[holder] = h
+		b.ipIndex[x.IpAddress] = x.MacAddress
+		dup.send = append(dup.send, Assignment{Expired: "1", IpAddress: x.IpAddress, MacAddress: holder, RemoteID: b.entry[holder].RemoteID})
+		dup.status = "replaced"
+	default:
+		b.ipIndex[x.IpAddress] = x.MacAddress
+		dup.status = "sent_both"
+	}
+	return dup
+}
+
+// releaseHeld hands the IP to the newest held claim on it, the rest stay held against the new holder
+func (b *recordTable) releaseHeld(ip string) []Assignment {
+	var newest string
+	for k, v := range b.held {
+		if v.IpAddress == ip && (newest == "" || b.lastSeen[k].at.After(b.lastSeen[newest].at)) {
+			newest = k
+		}
+	}
+	if newest == "" {
+		return nil
+	}
+
+	x := b.held[newest]
+	delete(b.held, newest)
+	persist.unhold(newest)
+	b.ipIndex[ip] = newest
+	logger.Info("scheduler updater: releasing held assignment ", ip, "[", newest, "], the previous holder is gone")
+	publishHeld(x, "", "released")
+	return []Assignment{x}
+}
+
+// dropHeld forgets the held claim for mac without sending it, called with the table locked
+func (b *recordTable) dropHeld(mac string, reason string) {
+	x, ok := b.held[mac]
+	if !ok {
+		return
+	}
+	delete(b.held, mac)
+	persist.unhold(mac)
+	logger.Warn("scheduler updater: dropped held assignment ", x.IpAddress, "[", mac, "], ", reason)
+	publishHeld(x, b.ipIndex[x.IpAddress], "dropped")
+}
+
+// pruneIPIndex drops IPs whose holder has been forgotten by pruneSeen() and releases the claims held against them,
+// called with the table locked. pruneSeen() keeps the held MACs, so a held claim only leaves through its holder.
+func (b *recordTable) pruneIPIndex() []Assignment {
+	var send []Assignment
+	for ip, mac := range b.ipIndex {
+		if _, ok := b.lastSeen[mac]; !ok {
+			delete(b.ipIndex, ip)
+			send = append(send, b.releaseHeld(ip)...)
+		}
+	}
+	for _, x := range b.held {
+		if _, ok := b.ipIndex[x.IpAddress]; !ok {
+			send = append(send, b.releaseHeld(x.IpAddress)...)
+		}
+	}
+	return send
+}
+
+func publishHeld(x Assignment, holder string, status string) {
+	events.publish(batchEvent{
+		Type:       eventDuplicateIP,
+		MacAddress: x.MacAddress,
+		IpAddress:  x.IpAddress,
+		RemoteID:   x.RemoteID,
+		PrevMac:    holder,
+		Status:     status,
+	})
+}
+
+type heldClaim struct {
+	MacAddress string    `json:"mac_address"`
+	IpAddress  string    `json:"ip_address"`
+	RemoteID   string    `json:"remote_id,omitempty"`
+	Holder     string    `json:"holder,omitempty"`
+	Seen       time.Time `json:"seen"`
+}
+
+// heldClaims lists the held claims by IP, with the MAC each is waiting on
+func (b *recordTable) heldClaims() []heldClaim {
+	b.rwTableMutex.Lock()
+	defer b.rwTableMutex.Unlock()
+
+	t := []heldClaim{}
+	for k, v := range b.held {
+		t = append(t, heldClaim{
+			MacAddress: k,
+			IpAddress:  v.IpAddress,
+			RemoteID:   v.RemoteID,
+			Holder:     b.ipIndex[v.IpAddress],
+			Seen:       b.lastSeen[k].at,
+		})
+	}
+	sort.Slice(t, func(i, j int) bool {
+		if t[i].IpAddress != t[j].IpAddress {
+			return t[i].IpAddress < t[j].IpAddress
+		}
+		return t[i].MacAddress < t[j].MacAddress
+	})
+	return t
+}
+
+// resolveHeld releases the held claim for mac, sending it alongside the holder the way send_both would, or drops it.
+// false when mac has nothing held.
+func (b *recordTable) resolveHeld(mac string, release bool) bool {
+	b.rwTableMutex.Lock()
+	defer b.rwTableMutex.Unlock()
+
+	x, ok := b.held[mac]
+	if !ok {
+		return false
+	}
+	if !release {
+		b.dropHeld(mac, "dropped on /api/held_ips")
+		return true
+	}
+
+	holder := b.ipIndex[x.IpAddress]
+	delete(b.held, mac)
+	persist.unhold(mac)
+	b.ipIndex[x.IpAddress] = mac
+	b.insert(x)
+	logger.Info("scheduler updater: releasing held assignment ", x.IpAddress, "[", mac, "] on /api/held_ips, ", holder, " still holds it")
+	publishHeld(x, holder, "released")
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// HeldIPHandler, /api/held_ips
+//
+// authenticated with events_username / events_password. GET lists the held claims as JSON, POST with mac and
+// action=release or action=drop resolves one.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func HeldIPHandler(w http.ResponseWriter, r *http.Request) {
+	remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	username, password, ok := r.BasicAuth()
+	if !ok || username != options.Events.Username || password != options.Events.Password {
+		endpointLogger("/api/held_ips", "failure (credentials)", remoteHost, r.URL.RawQuery, nil, "auth")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := json.Marshal(batchTable.heldClaims())
+		if err != nil {
+			logger.Error("held IPs: error marshalling held claims to JSON")
+			logger.Error(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case http.MethodPost:
+		q := r.URL.Query()
+		mac, err := net.ParseMAC(q.Get("mac"))
+		if err != nil {
+			endpointLogger("/api/held_ips", "unable to parse 'mac'", remoteHost, r.URL.RawQuery, err, "post")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		action := strings.ToLower(q.Get("action"))
+		if action != "release" && action != "drop" {
+			endpointLogger("/api/held_ips", "'action' must be release or drop", remoteHost, r.URL.RawQuery, nil, "post")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !batchTable.resolveHeld(mac.String(), action == "release") {
+			endpointLogger("/api/held_ips", "nothing held for 'mac'", remoteHost, r.URL.RawQuery, nil, "post")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		endpointLogger("/api/held_ips", action+" success", remoteHost, r.URL.RawQuery, nil, "post")
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func publishDuplicateIP(routerIP net.IP, mac string, ip string, remoteID string, holder string, status string) {
+	logger.Warn("duplicate IP ", ip, " claimed by ", mac, " is active on ", holder, ", ", status, " by batch_duplicate_ip_policy")
+
+	events.publish(batchEvent{
+		Type:       eventDuplicateIP,
+		RouterIP:   eventIP(routerIP),
+		MacAddress: mac,
+		IpAddress:  ip,
+		RemoteID:   remoteID,
+		PrevMac:    holder,
+		Status:     status,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// indexLease(), called by addLease() with the lease table locked
+//
+// proxy mode keeps the IP index for detection only, the whole lease table goes out every cycle so the policy is
+// applied by resolveDuplicateIPs() when the assignments are built. returns the previous holder of a duplicate.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (l *leaseRecord) indexLease(a lease) string {
+	holder := l.ipIndex[a.ip]
+	l.ipIndex[a.ip] = a.mac
+
+	if h, ok := l.entry[holder]; holder != "" && holder != a.mac && ok && h.ip == a.ip && h.state < leaseExpired {
+		return holder
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// resolveDuplicateIPs(), called by proxyAssignments()
+//
+// applies batch_duplicate_ip_policy to the proxy mode assignments. send_newest sends the older holders as expired,
+// hold leaves the newer claims out until the oldest holder's lease expires.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func resolveDuplicateIPs(leases []lease) []Assignment {
+	policy := duplicateIPPolicy()
+
+	active := make(map[string][]int)
+	for i, v := range leases {
+		if v.state < leaseExpired {
+			active[v.ip] = append(active[v.ip], i)
+		}
+	}
+
+	skip := make(map[int]bool)
+	expire := make(map[int]bool)
+	for _, idx := range active {
+		if len(idx) < 2 {
+			continue
+		}
+		sort.Slice(idx, func(i, j int) bool { return leases[idx[i]].timeStamp.Before(leases[idx[j]].timeStamp) })
+
+		switch policy {
+		case dupIPSendNewest:
+			for _, i := range idx[:len(idx)-1] {
+				expire[i] = true
+			}
+		case dupIPHold:
+			for _, i := range idx[1:] {
+				skip[i] = true
+			}
+		}
+	}
+
+	var t []Assignment
+	for i, v := range leases {
+		if skip[i] {
+			continue
+		}
+		x := Assignment{
+			Expired:    v.state.flag(),
+			IpAddress:  v.ip,
+			MacAddress: v.mac,
+			RemoteID:   v.rid,
+		}
+		if expire[i] {
+			x.Expired = "1"
+		}
+		t = append(t, x)
+	}
+	return t
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDuplicateIPPolicy(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	macA, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	macB, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+	ip := net.ParseIP("192.168.1.10")
+	now := time.Now()
+
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	c := events.subscribe(eventFilter{types: map[string]bool{eventDuplicateIP: true}})
+	defer events.unsubscribe(c)
+
+	tests := []struct {
+		policy string
+		status string
+		want   map[string]string
+	}{
+		{"", "sent_both", map[string]string{"aa:bb:cc:dd:ee:f0": "0", "aa:bb:cc:dd:ee:f1": "0"}},
+		{"send_newest", "replaced", map[string]string{"aa:bb:cc:dd:ee:f0": "1", "aa:bb:cc:dd:ee:f1": "0"}},
+		{"hold", "held", map[string]string{"aa:bb:cc:dd:ee:f0": "0"}},
+	}
+
+	for _, v := range tests {
+		options.Batch.DuplicateIPPolicy = v.policy
+		batchTable.initTable()
+
+		batchTable.UpdateBatchTableAt(now, "0", router, macA, ip, "")
+		batchTable.UpdateBatchTableAt(now.Add(time.Second), "0", router, macB, ip, "")
+
+		if len(batchTable.entry) != len(v.want) {
+			t.Errorf("%q - expected %v entries, got %+v", v.policy, len(v.want), batchTable.entry)
+		}
+		for mac, expired := range v.want {
+			if e, ok := batchTable.entry[mac]; !ok || e.Expired != expired {
+				t.Errorf("%q - %v expected expired %v, got %+v", v.policy, mac, expired, e)
+			}
+		}
+
+		select {
+		case ev := <-c:
+			if ev.Status != v.status || ev.MacAddress != "aa:bb:cc:dd:ee:f1" || ev.PrevMac != "aa:bb:cc:dd:ee:f0" {
+				t.Errorf("%q - unexpected duplicate_ip event %+v", v.policy, ev)
+			}
+		default:
+			t.Errorf("%q - expected a duplicate_ip event", v.policy)
+		}
+	}
+
+	// the held claim goes out once the holder expires the IP
+	batchTable.takeEntries()
+	batchTable.UpdateBatchTableAt(now.Add(2*time.Second), "1", router, macA, ip, "")
+	if e, ok := batchTable.entry["aa:bb:cc:dd:ee:f1"]; !ok || e.Expired != "0" {
+		t.Errorf("expected the held claim to be released, got %+v", batchTable.entry)
+	}
+	if len(batchTable.held) != 0 || batchTable.ipIndex["192.168.1.10"] != "aa:bb:cc:dd:ee:f1" {
+		t.Errorf("expected the IP to move to the held MAC, got %+v %+v", batchTable.held, batchTable.ipIndex)
+	}
+
+	// a MAC renewing its own IP, or moving to a free one, isn't a duplicate
+	options.Batch.DuplicateIPPolicy = ""
+	batchTable.initTable()
+	batchTable.UpdateBatchTableAt(now, "0", router, macA, ip, "")
+	batchTable.UpdateBatchTableAt(now.Add(time.Second), "0", router, macA, ip, "")
+	batchTable.UpdateBatchTableAt(now.Add(2*time.Second), "0", router, macA, net.ParseIP("192.168.1.11"), "")
+	batchTable.UpdateBatchTableAt(now.Add(3*time.Second), "0", router, macB, ip, "")
+	if batchTable.duplicates != 0 {
+		t.Errorf("expected no duplicates, got %v", batchTable.duplicates)
+	}
+}
+
+func TestHeldClaimOrderWindow(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	macA, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	macB, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+	ip := net.ParseIP("192.168.1.10")
+	then := time.Now().Add(-2 * time.Hour)
+
+	dir, err := ioutil.TempDir("", "batcher-held")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+	options.Batch.DuplicateIPPolicy = "hold"
+
+	persist, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("openWalStore: %v", err)
+	}
+	defer func() { persist.close(); persist = nil }()
+
+	c := events.subscribe(eventFilter{types: map[string]bool{eventDuplicateIP: true}})
+	defer events.unsubscribe(c)
+
+	// the holder renews inside the window, the claim stays held however old it is
+	batchTable.initTable()
+	batchTable.UpdateBatchTableAt(then, "0", router, macA, ip, "")
+	batchTable.UpdateBatchTableAt(then.Add(time.Second), "0", router, macB, ip, "")
+	batchTable.UpdateBatchTableAt(time.Now(), "0", router, macA, ip, "")
+	<-c
+
+	id, entries := batchTable.takeEntries()
+	if len(entries) != 1 || entries[0].MacAddress != "aa:bb:cc:dd:ee:f0" {
+		t.Errorf("expected just the holder in the batch, got %+v", entries)
+	}
+	persist.sent(id)
+	if _, ok := batchTable.held["aa:bb:cc:dd:ee:f1"]; !ok {
+		t.Fatalf("expected the held claim to survive the order window, got %+v", batchTable.held)
+	}
+
+	// the held claim is replayed in front of the same holder
+	persist.close()
+	persist, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	batchTable.initTable()
+	persist.restoreBatchTable(&batchTable)
+	if _, ok := batchTable.held["aa:bb:cc:dd:ee:f1"]; !ok || batchTable.ipIndex["192.168.1.10"] != "aa:bb:cc:dd:ee:f0" {
+		t.Fatalf("expected the held claim to be restored, got %+v %+v", batchTable.held, batchTable.ipIndex)
+	}
+	if claims := batchTable.heldClaims(); len(claims) != 1 || claims[0].Holder != "aa:bb:cc:dd:ee:f0" {
+		t.Errorf("expected one held claim on f0, got %+v", claims)
+	}
+
+	// the holder goes quiet for the window, the claim is released into the next batch
+	batchTable.lastSeen["aa:bb:cc:dd:ee:f0"] = macSeen{at: then, router: router.String(), ip: ip.String(), expired: "0"}
+	_, entries = batchTable.takeEntries()
+	if len(entries) != 1 || entries[0].MacAddress != "aa:bb:cc:dd:ee:f1" || entries[0].Expired != "0" {
+		t.Errorf("expected the held claim to be released, got %+v", entries)
+	}
+	if len(batchTable.held) != 0 || batchTable.ipIndex["192.168.1.10"] != "aa:bb:cc:dd:ee:f1" {
+		t.Errorf("expected the IP to move to the held MAC, got %+v %+v", batchTable.held, batchTable.ipIndex)
+	}
+	select {
+	case ev := <-c:
+		if ev.Status != "released" || ev.MacAddress != "aa:bb:cc:dd:ee:f1" {
+			t.Errorf("unexpected duplicate_ip event %+v", ev)
+		}
+	default:
+		t.Errorf("expected a released duplicate_ip event")
+	}
+
+	// nothing is held after a restart once the claim went out
+	persist.close()
+	persist, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if len(persist.state.held) != 0 {
+		t.Errorf("expected no held claims in the log, got %+v", persist.state.held)
+	}
+}
+
+func TestResolveHeld(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	macA, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	macB, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+	macC, _ := net.ParseMAC("AA:BB:CC:DD:EE:F2")
+	ip := net.ParseIP("192.168.1.10")
+	now := time.Now()
+
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+	options.Batch.DuplicateIPPolicy = "hold"
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTableAt(now, "0", router, macA, ip, "")
+	batchTable.UpdateBatchTableAt(now.Add(time.Second), "0", router, macB, ip, "")
+	batchTable.UpdateBatchTableAt(now.Add(2*time.Second), "0", router, macC, ip, "")
+	batchTable.takeEntries()
+
+	if batchTable.resolveHeld("aa:bb:cc:dd:ee:f0", true) {
+		t.Errorf("expected nothing to resolve for the holder")
+	}
+	if !batchTable.resolveHeld("aa:bb:cc:dd:ee:f1", false) {
+		t.Errorf("expected f1 to be dropped")
+	}
+	if !batchTable.resolveHeld("aa:bb:cc:dd:ee:f2", true) {
+		t.Errorf("expected f2 to be released")
+	}
+	if _, ok := batchTable.entry["aa:bb:cc:dd:ee:f1"]; ok || len(batchTable.held) != 0 {
+		t.Errorf("expected f1 to be gone, got %+v %+v", batchTable.entry, batchTable.held)
+	}
+	if _, ok := batchTable.entry["aa:bb:cc:dd:ee:f2"]; !ok || batchTable.ipIndex["192.168.1.10"] != "aa:bb:cc:dd:ee:f2" {
+		t.Errorf("expected f2 to be sent and hold the IP, got %+v %+v", batchTable.entry, batchTable.ipIndex)
+	}
+}
+
+func TestResolveDuplicateIPs(t *testing.T) {
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	now := time.Now()
+	leases := []lease{
+		{mac: "aa:bb:cc:dd:ee:f0", ip: "192.168.1.10", timeStamp: now, state: leaseActive},
+		{mac: "aa:bb:cc:dd:ee:f1", ip: "192.168.1.10", timeStamp: now.Add(time.Second), state: leaseActive},
+		{mac: "aa:bb:cc:dd:ee:f2", ip: "192.168.1.11", timeStamp: now, state: leaseActive},
+	}
+
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{"send_both", map[string]string{"aa:bb:cc:dd:ee:f0": "0", "aa:bb:cc:dd:ee:f1": "0", "aa:bb:cc:dd:ee:f2": "0"}},
+		{"send_newest", map[string]string{"aa:bb:cc:dd:ee:f0": "1", "aa:bb:cc:dd:ee:f1": "0", "aa:bb:cc:dd:ee:f2": "0"}},
+		{"hold", map[string]string{"aa:bb:cc:dd:ee:f0": "0", "aa:bb:cc:dd:ee:f2": "0"}},
+	}
+
+	for _, v := range tests {
+		options.Batch.DuplicateIPPolicy = v.policy
+		got := make(map[string]string)
+		for _, a := range resolveDuplicateIPs(leases) {
+			got[a.MacAddress] = a.Expired
+		}
+		if len(got) != len(v.want) {
+			t.Errorf("%v - expected %+v, got %+v", v.policy, v.want, got)
+			continue
+		}
+		for mac, expired := range v.want {
+			if got[mac] != expired {
+				t.Errorf("%v - %v expected expired %v, got %v", v.policy, mac, expired, got[mac])
+			}
+		}
+	}
+
+	// the lease table index detects the duplicate
+	var l leaseRecord
+	l.init()
+	l.entry[leases[0].mac] = leases[0]
+	l.indexLease(leases[0])
+	if holder := l.indexLease(leases[1]); holder != "aa:bb:cc:dd:ee:f0" {
+		t.Errorf("expected the lease index to report the holder, got %q", holder)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// Kea source ("kea" operation mode), two ways in, either or both can be enabled:
+//
+// hook     Kea hook callouts (a run_script script or similar) POST lease events as JSON to kea_hook_address, they
+//          are applied to the batch table as they come in.
+// control  the Kea control channel (unix socket, or the control agent over HTTP) is polled with lease4-get-all,
+//          the result is diffed against the previous poll like the lease files are.
+//
+// hook payload, "lease" is a lease4 record as returned by lease4-get / lease4-get-all:
+//
+// {"event": "leases4_committed", "lease": {"ip-address": "192.168.1.10", "hw-address": "aa:bb:cc:dd:ee:f0", ...}}
+// {"event": "lease4_expire", "leases": [{...}, {...}]}
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type keaLease struct {
+	IpAddress   string          `json:"ip-address"`
+	HwAddress   string          `json:"hw-address"`
+	ValidLft    int64           `json:"valid-lft"`
+	Cltt        int64           `json:"cltt"`
+	State       int             `json:"state"`
+	UserContext json.RawMessage `json:"user-context"`
+}
+
+type keaHookEvent struct {
+	Event  string     `json:"event"`
+	Lease  *keaLease  `json:"lease"`
+	Leases []keaLease `json:"leases"`
+}
+
+type keaResponse struct {
+	Result    int             `json:"result"`
+	Text      string          `json:"text"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// keaExpiryEvents are the hook points where the lease stops being in use
+var keaExpiryEvents = map[string]bool{
+	"lease4_release": true,
+	"lease4_expire":  true,
+	"lease4_decline": true,
+}
+
+// entry converts a Kea lease4 record, state 0 is the only assigned state
+func (l keaLease) entry() (leaseFileEntry, bool) {
+	ip := net.ParseIP(l.IpAddress)
+	mac, err := net.ParseMAC(l.HwAddress)
+	if ip == nil || err != nil {
+		return leaseFileEntry{}, false
+	}
+
+	e := leaseFileEntry{
+		mac:    mac.String(),
+		ip:     ip.String(),
+		active: l.State == 0 && l.ValidLft != 0,
+	}
+	if len(l.UserContext) > 0 {
+		e.remoteID = keaRemoteID(string(l.UserContext))
+	}
+	// a valid-lft of 0xffffffff is an infinite lease
+	if l.Cltt != 0 && l.ValidLft != 0 && l.ValidLft != 4294967295 {
+		e.ends = time.Unix(l.Cltt+l.ValidLft, 0)
+	}
+	return e, true
+}
+
+func keaRouterIP() net.IP {
+	if ip := net.ParseIP(options.Kea.RouterIP); ip != nil {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// KeaHookHandler, /api/kea
+//
+// applies the leases in a hook callout to the batch table. kea_hook_username / kea_hook_password enable basic auth,
+// without them checkConfig() only lets the endpoint bind to loopback.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func KeaHookHandler(w http.ResponseWriter, r *http.Request) {
+	remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	if options.Kea.HookUsername != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != options.Kea.HookUsername || password != options.Kea.HookPassword {
+			endpointLogger("/api/kea", "failure (credentials)", remoteHost, r.URL.RawQuery, nil, "auth")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ev keaHookEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&ev); err != nil {
+		endpointLogger("/api/kea", "failure (unable to decode hook JSON)", remoteHost, r.URL.RawQuery, err, "post")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	leases := ev.Leases
+	if ev.Lease != nil {
+		leases = append(leases, *ev.Lease)
+	}
+
+	routerIP := keaRouterIP()
+	applied := 0
+	for _, l := range leases {
+		e, ok := l.entry()
+		if !ok {
+			continue
+		}
+		expired := "0"
+		if keaExpiryEvents[strings.ToLower(ev.Event)] || !e.active {
+			expired = "1"
+		}
+		mac, _ := net.ParseMAC(e.mac)
+		batchTable.UpdateBatchTable(expired, routerIP, mac, net.ParseIP(e.ip), e.remoteID)
+		applied++
+	}
+
+	logger.Debug("kea: hook ", ev.Event, " applied ", applied, " of ", len(leases), " leases")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// keaCommand(), called by fetchKeaLeases()
+//
+// sends a command over the control channel. the unix socket takes the bare command and closes the connection after
+// answering, the control agent wants the service named and answers with a list, one response per service.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func keaCommand(command string) (keaResponse, error) {
+	var res keaResponse
+
+	if options.Kea.ControlSocket != "" {
+		conn, err := net.DialTimeout("unix", options.Kea.ControlSocket, 5*time.Second)
+		if err != nil {
+			return res, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		req, _ := json.Marshal(map[string]string{"command": command})
+		if _, err := conn.Write(req); err != nil {
+			return res, err
+		}
+
+		// no framing, the response is complete once it decodes
+		dec := json.NewDecoder(conn)
+		if err := dec.Decode(&res); err != nil {
+			return res, err
+		}
+		return res, nil
+	}
+
+	req, _ := json.Marshal(map[string]interface{}{"command": command, "service": []string{"dhcp4"}})
+	httpReq, err := http.NewRequest("POST", options.Kea.ControlURL, bytes.NewReader(req))
+	if err != nil {
+		return res, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if options.Kea.ControlUsername != "" {
+		httpReq.SetBasicAuth(options.Kea.ControlUsername, options.Kea.ControlPassword)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return res, err
+	}
+	defer httpRes.Body.Close()
+
+	data, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return res, err
+	}
+	if httpRes.StatusCode < 200 || httpRes.StatusCode > 299 {
+		return res, errors.New("control agent returned " + httpRes.Status)
+	}
+
+	var list []keaResponse
+	if err := json.Unmarshal(data, &list); err != nil {
+		return res, err
+	}
+	if len(list) == 0 {
+		return res, errors.New("control agent returned an empty response")
+	}
+	return list[0], nil
+}
+
+// fetchKeaLeases fetches every lease4 over the control channel, result 3 is Kea for "no leases"
+func fetchKeaLeases() ([]leaseFileEntry, error) {
+	res, err := keaCommand("lease4-get-all")
+	if err != nil {
+		return nil, err
+	}
+	if res.Result == 3 {
+		return nil, nil
+	}
+	if res.Result != 0 {
+		return nil, errors.New("lease4-get-all failed (result " + strconv.Itoa(res.Result) + "): " + res.Text)
+	}
+
+	var args struct {
+		Leases []keaLease `json:"leases"`
+	}
+	if err := json.Unmarshal(res.Arguments, &args); err != nil {
+		return nil, err
+	}
+
+	var entries []leaseFileEntry
+	for _, l := range args.Leases {
+		if e, ok := l.entry(); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// pollKea(), called by startKeaSource()
+//
+// polls lease4-get-all and diffs a snapshot against the previous poll. a failed poll keeps the previous snapshot so
+// a Kea restart doesn't expire every lease. runs until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func pollKea(interval time.Duration, ctl chan bool) {
+	routerIP := keaRouterIP()
+	prev := make(leaseSnapshot)
+
+	poll := func() {
+		entries, err := fetchKeaLeases()
+		if err != nil {
+			logger.Warn("kea: unable to fetch leases over the control channel")
+			logger.Warn("kea: ", err.Error())
+			return
+		}
+
+		cur := snapshotAt(entries, time.Now())
+		changes := diffSnapshots(prev, cur)
+		prev = cur
+
+		if len(changes) > 0 {
+			logger.Info("kea: ", len(changes), " lease change(s)")
+			applySnapshotChanges(changes, routerIP)
+		}
+	}
+
+	poll()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			logger.Debug("kea: control channel poller exit..")
+			return
+		case <-t.C:
+			poll()
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startKeaSource, called by main()
+//
+// starts the hook endpoint and / or the control channel poller, routines are concurrent and will run until stop
+// signal is sent. returns an error when the hook endpoint won't bind.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startKeaSource(ctl chan bool) error {
+	var server *http.Server
+	if options.Kea.HookAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/kea", KeaHookHandler)
+
+		server = &http.Server{
+			Addr:              options.Kea.HookAddress,
+			Handler:           mux,
+			ReadTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       120 * time.Second,
+		}
+
+		ln, err := net.Listen("tcp", options.Kea.HookAddress)
+		if err != nil {
+			logger.Error("kea: unable to listen on ", options.Kea.HookAddress)
+			logger.Error("kea: ", err.Error())
+			return err
+		}
+
+		go func() {
+			logger.Info("kea: starting hook endpoint on ", options.Kea.HookAddress)
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Error("kea: hook endpoint error")
+				logger.Error("kea: ", err.Error())
+			}
+		}()
+	}
+
+	var pollerStop chan bool
+	if options.Kea.ControlSocket != "" || options.Kea.ControlURL != "" {
+		interval := time.Duration(options.Kea.PollInterval) * time.Second
+		if interval == 0 {
+			interval = 30 * time.Second
+		}
+		pollerStop = make(chan bool)
+		go pollKea(interval, pollerStop)
+	}
+
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
+
+	if pollerStop != nil {
+		pollerStop <- true
+	}
+	if server != nil {
+		server.Close()
+	}
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("kea: exit..")
+	return nil
+}
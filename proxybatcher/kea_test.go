@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var keaLeaseGetAll = `{"result": 0, "text": "2 IPv4 lease(s) found.", "arguments": {"leases": [
+	{"ip-address": "192.168.1.10", "hw-address": "aa:bb:cc:dd:ee:f0", "valid-lft": 4294967295, "cltt": 1589553091, "state": 0,
+	 "user-context": {"ISC": {"relay-agent-info": {"sub-options": "0x0104657468300207726F7574657231"}}}},
+	{"ip-address": "192.168.1.11", "hw-address": "aa:bb:cc:dd:ee:f1", "valid-lft": 3600, "cltt": 1589553091, "state": 2}
+]}}`
+
+// fakeKeaSocket answers one command per connection like the Kea control socket does
+func fakeKeaSocket(t *testing.T, response string) (string, func()) {
+	dir, err := ioutil.TempDir("", "batcher-kea")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	path := filepath.Join(dir, "kea4-ctrl-socket")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req map[string]interface{}
+			json.NewDecoder(conn).Decode(&req)
+			if req["command"] == "lease4-get-all" {
+				conn.Write([]byte(response))
+			} else {
+				conn.Write([]byte(`{"result": 2, "text": "'` + req["command"].(string) + `' command not supported."}`))
+			}
+			conn.Close()
+		}
+	}()
+
+	return path, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKeaControlSocket(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	path, cleanup := fakeKeaSocket(t, keaLeaseGetAll)
+	defer cleanup()
+	options.Kea = keaConfig{ControlSocket: path}
+
+	entries, err := fetchKeaLeases()
+	if err != nil {
+		t.Fatalf("fetchKeaLeases: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 leases, got %v", len(entries))
+	}
+
+	if e := entries[0]; e.mac != "aa:bb:cc:dd:ee:f0" || e.ip != "192.168.1.10" || !e.active || !e.ends.IsZero() || e.remoteID != "router1" {
+		t.Errorf("unexpected infinite lease %+v", e)
+	}
+	if e := entries[1]; e.active {
+		t.Errorf("expected the reclaimed lease to be inactive, got %+v", e)
+	}
+
+	// "no leases" isn't an error
+	empty, cleanupEmpty := fakeKeaSocket(t, `{"result": 3, "text": "0 IPv4 lease(s) found.", "arguments": {"leases": []}}`)
+	defer cleanupEmpty()
+	options.Kea.ControlSocket = empty
+
+	if entries, err := fetchKeaLeases(); err != nil || len(entries) != 0 {
+		t.Errorf("expected no leases and no error, got %v, %v", entries, err)
+	}
+}
+
+func TestKeaControlAgent(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Command string   `json:"command"`
+			Service []string `json:"service"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Command != "lease4-get-all" || len(req.Service) != 1 || req.Service[0] != "dhcp4" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("[" + keaLeaseGetAll + "]"))
+	}))
+	defer server.Close()
+
+	options.Kea = keaConfig{ControlURL: server.URL}
+
+	entries, err := fetchKeaLeases()
+	if err != nil {
+		t.Fatalf("fetchKeaLeases: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 leases, got %v", len(entries))
+	}
+}
+
+func TestKeaHookHandler(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.Kea = keaConfig{HookUsername: "kea", HookPassword: "keahookpassword1", RouterIP: "192.0.2.1"}
+	batchTable.initTable()
+
+	tests := []struct {
+		body    string
+		auth    bool
+		status  int
+		expired string
+	}{
+		{`{"event": "leases4_committed", "lease": {"ip-address": "192.168.1.10", "hw-address": "aa:bb:cc:dd:ee:f0", "valid-lft": 3600, "state": 0}}`, false, http.StatusUnauthorized, ""},
+		{`{"event": "leases4_committed", "lease": {"ip-address": "192.168.1.10", "hw-address": "aa:bb:cc:dd:ee:f0", "valid-lft": 3600, "state": 0}}`, true, http.StatusNoContent, "0"},
+		{`{"event": "lease4_release", "leases": [{"ip-address": "192.168.1.10", "hw-address": "aa:bb:cc:dd:ee:f0", "valid-lft": 3600, "state": 0}]}`, true, http.StatusNoContent, "1"},
+		{`{"event": "leases4_committed", "lease": `, true, http.StatusBadRequest, ""},
+	}
+
+	for _, v := range tests {
+		req := httptest.NewRequest("POST", "/api/kea", strings.NewReader(v.body))
+		req.RemoteAddr = "127.0.0.1:40000"
+		if v.auth {
+			req.SetBasicAuth("kea", "keahookpassword1")
+		}
+		rec := httptest.NewRecorder()
+		KeaHookHandler(rec, req)
+
+		if rec.Code != v.status {
+			t.Errorf("%v - got status %v want %v", v.body, rec.Code, v.status)
+			continue
+		}
+		if v.expired == "" {
+			continue
+		}
+
+		a, ok := batchTable.entry["aa:bb:cc:dd:ee:f0"]
+		if !ok || a.Expired != v.expired || a.IpAddress != "192.168.1.10" {
+			t.Errorf("%v - got %+v", v.body, a)
+		}
+	}
+}
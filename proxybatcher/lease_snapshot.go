@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// lease snapshots, for the sources that can only see the full lease table at a point in time (lease files, polled
+// servers) rather than individual events. each poll produces a snapshot keyed by MAC, diffSnapshots() turns two
+// consecutive snapshots into the assignments and expiries that need batching.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type leaseSnapshot map[string]Assignment
+
+// add keeps an active lease over an expired one when a MAC shows up more than once (old leases on other addresses)
+func (s leaseSnapshot) add(a Assignment) {
+	if existing, ok := s[a.MacAddress]; ok && existing.Expired == "0" && a.Expired != "0" {
+		return
+	}
+	s[a.MacAddress] = a
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// diffSnapshots(), called by the snapshot based sources
+//
+// returns every entry that is new or changed in cur, plus an expiry for every active entry in prev that has
+// disappeared from cur (dnsmasq and RouterOS simply drop released or expired leases).
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func diffSnapshots(prev leaseSnapshot, cur leaseSnapshot) []Assignment {
+	var changes []Assignment
+
+	for mac, a := range cur {
+		if p, ok := prev[mac]; ok && p == a {
+			continue
+		}
+		changes = append(changes, a)
+	}
+
+	for mac, p := range prev {
+		if _, ok := cur[mac]; ok || p.Expired != "0" {
+			continue
+		}
+		p.Expired = "1"
+		changes = append(changes, p)
+	}
+
+	return changes
+}
+
+// applySnapshotChanges feeds the changes into the batch table on behalf of routerIP
+func applySnapshotChanges(changes []Assignment, routerIP net.IP) {
+	for _, a := range changes {
+		mac, err := net.ParseMAC(a.MacAddress)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(a.IpAddress)
+		if ip == nil {
+			continue
+		}
+		batchTable.UpdateBatchTable(a.Expired, routerIP, mac, ip, a.RemoteID)
+	}
+}
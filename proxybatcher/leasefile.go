@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// lease file source ("leasefile" operation mode), for sites running their own DHCP server on a linux box. the lease
+// database is polled and parsed, lease state transitions are turned into assignments / expiries in the batch table.
+//
+// supported formats:
+//
+// isc      ISC dhcpd dhcpd.leases, an append-only journal, the last block for an address wins
+// dnsmasq  dnsmasq.leases, a full rewrite on every change, a lease that disappears has been released or expired
+// kea      Kea memfile lease4 CSV, append-only like ISC, state 1 (declined) and 2 (expired-reclaimed) are expired
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// leaseFileEntry is a parsed lease, expiry is worked out against the clock on every poll so leases that run out
+// without the server touching the file still get expired.
+type leaseFileEntry struct {
+	mac      string
+	ip       string
+	remoteID string
+	ends     time.Time
+	active   bool
+}
+
+type leaseFileParser func(data []byte) ([]leaseFileEntry, error)
+
+var leaseFileParsers = map[string]leaseFileParser{
+	"isc":     parseISCLeases,
+	"dnsmasq": parseDnsmasqLeases,
+	"kea":     parseKeaLeases,
+}
+
+// snapshotAt turns the parsed entries into a snapshot as of now
+func snapshotAt(entries []leaseFileEntry, now time.Time) leaseSnapshot {
+	s := make(leaseSnapshot)
+	for _, e := range entries {
+		a := Assignment{
+			Expired:    "1",
+			IpAddress:  e.ip,
+			MacAddress: e.mac,
+			RemoteID:   e.remoteID,
+		}
+		if e.active && (e.ends.IsZero() || now.Before(e.ends)) {
+			a.Expired = "0"
+		}
+		s.add(a)
+	}
+	return s
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseISCLeases(), ISC dhcpd.leases
+//
+// dhcpd writes one statement per line, which is all we rely on:
+//
+// lease 192.168.1.10 {
+//   ends 5 2020/05/15 14:31:31;         (or "ends epoch 1589553091;" with db-time-format local, or "ends never;")
+//   binding state active;
+//   hardware ethernet aa:bb:cc:dd:ee:f0;
+//   option agent.remote-id "router1";   (only with stash-agent-options, may be colon separated hex instead)
+// }
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseISCLeases(data []byte) ([]leaseFileEntry, error) {
+	byIP := make(map[string]int)
+	var entries []leaseFileEntry
+	var current *leaseFileEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == nil {
+			if strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{") {
+				ip := net.ParseIP(strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "lease "), "{")))
+				if ip != nil {
+					current = &leaseFileEntry{ip: ip.String()}
+				}
+			}
+			continue
+		}
+
+		if line == "}" {
+			if current.mac != "" {
+				// a later block for the same address supersedes the earlier one
+				if i, ok := byIP[current.ip]; ok {
+					entries[i] = *current
+				} else {
+					byIP[current.ip] = len(entries)
+					entries = append(entries, *current)
+				}
+			}
+			current = nil
+			continue
+		}
+
+		line = strings.TrimSuffix(line, ";")
+		switch {
+		case strings.HasPrefix(line, "binding state "):
+			current.active = strings.TrimPrefix(line, "binding state ") == "active"
+		case strings.HasPrefix(line, "hardware ethernet "):
+			if mac, err := net.ParseMAC(strings.TrimPrefix(line, "hardware ethernet ")); err == nil {
+				current.mac = mac.String()
+			}
+		case strings.HasPrefix(line, "ends "):
+			current.ends = parseISCTime(strings.TrimPrefix(line, "ends "))
+		case strings.HasPrefix(line, "option agent.remote-id "):
+			current.remoteID = parseISCString(strings.TrimPrefix(line, "option agent.remote-id "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseISCTime handles "W YYYY/MM/DD HH:MM:SS" (UTC), "epoch N" and "never" (zero time, never expires)
+func parseISCTime(v string) time.Time {
+	if strings.HasPrefix(v, "epoch ") {
+		f := strings.Fields(v)
+		if len(f) < 2 {
+			return time.Time{}
+		}
+		if n, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+		return time.Time{}
+	}
+
+	f := strings.Fields(v)
+	if len(f) != 3 {
+		return time.Time{}
+	}
+	t, err := time.Parse("2006/01/02 15:04:05", f[1]+" "+f[2])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// parseISCString handles quoted strings and colon separated hex
+func parseISCString(v string) string {
+	if strings.HasPrefix(v, "\"") {
+		if s, err := strconv.Unquote(v); err == nil {
+			return s
+		}
+		return strings.Trim(v, "\"")
+	}
+
+	var b []byte
+	for _, x := range strings.Split(v, ":") {
+		n, err := strconv.ParseUint(x, 16, 8)
+		if err != nil {
+			return v
+		}
+		b = append(b, byte(n))
+	}
+	return string(b)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseDnsmasqLeases(), dnsmasq.leases
+//
+// <expiry epoch> <mac> <ip> <hostname> <client id>, expiry 0 is an infinite lease. the DHCPv6 section (after the
+// "duid" line) has an IAID where the MAC would be and is skipped.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseDnsmasqLeases(data []byte) ([]leaseFileEntry, error) {
+	var entries []leaseFileEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 3 || f[0] == "duid" {
+			continue
+		}
+
+		mac, err := net.ParseMAC(f[1])
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(f[2])
+		if ip == nil {
+			continue
+		}
+
+		e := leaseFileEntry{
+			mac:    mac.String(),
+			ip:     ip.String(),
+			active: true,
+		}
+		if n, err := strconv.ParseInt(f[0], 10, 64); err == nil && n != 0 {
+			e.ends = time.Unix(n, 0)
+		}
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseKeaLeases(), Kea memfile lease4 CSV
+//
+// columns are located by the header (address, hwaddr, valid_lifetime, expire, state, user_context), commas inside
+// fields are escaped by Kea as "&#x2c". a valid_lifetime of 0 is Kea recording a deleted lease.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseKeaLeases(data []byte) ([]leaseFileEntry, error) {
+	byIP := make(map[string]int)
+	var entries []leaseFileEntry
+	columns := make(map[string]int)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if strings.HasPrefix(line, "address,") {
+			for i, name := range fields {
+				columns[name] = i
+			}
+			continue
+		}
+		if len(columns) == 0 {
+			return nil, errors.New("kea lease file has no header line")
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.Replace(fields[i], "&#x2c", ",", -1)
+			}
+			return ""
+		}
+
+		ip := net.ParseIP(field("address"))
+		mac, err := net.ParseMAC(field("hwaddr"))
+		if ip == nil || err != nil {
+			continue
+		}
+
+		e := leaseFileEntry{
+			mac:      mac.String(),
+			ip:       ip.String(),
+			remoteID: keaRemoteID(field("user_context")),
+			active:   field("state") == "0" && field("valid_lifetime") != "0",
+		}
+		if n, err := strconv.ParseInt(field("expire"), 10, 64); err == nil {
+			e.ends = time.Unix(n, 0)
+		}
+
+		if i, ok := byIP[e.ip]; ok {
+			entries[i] = e
+		} else {
+			byIP[e.ip] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// keaRemoteID(), called by parseKeaLeases()
+//
+// Kea keeps the relay agent information in the lease user context. older releases store the raw option 82 data as
+// a hex string, newer ones a map with the raw data in "sub-options" and the remote id already pulled out.
+//
+// {"ISC": {"relay-agent-info": "0x0104..."}}
+// {"ISC": {"relay-agent-info": {"sub-options": "0x0104...", "remote-id": "0x..."}}}
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func keaRemoteID(userContext string) string {
+	if userContext == "" {
+		return ""
+	}
+
+	var uc struct {
+		ISC struct {
+			RelayAgentInfo json.RawMessage `json:"relay-agent-info"`
+		} `json:"ISC"`
+	}
+	if err := json.Unmarshal([]byte(userContext), &uc); err != nil || len(uc.ISC.RelayAgentInfo) == 0 {
+		return ""
+	}
+
+	var raw string
+	if err := json.Unmarshal(uc.ISC.RelayAgentInfo, &raw); err != nil {
+		var info struct {
+			SubOptions string `json:"sub-options"`
+			RemoteID   string `json:"remote-id"`
+		}
+		if err := json.Unmarshal(uc.ISC.RelayAgentInfo, &info); err != nil {
+			return ""
+		}
+		if info.RemoteID != "" {
+			return string(decodeKeaHex(info.RemoteID))
+		}
+		raw = info.SubOptions
+	}
+
+	info, err := parseRelayAgentInfo(decodeKeaHex(raw))
+	if err != nil {
+		return ""
+	}
+	return string(info.remoteID)
+}
+
+func decodeKeaHex(v string) []byte {
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "0x"), "0X")
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// tailLeaseFile(), called by startLeaseFileSource()
+//
+// polls the lease file, re-parses it when the size or modification time changes, and diffs a fresh snapshot against
+// the previous one on every poll. runs until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func tailLeaseFile(src leaseFileSource, interval time.Duration, ctl chan bool) {
+	parse := leaseFileParsers[strings.ToLower(src.Format)]
+	routerIP := net.ParseIP(src.RouterIP)
+	if routerIP == nil {
+		routerIP = net.IPv4(127, 0, 0, 1)
+	}
+
+	var entries []leaseFileEntry
+	var modTime time.Time
+	var size int64 = -1
+	prev := make(leaseSnapshot)
+
+	poll := func() {
+		fi, err := os.Stat(src.Path)
+		if err != nil {
+			logger.Warn("leasefile: unable to stat ", src.Path)
+			logger.Warn("leasefile: ", err.Error())
+			return
+		}
+
+		if !fi.ModTime().Equal(modTime) || fi.Size() != size {
+			data, err := ioutil.ReadFile(src.Path)
+			if err != nil {
+				logger.Warn("leasefile: unable to read ", src.Path)
+				logger.Warn("leasefile: ", err.Error())
+				return
+			}
+			parsed, err := parse(data)
+			if err != nil {
+				logger.Warn("leasefile: unable to parse ", src.Path)
+				logger.Warn("leasefile: ", err.Error())
+				return
+			}
+			entries = parsed
+			modTime = fi.ModTime()
+			size = fi.Size()
+			logger.Debug("leasefile: ", src.Path, " parsed, ", len(entries), " leases")
+		}
+
+		cur := snapshotAt(entries, time.Now())
+		changes := diffSnapshots(prev, cur)
+		prev = cur
+
+		if len(changes) > 0 {
+			logger.Info("leasefile: ", src.Path, " ", len(changes), " lease change(s)")
+			applySnapshotChanges(changes, routerIP)
+		}
+	}
+
+	logger.Info("leasefile: watching ", src.Path, " (", src.Format, ")")
+	poll()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			logger.Debug("leasefile: ", src.Path, " exit..")
+			return
+		case <-t.C:
+			poll()
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startLeaseFileSource, called by main()
+//
+// starts a watcher per configured lease file, routines are concurrent and will run until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startLeaseFileSource(ctl chan bool) error {
+	interval := time.Duration(options.LeaseFile.PollInterval) * time.Second
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	var stops []chan bool
+	for _, src := range options.LeaseFile.Sources {
+		stop := make(chan bool)
+		stops = append(stops, stop)
+		go tailLeaseFile(src, interval, stop)
+	}
+
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
+
+	for _, s := range stops {
+		s <- true
+	}
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("leasefile: exit..")
+	return nil
+}
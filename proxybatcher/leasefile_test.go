@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.4.1
+
+authoring-byte-order little-endian;
+
+lease 192.168.1.10 {
+  starts 4 2020/05/14 14:31:31;
+  ends 5 2020/05/15 14:31:31;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:f0;
+  option agent.remote-id "router1";
+}
+lease 192.168.1.11 {
+  ends epoch 1589553091; # Fri May 15 14:31:31 2020
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:f1;
+  option agent.remote-id 72:6f:75:74:65:72:32;
+}
+lease 192.168.1.12 {
+  ends never;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:f2;
+}
+lease 192.168.1.10 {
+  ends 5 2020/05/15 14:31:31;
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:f0;
+}
+`
+
+var dnsmasqLeases = `1589553091 aa:bb:cc:dd:ee:f0 192.168.1.10 host1 01:aa:bb:cc:dd:ee:f0
+0 aa:bb:cc:dd:ee:f1 192.168.1.11 * *
+duid 00:01:00:01:26:4b:63:0c:52:54:00:12:34:56
+1589553091 1234567 2001:db8::10 host3 00:01:00:01
+`
+
+var keaLeases = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.168.1.10,aa:bb:cc:dd:ee:f0,,3600,1589553091,1,0,0,,0,{ "ISC": { "relay-agent-info": "0x0104657468300207726F7574657231" } }
+192.168.1.11,aa:bb:cc:dd:ee:f1,,3600,1589553091,1,0,0,host&#x2cwith&#x2ccomma,0,{ "ISC": { "relay-agent-info": { "sub-options": "0x0104657468300207726F7574657231"&#x2c "remote-id": "0x726F7574657232" } } }
+192.168.1.12,aa:bb:cc:dd:ee:f2,,3600,1589553091,1,0,0,,2,
+192.168.1.10,aa:bb:cc:dd:ee:f0,,0,1589553091,1,0,0,,0,
+`
+
+func TestLeaseFileParsers(t *testing.T) {
+	// one second before the leases run out
+	now := time.Unix(1589553090, 0)
+
+	type want struct {
+		ip       string
+		expired  string
+		remoteID string
+	}
+
+	tests := []struct {
+		format string
+		data   string
+		want   map[string]want
+	}{
+		{"isc", iscLeases, map[string]want{
+			"aa:bb:cc:dd:ee:f0": {"192.168.1.10", "1", ""},
+			"aa:bb:cc:dd:ee:f1": {"192.168.1.11", "0", "router2"},
+			"aa:bb:cc:dd:ee:f2": {"192.168.1.12", "0", ""},
+		}},
+		{"dnsmasq", dnsmasqLeases, map[string]want{
+			"aa:bb:cc:dd:ee:f0": {"192.168.1.10", "0", ""},
+			"aa:bb:cc:dd:ee:f1": {"192.168.1.11", "0", ""},
+		}},
+		{"kea", keaLeases, map[string]want{
+			"aa:bb:cc:dd:ee:f0": {"192.168.1.10", "1", ""},
+			"aa:bb:cc:dd:ee:f1": {"192.168.1.11", "0", "router2"},
+			"aa:bb:cc:dd:ee:f2": {"192.168.1.12", "1", ""},
+		}},
+	}
+
+	for _, v := range tests {
+		entries, err := leaseFileParsers[v.format]([]byte(v.data))
+		if err != nil {
+			t.Errorf("%v - parse error: %v", v.format, err)
+			continue
+		}
+
+		s := snapshotAt(entries, now)
+		if len(s) != len(v.want) {
+			t.Errorf("%v - expected %v leases, got %v", v.format, len(v.want), len(s))
+		}
+
+		for mac, w := range v.want {
+			a, ok := s[mac]
+			if !ok {
+				t.Errorf("%v - lease for %v missing", v.format, mac)
+				continue
+			}
+			if a.IpAddress != w.ip || a.Expired != w.expired || a.RemoteID != w.remoteID {
+				t.Errorf("%v - %v, got ip:%v expired:%v remote_id:%v want ip:%v expired:%v remote_id:%v", v.format, mac, a.IpAddress, a.Expired, a.RemoteID, w.ip, w.expired, w.remoteID)
+			}
+		}
+	}
+
+	// the same leases a couple of seconds later have run out
+	entries, _ := parseDnsmasqLeases([]byte(dnsmasqLeases))
+	s := snapshotAt(entries, now.Add(2*time.Second))
+	if s["aa:bb:cc:dd:ee:f0"].Expired != "1" || s["aa:bb:cc:dd:ee:f1"].Expired != "0" {
+		t.Errorf("dnsmasq - expected only the finite lease to expire, got %+v", s)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	prev := leaseSnapshot{
+		"aa:bb:cc:dd:ee:f0": {Expired: "0", IpAddress: "192.168.1.10", MacAddress: "aa:bb:cc:dd:ee:f0"},
+		"aa:bb:cc:dd:ee:f1": {Expired: "0", IpAddress: "192.168.1.11", MacAddress: "aa:bb:cc:dd:ee:f1"},
+		"aa:bb:cc:dd:ee:f2": {Expired: "1", IpAddress: "192.168.1.12", MacAddress: "aa:bb:cc:dd:ee:f2"},
+	}
+	cur := leaseSnapshot{
+		"aa:bb:cc:dd:ee:f0": {Expired: "0", IpAddress: "192.168.1.10", MacAddress: "aa:bb:cc:dd:ee:f0"},
+		"aa:bb:cc:dd:ee:f3": {Expired: "0", IpAddress: "192.168.1.13", MacAddress: "aa:bb:cc:dd:ee:f3"},
+	}
+
+	changes := diffSnapshots(prev, cur)
+
+	got := make(map[string]string)
+	for _, a := range changes {
+		got[a.MacAddress] = a.Expired
+	}
+
+	// unchanged f0 and already expired f2 produce nothing, f1 disappeared, f3 is new
+	if len(got) != 2 || got["aa:bb:cc:dd:ee:f1"] != "1" || got["aa:bb:cc:dd:ee:f3"] != "0" {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
+
+func TestParseISCTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"epoch 1589553091":      time.Unix(1589553091, 0),
+		"5 2020/05/15 14:31:31": time.Date(2020, 5, 15, 14, 31, 31, 0, time.UTC),
+		"never":                 {},
+		"epoch ":                {},
+		"epoch x":               {},
+		"5 2020/05/15":          {},
+	}
+	for v, want := range tests {
+		if got := parseISCTime(v); !got.Equal(want) {
+			t.Errorf("%q - expected %v, got %v", v, want, got)
+		}
+	}
+}
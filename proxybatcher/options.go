@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -20,11 +21,18 @@ import (
 var options programConfig
 
 type programConfig struct {
-	OperationMode string        `yaml:"operation_mode"`
-	Sonar         sonarConfig   `yaml:"sonar"`
-	Batch         batchConfig   `yaml:"batch"`
-	Proxy         proxyConfig   `yaml:"proxy"`
-	Logging       loggingConfig `yaml:"logging"`
+	OperationMode string          `yaml:"operation_mode"`
+	Sonar         sonarConfig     `yaml:"sonar"`
+	Batch         batchConfig     `yaml:"batch"`
+	Proxy         proxyConfig     `yaml:"proxy"`
+	Logging       loggingConfig   `yaml:"logging"`
+	Events        eventsConfig    `yaml:"events"`
+	LeaseFile     leaseFileConfig `yaml:"leasefile"`
+	Syslog        syslogConfig    `yaml:"syslog"`
+	Kea           keaConfig       `yaml:"kea"`
+	Radius        radiusConfig    `yaml:"radius"`
+	Snoop         snoopConfig     `yaml:"snoop"`
+	Persistence   persistConfig   `yaml:"persistence"`
 }
 
 type sonarConfig struct {
@@ -33,12 +41,19 @@ type sonarConfig struct {
 	ApiKey       string `yaml:"sonar_api_key"`
 	InstanceName string `yaml:"sonar_instance"`
 	BearerToken  string `yaml:"sonar_bearer_token"`
+	Timeout      int    `yaml:"sonar_timeout"`
 }
 
 type batchRouterAuth struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	RouterIP string `yaml:"router_ip"`
+	Username         string `yaml:"username"`
+	Password         string `yaml:"password"`
+	RouterIP         string `yaml:"router_ip"`
+	ApiUsername      string `yaml:"api_username"`
+	ApiPassword      string `yaml:"api_password"`
+	ApiPort          string `yaml:"api_port"`
+	ApiUseTLS        bool   `yaml:"api_tls"`
+	ApiTLSSkipVerify bool   `yaml:"api_tls_skip_verify"`
+	PollInterval     int    `yaml:"poll_interval"`
 }
 
 type batchConfig struct {
@@ -52,13 +67,133 @@ type batchConfig struct {
 	TlsServerPort      string            `yaml:"batch_tls_port"`
 	SchedulerCycleTime int               `yaml:"batch_cycle_time"`
 	Routers            []batchRouterAuth `yaml:"batch_routers"`
+	TlsReloadInterval  int               `yaml:"batch_tls_reload_interval"`
+	TlsExpiryWarnDays  int               `yaml:"batch_tls_expiry_warn_days"`
+	TlsProfile         string            `yaml:"batch_tls_profile"`
+	TlsMinVersion      string            `yaml:"batch_tls_min_version"`
+	TlsMaxVersion      string            `yaml:"batch_tls_max_version"`
+	TlsCipherSuites    []string          `yaml:"batch_tls_ciphers"`
+	TlsCurves          []string          `yaml:"batch_tls_curves"`
+	TlsLegacyPort      string            `yaml:"batch_tls_legacy_port"`
+	TlsLegacyProfile   string            `yaml:"batch_tls_legacy_profile"`
+	Listeners          []batchListener   `yaml:"batch_listeners"`
+	ShutdownTimeout    int               `yaml:"batch_shutdown_timeout"`
+	FlushSize          int               `yaml:"batch_flush_size"`
+	FlushAge           int               `yaml:"batch_flush_age"`
+	ImmediateExpiry    bool              `yaml:"batch_immediate_expiry"`
+	Jitter             int               `yaml:"batch_jitter"`
+	OrderWindow        int               `yaml:"batch_order_window"`
+	ConflictPolicy     string            `yaml:"batch_conflict_policy"`
+	DuplicateIPPolicy  string            `yaml:"batch_duplicate_ip_policy"`
+	QueueSize          int               `yaml:"batch_queue_size"`
+}
+
+type batchListener struct {
+	Address         string `yaml:"address"`
+	Network         string `yaml:"network"`
+	UseTLS          bool   `yaml:"tls"`
+	TlsProfile      string `yaml:"tls_profile"`
+	RedirectTLSPort string `yaml:"redirect_tls_port"`
 }
 
 type proxyConfig struct {
-	UpstreamInterface   string   `yaml:"proxy_upstream_if"`
-	DownstreamInterface string   `yaml:"proxy_downstream_if"`
-	UpstreamServerIPs   []string `yaml:"proxy_upstream_dhcp_ips"`
-	ProxyServerIP       string   `yaml:"proxy_server_ip"`
+	UpstreamInterface   string                `yaml:"proxy_upstream_if"`
+	DownstreamInterface string                `yaml:"proxy_downstream_if"`
+	UpstreamServerIPs   []string              `yaml:"proxy_upstream_dhcp_ips"`
+	ProxyServerIP       string                `yaml:"proxy_server_ip"`
+	TransactionTTL      int                   `yaml:"proxy_transaction_ttl"`
+	TransactionMax      int                   `yaml:"proxy_transaction_max"`
+	Option82            bool                  `yaml:"proxy_option82"`
+	Option82CircuitID   string                `yaml:"proxy_option82_circuit_id"`
+	Option82RemoteID    string                `yaml:"proxy_option82_remote_id"`
+	Option82Static      []option82Static      `yaml:"proxy_option82_static"`
+	Option82MaxSize     int                   `yaml:"proxy_option82_max_size"`
+	Option82Trusted     []string              `yaml:"proxy_option82_trusted"`
+	UpstreamPolicy      string                `yaml:"proxy_upstream_policy"`
+	UpstreamTimeout     int                   `yaml:"proxy_upstream_timeout"`
+	UpstreamFailures    int                   `yaml:"proxy_upstream_failures"`
+	UpstreamRetry       int                   `yaml:"proxy_upstream_retry"`
+	LinkSelection       []linkSelectionConfig `yaml:"proxy_link_selection"`
+	LeaseGrace          int                   `yaml:"proxy_lease_grace"`
+}
+
+type linkSelectionConfig struct {
+	Subnet           string `yaml:"subnet"`
+	Interface        string `yaml:"interface"`
+	Link             string `yaml:"link"`
+	ServerIDOverride bool   `yaml:"server_id_override"`
+}
+
+type option82Static struct {
+	Interface string `yaml:"interface"`
+	CircuitID string `yaml:"circuit_id"`
+	RemoteID  string `yaml:"remote_id"`
+}
+
+type leaseFileConfig struct {
+	Sources      []leaseFileSource `yaml:"leasefile_sources"`
+	PollInterval int               `yaml:"leasefile_poll_interval"`
+}
+
+type leaseFileSource struct {
+	Path     string `yaml:"path"`
+	Format   string `yaml:"format"`
+	RouterIP string `yaml:"router_ip"`
+}
+
+type syslogConfig struct {
+	Address   string           `yaml:"syslog_address"`
+	Protocols []string         `yaml:"syslog_protocols"`
+	Formats   []string         `yaml:"syslog_formats"`
+	Templates []syslogTemplate `yaml:"syslog_templates"`
+}
+
+type syslogTemplate struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	Expired string `yaml:"expired"`
+}
+
+type keaConfig struct {
+	HookAddress     string `yaml:"kea_hook_address"`
+	HookUsername    string `yaml:"kea_hook_username"`
+	HookPassword    string `yaml:"kea_hook_password"`
+	ControlSocket   string `yaml:"kea_control_socket"`
+	ControlURL      string `yaml:"kea_control_url"`
+	ControlUsername string `yaml:"kea_control_username"`
+	ControlPassword string `yaml:"kea_control_password"`
+	PollInterval    int    `yaml:"kea_poll_interval"`
+	RouterIP        string `yaml:"kea_router_ip"`
+}
+
+type radiusConfig struct {
+	Address string             `yaml:"radius_address"`
+	Clients []radiusClientAuth `yaml:"radius_clients"`
+}
+
+type snoopConfig struct {
+	Interface string `yaml:"snoop_if"`
+	PcapFile  string `yaml:"snoop_pcap"`
+}
+
+type radiusClientAuth struct {
+	NasIP    string `yaml:"nas_ip"`
+	Secret   string `yaml:"secret"`
+	RemoteID string `yaml:"remote_id"`
+}
+
+type persistConfig struct {
+	Path           string `yaml:"persistence_path"`
+	Fsync          string `yaml:"persistence_fsync"`
+	FsyncInterval  int    `yaml:"persistence_fsync_interval"`
+	CompactRecords int    `yaml:"persistence_compact_records"`
+}
+
+type eventsConfig struct {
+	Enabled  bool   `yaml:"events_enabled"`
+	Address  string `yaml:"events_address"`
+	Username string `yaml:"events_username"`
+	Password string `yaml:"events_password"`
 }
 
 type loggingConfig struct {
@@ -164,15 +299,92 @@ func checkConfig() error {
 
 	if strings.ToLower(options.OperationMode) == "batch" {
 
-		if options.Batch.IsTLSEnabled {
+		usesTLS := false
+		for _, l := range batchListeners() {
+			if l.UseTLS {
+				usesTLS = true
+			}
+		}
+
+		if usesTLS {
 			if _, err := os.Stat(options.Batch.TlsKey); err != nil {
 				return errors.New("(batch_tls_key) TLS key not found")
 			}
 			if _, err := os.Stat(options.Batch.TlsCert); err != nil {
 				return errors.New("(batch_tls_cert) TLS cert not found")
 			}
-			if _, err := strconv.Atoi(options.Batch.TlsServerPort); err != nil {
-				return errors.New("(batch_tls_port) TLS port must be an integer")
+			if options.Batch.TlsReloadInterval < 0 {
+				return errors.New("(batch_tls_reload_interval) TLS reload interval can't be negative")
+			}
+			if options.Batch.TlsExpiryWarnDays < 0 {
+				return errors.New("(batch_tls_expiry_warn_days) TLS expiry warning days can't be negative")
+			}
+			if _, err := resolveTLSProfile(options.Batch.TlsProfile, true); err != nil {
+				return err
+			}
+		}
+
+		if len(options.Batch.Listeners) == 0 {
+
+			if x := net.ParseIP(options.Batch.ServerIP); x == nil {
+				return errors.New("(batch_ip) unable to parse server IP")
+			}
+
+			if options.Batch.IsTLSEnabled {
+				if _, err := strconv.Atoi(options.Batch.TlsServerPort); err != nil {
+					return errors.New("(batch_tls_port) TLS port must be an integer")
+				}
+				if options.Batch.TlsLegacyPort != "" {
+					if _, err := strconv.Atoi(options.Batch.TlsLegacyPort); err != nil {
+						return errors.New("(batch_tls_legacy_port) TLS legacy port must be an integer")
+					}
+					if options.Batch.TlsLegacyPort == options.Batch.TlsServerPort {
+						return errors.New("(batch_tls_legacy_port) TLS legacy port must be different from batch_tls_port")
+					}
+					if options.Batch.TlsLegacyProfile != "" {
+						if _, ok := tlsProfileByName(options.Batch.TlsLegacyProfile); !ok {
+							return errors.New("(batch_tls_legacy_profile) unknown TLS profile, use [ modern | intermediate | legacy ]")
+						}
+					}
+				}
+			}
+		}
+
+		for _, l := range options.Batch.Listeners {
+			switch l.network() {
+			case "tcp", "tcp4", "tcp6":
+				host, port, err := net.SplitHostPort(l.Address)
+				if err != nil {
+					return errors.New("(batch_listeners) unable to parse listener address " + l.Address + ", use ip:port or [ipv6]:port")
+				}
+				if host != "" && net.ParseIP(host) == nil {
+					return errors.New("(batch_listeners) unable to parse listener IP " + host)
+				}
+				if _, err := strconv.Atoi(port); err != nil {
+					return errors.New("(batch_listeners) listener port must be an integer " + l.Address)
+				}
+			case "unix":
+				if l.Address == "" {
+					return errors.New("(batch_listeners) unix listener needs a socket path as its address")
+				}
+			default:
+				return errors.New("(batch_listeners) unknown listener network " + l.Network + ", use [ tcp | tcp4 | tcp6 | unix ]")
+			}
+
+			if l.TlsProfile != "" {
+				if _, ok := tlsProfileByName(l.TlsProfile); !ok {
+					return errors.New("(batch_listeners) unknown TLS profile " + l.TlsProfile + ", use [ modern | intermediate | legacy ]")
+				}
+			}
+
+			if l.UseTLS && l.RedirectTLSPort != "" {
+				return errors.New("(batch_listeners) listener " + l.Address + " can't be both a TLS endpoint and a redirect")
+			}
+
+			if l.RedirectTLSPort != "" {
+				if _, err := strconv.Atoi(l.RedirectTLSPort); err != nil {
+					return errors.New("(batch_listeners) redirect_tls_port must be an integer")
+				}
 			}
 		}
 
@@ -183,10 +395,6 @@ func checkConfig() error {
 		if len(options.Batch.EndpointPassword) < 16 {
 			return errors.New("(batch_password) endpoint password must be 16 or more characters")
 		}
-
-		if x := net.ParseIP(options.Batch.ServerIP); x == nil {
-			return errors.New("(batch_ip) unable to parse server IP")
-		}
 	}
 
 	if strings.ToLower(options.OperationMode) == "proxy" {
@@ -205,6 +413,293 @@ func checkConfig() error {
 			}
 
 		}
+
+		if options.Proxy.TransactionTTL < 0 {
+			return errors.New("(proxy_transaction_ttl) transaction ttl can't be negative")
+		}
+
+		if options.Proxy.TransactionMax < 0 {
+			return errors.New("(proxy_transaction_max) transaction table size can't be negative")
+		}
+
+		if p := strings.ToLower(options.Proxy.UpstreamPolicy); p != "" {
+			found := false
+			for _, policy := range upstreamPolicies {
+				found = found || p == policy
+			}
+			if !found {
+				return errors.New("(proxy_upstream_policy) unknown upstream policy " + options.Proxy.UpstreamPolicy + ", use [ broadcast | failover | round_robin | mac_hash ]")
+			}
+		}
+
+		if options.Proxy.UpstreamTimeout < 0 || options.Proxy.UpstreamFailures < 0 || options.Proxy.UpstreamRetry < 0 {
+			return errors.New("(proxy_upstream_timeout) upstream timeout, failures and retry can't be negative")
+		}
+
+		if options.Proxy.LeaseGrace < 0 {
+			return errors.New("(proxy_lease_grace) lease grace period can't be negative")
+		}
+
+		if _, err := newLinkSelector(options.Proxy.LinkSelection); err != nil {
+			return err
+		}
+
+		if options.Proxy.Option82 {
+			for _, v := range []struct{ key, source string }{
+				{"proxy_option82_circuit_id", options.Proxy.Option82CircuitID},
+				{"proxy_option82_remote_id", options.Proxy.Option82RemoteID},
+			} {
+				found := v.source == ""
+				for _, s := range option82Sources {
+					found = found || strings.ToLower(v.source) == s
+				}
+				if !found {
+					return errors.New("(" + v.key + ") unknown option 82 source " + v.source + ", use [ interface | vlan | giaddr | static | none ]")
+				}
+			}
+
+			if strings.ToLower(options.Proxy.Option82CircuitID) == "none" && strings.ToLower(options.Proxy.Option82RemoteID) == "none" {
+				return errors.New("(proxy_option82_circuit_id) option 82 needs a circuit id or a remote id")
+			}
+
+			for _, s := range options.Proxy.Option82Static {
+				if s.Interface == "" {
+					return errors.New("(proxy_option82_static) static entries need an interface")
+				}
+				if len(s.CircuitID) > 255 || len(s.RemoteID) > 255 {
+					return errors.New("(proxy_option82_static) circuit and remote id are limited to 255 characters")
+				}
+			}
+
+			if options.Proxy.Option82MaxSize != 0 && options.Proxy.Option82MaxSize < 576 {
+				return errors.New("(proxy_option82_max_size) max size must be at least 576 bytes")
+			}
+
+			// without a max size the limit comes from the upstream MTU, which has to be there at startup
+			if _, err := newRelayAgent(); err != nil {
+				return errors.New("(proxy_option82_max_size) " + err.Error() + ", set proxy_option82_max_size")
+			}
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "leasefile" {
+
+		if len(options.LeaseFile.Sources) == 0 {
+			return errors.New("(leasefile_sources) you need to specify at least one lease file to watch")
+		}
+
+		for _, src := range options.LeaseFile.Sources {
+			if _, ok := leaseFileParsers[strings.ToLower(src.Format)]; !ok {
+				return errors.New("(leasefile_sources) unknown lease file format " + src.Format + ", use [ isc | dnsmasq | kea ]")
+			}
+			if _, err := os.Stat(src.Path); err != nil {
+				return errors.New("(leasefile_sources) lease file " + src.Path + " not found")
+			}
+			if src.RouterIP != "" && net.ParseIP(src.RouterIP) == nil {
+				return errors.New("(leasefile_sources) unable to parse router_ip " + src.RouterIP)
+			}
+		}
+
+		if options.LeaseFile.PollInterval < 0 {
+			return errors.New("(leasefile_poll_interval) poll interval can't be negative")
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "syslog" {
+
+		if len(options.Batch.Routers) == 0 {
+			return errors.New("(batch_routers) you need to specify the routers allowed to send syslog")
+		}
+
+		if options.Syslog.Address != "" {
+			if _, _, err := net.SplitHostPort(options.Syslog.Address); err != nil {
+				return errors.New("(syslog_address) unable to parse listen address " + options.Syslog.Address)
+			}
+		}
+
+		for _, p := range options.Syslog.Protocols {
+			if p := strings.ToLower(p); p != "udp" && p != "tcp" {
+				return errors.New("(syslog_protocols) unknown protocol " + p + ", use [ udp | tcp ]")
+			}
+		}
+
+		if _, err := newSyslogReceiver(); err != nil {
+			return err
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "kea" {
+
+		if options.Kea.HookAddress == "" && options.Kea.ControlSocket == "" && options.Kea.ControlURL == "" {
+			return errors.New("(kea_hook_address) you need to enable the hook endpoint, the control channel, or both")
+		}
+
+		if options.Kea.HookAddress != "" {
+			host, _, err := net.SplitHostPort(options.Kea.HookAddress)
+			if err != nil {
+				return errors.New("(kea_hook_address) unable to parse listen address " + options.Kea.HookAddress)
+			}
+			// without credentials anything that can reach the endpoint can inject leases
+			if ip := net.ParseIP(host); options.Kea.HookUsername == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				return errors.New("(kea_hook_username) the hook endpoint needs kea_hook_username and kea_hook_password unless kea_hook_address is loopback")
+			}
+		}
+
+		if options.Kea.HookUsername != "" && len(options.Kea.HookPassword) < 16 {
+			return errors.New("(kea_hook_password) hook password must be 16 or more characters")
+		}
+
+		if options.Kea.ControlSocket != "" && options.Kea.ControlURL != "" {
+			return errors.New("(kea_control_socket) use either kea_control_socket or kea_control_url, not both")
+		}
+
+		if options.Kea.ControlURL != "" {
+			if u, err := url.Parse(options.Kea.ControlURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return errors.New("(kea_control_url) unable to parse control agent url " + options.Kea.ControlURL)
+			}
+		}
+
+		if options.Kea.PollInterval < 0 {
+			return errors.New("(kea_poll_interval) poll interval can't be negative")
+		}
+
+		if options.Kea.RouterIP != "" && net.ParseIP(options.Kea.RouterIP) == nil {
+			return errors.New("(kea_router_ip) unable to parse router ip " + options.Kea.RouterIP)
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "routeros" {
+
+		polled := 0
+		for _, r := range options.Batch.Routers {
+			if r.ApiUsername == "" {
+				continue
+			}
+			polled++
+			if net.ParseIP(r.RouterIP) == nil {
+				return errors.New("(batch_routers) unable to parse router_ip " + r.RouterIP)
+			}
+			if r.ApiPort != "" {
+				if p, err := strconv.Atoi(r.ApiPort); err != nil || p < 1 || p > 65535 {
+					return errors.New("(batch_routers) api_port for " + r.RouterIP + " must be between 1 and 65535")
+				}
+			}
+			if r.PollInterval < 0 {
+				return errors.New("(batch_routers) poll_interval for " + r.RouterIP + " can't be negative")
+			}
+		}
+
+		if polled == 0 {
+			return errors.New("(batch_routers) you need at least one router with api_username set to poll")
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "radius" {
+
+		if len(options.Radius.Clients) == 0 {
+			return errors.New("(radius_clients) you need to specify the NAS's allowed to send accounting")
+		}
+
+		if options.Radius.Address != "" {
+			if _, _, err := net.SplitHostPort(options.Radius.Address); err != nil {
+				return errors.New("(radius_address) unable to parse listen address " + options.Radius.Address)
+			}
+		}
+
+		for _, c := range options.Radius.Clients {
+			if net.ParseIP(c.NasIP) == nil {
+				return errors.New("(radius_clients) unable to parse nas_ip " + c.NasIP)
+			}
+			if len(c.Secret) < 8 {
+				return errors.New("(radius_clients) shared secret for " + c.NasIP + " must be 8 or more characters")
+			}
+			if r := strings.ToLower(c.RemoteID); r != "" && r != "user_name" && r != "nas_port_id" {
+				return errors.New("(radius_clients) unknown remote_id " + c.RemoteID + " for " + c.NasIP + ", use [ user_name | nas_port_id ]")
+			}
+		}
+	}
+
+	if strings.ToLower(options.OperationMode) == "snoop" {
+
+		if options.Snoop.Interface == "" && options.Snoop.PcapFile == "" {
+			return errors.New("(snoop_if) you need to specify the mirror interface to capture on, or a snoop_pcap file to read")
+		}
+
+		if options.Snoop.Interface != "" {
+			if _, err := net.InterfaceByName(options.Snoop.Interface); err != nil {
+				return errors.New("(snoop_if) unable to find interface " + options.Snoop.Interface)
+			}
+		}
+
+		if options.Snoop.PcapFile != "" {
+			if _, err := os.Stat(options.Snoop.PcapFile); err != nil {
+				return errors.New("(snoop_pcap) unable to read " + options.Snoop.PcapFile)
+			}
+		}
+	}
+
+	if options.Batch.ShutdownTimeout < 0 {
+		return errors.New("(batch_shutdown_timeout) shutdown timeout can't be negative")
+	}
+
+	if options.Batch.FlushSize < 0 {
+		return errors.New("(batch_flush_size) flush size can't be negative")
+	}
+
+	if options.Batch.FlushAge < 0 {
+		return errors.New("(batch_flush_age) flush age can't be negative")
+	}
+
+	if options.Batch.Jitter < 0 {
+		return errors.New("(batch_jitter) jitter can't be negative")
+	}
+
+	if options.Batch.OrderWindow < 0 {
+		return errors.New("(batch_order_window) order window can't be negative")
+	}
+
+	if p := strings.ToLower(options.Batch.ConflictPolicy); p != "" && p != "newest" && p != "owner" {
+		return errors.New("(batch_conflict_policy) unknown conflict policy " + options.Batch.ConflictPolicy + ", use [ newest | owner ]")
+	}
+
+	if p := strings.ToLower(options.Batch.DuplicateIPPolicy); p != "" && p != dupIPSendBoth && p != dupIPSendNewest && p != dupIPHold {
+		return errors.New("(batch_duplicate_ip_policy) unknown duplicate IP policy " + options.Batch.DuplicateIPPolicy + ", use [ send_both | send_newest | hold ]")
+	}
+
+	if options.Batch.QueueSize < 0 {
+		return errors.New("(batch_queue_size) queue size can't be negative")
+	}
+
+	if options.Persistence.Path != "" {
+
+		if f := strings.ToLower(options.Persistence.Fsync); f != "" && f != "always" && f != "interval" && f != "none" {
+			return errors.New("(persistence_fsync) unknown fsync policy " + options.Persistence.Fsync + ", use [ always | interval | none ]")
+		}
+
+		if options.Persistence.FsyncInterval < 0 {
+			return errors.New("(persistence_fsync_interval) fsync interval can't be negative")
+		}
+
+		if options.Persistence.CompactRecords < 0 {
+			return errors.New("(persistence_compact_records) compaction threshold can't be negative")
+		}
+	}
+
+	if options.Events.Enabled {
+
+		if len(options.Events.Username) < 5 {
+			return errors.New("(events_username) event stream username must be 5 or more characters")
+		}
+
+		if len(options.Events.Password) < 16 {
+			return errors.New("(events_password) event stream password must be 16 or more characters")
+		}
+
+		if options.Events.Address != "" {
+			if _, _, err := net.SplitHostPort(options.Events.Address); err != nil {
+				return errors.New("(events_address) unable to parse event stream address, use ip:port or [ipv6]:port")
+			}
+		}
 	}
 
 	if options.Sonar.Version < 1 && options.Sonar.Version > 2 {
@@ -239,6 +734,10 @@ func checkConfig() error {
 
 	}
 
+	if options.Sonar.Timeout < 0 {
+		return errors.New("(sonar_timeout) request timeout can't be negative")
+	}
+
 	options.Sonar.InstanceName = strings.ToLower(options.Sonar.InstanceName)
 	options.Sonar.InstanceName = strings.Replace(options.Sonar.InstanceName, "https://", "", 1)
 
@@ -254,78 +753,135 @@ func checkConfig() error {
 //
 // provides TLS configuration for TLS endpoint server, constructed as an independent function to allow more granular
 // configuration of the TLS Batch, as many older device firmwares might require tailoring ciphersuites to be TLS
-// compatible.
+// compatible. settings come from the named profile (see tls_profiles.go), with the batch_tls_* overrides applied on
+// top when applyOverrides is set -- the legacy listener takes its profile as-is.
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func configBatchModeTLS() tls.Config {
-	TLSConfig := tls.Config{
+func configBatchModeTLS(profileName string, applyOverrides bool) (*tls.Config, error) {
+	profile, err := resolveTLSProfile(profileName, applyOverrides)
+	if err != nil {
+		return nil, err
+	}
+
+	TLSConfig := &tls.Config{
 		PreferServerCipherSuites: true,
-		CurvePreferences: []tls.CurveID{
-			// tls.CurveP384,
-			tls.CurveP256,
-			tls.X25519,
-		},
-		MinVersion: tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-
-			// best disabled, as they don't provide forward secrecy, but might be necessary for some clients.
-			// enable at your own risk.
-
-			// tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			// tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-		},
-	}
-	return TLSConfig
+		CurvePreferences:         profile.curves,
+		MinVersion:               profile.minVersion,
+		MaxVersion:               profile.maxVersion,
+		CipherSuites:             profile.cipherSuites,
+	}
+	return TLSConfig, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// batchListeners(), called by checkConfig() and configBatchModeServers()
+//
+// returns the batch_listeners list, or when it's empty builds the equivalent list from the single address settings
+// (batch_ip, batch_http_port, batch_use_tls, batch_tls_port and batch_tls_legacy_port) so older config files keep
+// working unchanged.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func batchListeners() []batchListener {
+	if len(options.Batch.Listeners) > 0 {
+		return options.Batch.Listeners
+	}
+
+	if !options.Batch.IsTLSEnabled {
+		return []batchListener{
+			{Address: net.JoinHostPort(options.Batch.ServerIP, options.Batch.HttpServerPort)},
+		}
+	}
+
+	listeners := []batchListener{
+		{Address: net.JoinHostPort(options.Batch.ServerIP, options.Batch.HttpServerPort), RedirectTLSPort: options.Batch.TlsServerPort},
+		{Address: net.JoinHostPort(options.Batch.ServerIP, options.Batch.TlsServerPort), UseTLS: true},
+	}
+
+	if options.Batch.TlsLegacyPort != "" {
+		legacyProfile := options.Batch.TlsLegacyProfile
+		if legacyProfile == "" {
+			legacyProfile = "legacy"
+		}
+		listeners = append(listeners, batchListener{
+			Address:    net.JoinHostPort(options.Batch.ServerIP, options.Batch.TlsLegacyPort),
+			UseTLS:     true,
+			TlsProfile: legacyProfile,
+		})
+	}
+
+	return listeners
+}
+
+// network returns the listener network, tcp unless specified
+func (l batchListener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return strings.ToLower(l.Network)
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // configBatchModeServers(), called by startBatchModeServer()
 //
-// tls.Config is passed into this function and it gets applied to the http.Server listeners. provide either a insecure
-// http endpoint, or an http redirector + TLS endpoint for secure batching. constructed as an independant function to
+// builds one http.Server per batch listener. TLS listeners get their own tls.Config from their profile (listeners
+// without a tls_profile use batch_tls_profile plus the batch_tls_* overrides), with the certificate supplied by the
+// reloader. plain listeners with redirect_tls_port set only redirect to TLS. constructed as an independant function to
 // allow granular configuration of timeouts and other http.server parameters.
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func configBatchModeServers(TLSConfig *tls.Config) (http.Server, http.Server, error) {
-	var redirectConfig, endpointConfig http.Server
-	if options.Batch.IsTLSEnabled == true {
-		// http redirect
-		redirectConfig = http.Server{
-			Addr: options.Batch.ServerIP + ":" + options.Batch.HttpServerPort,
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				w.Header().Set("Connection", "close")
-				url := "https://" + options.Batch.ServerIP + ":" + options.Batch.TlsServerPort + req.URL.String()
-				http.Redirect(w, req, url, http.StatusMovedPermanently)
-			}),
-			ReadTimeout:       5 * time.Second,
-			ReadHeaderTimeout: 5 * time.Second,
-			WriteTimeout:      5 * time.Second,
-			IdleTimeout:       120 * time.Second,
-		}
-		// tls endpoint
-		endpointConfig = http.Server{
-			Addr:              options.Batch.ServerIP + ":" + options.Batch.TlsServerPort,
-			TLSConfig:         TLSConfig,
-			ReadTimeout:       5 * time.Second,
-			ReadHeaderTimeout: 5 * time.Second,
-			WriteTimeout:      10 * time.Second,
-			IdleTimeout:       120 * time.Second,
-		}
-		return redirectConfig, endpointConfig, nil
-	}
-	// http endpoint
-	endpointConfig = http.Server{
-		Addr:              options.Batch.ServerIP + ":" + options.Batch.HttpServerPort,
-		ReadTimeout:       5 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      5 * time.Second,
-		IdleTimeout:       120 * time.Second,
-	}
-	return http.Server{}, endpointConfig, nil
+func configBatchModeServers(reloader *certReloader) ([]*batchEndpoint, error) {
+	var endpoints []*batchEndpoint
+
+	for _, l := range batchListeners() {
+		e := &batchEndpoint{listener: l}
+
+		switch {
+		case l.UseTLS:
+			var TLSConfig *tls.Config
+			var err error
+			if l.TlsProfile == "" {
+				TLSConfig, err = configBatchModeTLS(options.Batch.TlsProfile, true)
+			} else {
+				TLSConfig, err = configBatchModeTLS(l.TlsProfile, false)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if reloader == nil {
+				return nil, errors.New("(batch_listeners) TLS listener " + l.Address + " configured without a TLS certificate")
+			}
+			TLSConfig.GetCertificate = reloader.GetCertificate
+
+			// tls endpoint
+			e.server = &http.Server{
+				TLSConfig:         TLSConfig,
+				ReadTimeout:       5 * time.Second,
+				ReadHeaderTimeout: 5 * time.Second,
+				WriteTimeout:      10 * time.Second,
+				IdleTimeout:       120 * time.Second,
+			}
+		case l.RedirectTLSPort != "":
+			// http redirect
+			e.server = &http.Server{
+				Handler:           redirectToTLS(l.RedirectTLSPort),
+				ReadTimeout:       5 * time.Second,
+				ReadHeaderTimeout: 5 * time.Second,
+				WriteTimeout:      5 * time.Second,
+				IdleTimeout:       120 * time.Second,
+			}
+		default:
+			// http endpoint
+			e.server = &http.Server{
+				ReadTimeout:       5 * time.Second,
+				ReadHeaderTimeout: 5 * time.Second,
+				WriteTimeout:      5 * time.Second,
+				IdleTimeout:       120 * time.Second,
+			}
+		}
+
+		e.server.Addr = l.Address
+		endpoints = append(endpoints, e)
+	}
+
+	return endpoints, nil
 }
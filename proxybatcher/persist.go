@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// batch table / lease table persistence, a JSON lines write-ahead log in persistence_path. every change to the
+// tables is appended before it is acted on, on startup the log is replayed so assignments received since the last
+// dispatch survive a restart or a crash.
+//
+// records:
+//
+// put    an assignment added to the batch table
+// batch  the batch table was drained into batch number N and handed to the dispatcher, or just the listed MACs
+//        when only the expiries were flushed
+// sent   batch N was accepted by Sonar, or refused and its assignments put back in the batch table, either way
+//        the batch can be forgotten
+// lease  a proxy mode lease was added or expired, stored with an absolute expiry
+// hold   a duplicate IP claim held back by batch_duplicate_ip_policy "hold", with the holder it's waiting on
+// unhold the held claims for the listed MACs were released or dropped
+//
+// batches that were never marked sent are put back in the batch table on replay and go out with the next batch, held
+// claims are held again against the same holder.
+// the log is rewritten with just the live state on startup and whenever it grows past persistence_compact_records.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	walOpPut    = "put"
+	walOpBatch  = "batch"
+	walOpSent   = "sent"
+	walOpLease  = "lease"
+	walOpHold   = "hold"
+	walOpUnhold = "unhold"
+
+	walFile = "batcher.wal"
+)
+
+type walRecord struct {
+	Op         string      `json:"op"`
+	Batch      batchID     `json:"batch,omitempty"`
+	Macs       []string    `json:"macs,omitempty"`
+	Assignment *Assignment `json:"assignment,omitempty"`
+	Lease      *walLease   `json:"lease,omitempty"`
+	Hold       *walHold    `json:"hold,omitempty"`
+}
+
+type walLease struct {
+	Mac       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Router    string    `json:"router,omitempty"`
+	ServerID  string    `json:"server_id,omitempty"`
+	CircuitID string    `json:"circuit_id,omitempty"`
+	RemoteID  string    `json:"remote_id,omitempty"`
+	AgentInfo string    `json:"agent_info,omitempty"`
+	LeaseTime uint32    `json:"lease_time,omitempty"`
+	T1        time.Time `json:"t1,omitempty"`
+	T2        time.Time `json:"t2,omitempty"`
+	Expires   time.Time `json:"expires"`
+	Expired   string    `json:"expired"`
+	State     string    `json:"state,omitempty"`
+}
+
+// walHold is where a held claim and its holder were last seen, so ordering and the IP index pick up where they were
+type walHold struct {
+	Router       string    `json:"router,omitempty"`
+	Seen         time.Time `json:"seen"`
+	Holder       string    `json:"holder"`
+	HolderRouter string    `json:"holder_router,omitempty"`
+	HolderSeen   time.Time `json:"holder_seen"`
+}
+
+type walHeld struct {
+	assignment Assignment
+	hold       walHold
+}
+
+// walState is what the log describes, kept in memory so compaction doesn't have to re-read the file
+type walState struct {
+	pending  map[string]Assignment
+	inflight map[batchID]map[string]Assignment
+	leases   map[string]walLease
+	held     map[string]walHeld
+}
+
+type walStore struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	fsync    string
+	dirty    bool
+	records  int
+	live     int
+	compact  int
+	state    walState
+	stopSync chan bool
+}
+
+// persist is nil when persistence is disabled, every method is a no-op on a nil store
+var persist *walStore
+
+func newWalState() walState {
+	return walState{
+		pending:  make(map[string]Assignment),
+		inflight: make(map[batchID]map[string]Assignment),
+		leases:   make(map[string]walLease),
+		held:     make(map[string]walHeld),
+	}
+}
+
+func (s *walState) apply(r walRecord) {
+	switch r.Op {
+	case walOpPut:
+		if r.Assignment != nil {
+			s.pending[r.Assignment.MacAddress] = *r.Assignment
+		}
+	case walOpBatch:
+		if len(r.Macs) == 0 {
+			s.inflight[r.Batch] = s.pending
+			s.pending = make(map[string]Assignment)
+			break
+		}
+		batch := make(map[string]Assignment)
+		for _, m := range r.Macs {
+			if a, ok := s.pending[m]; ok {
+				batch[m] = a
+				delete(s.pending, m)
+			}
+		}
+		s.inflight[r.Batch] = batch
+	case walOpSent:
+		delete(s.inflight, r.Batch)
+	case walOpLease:
+		if r.Lease != nil {
+			s.leases[r.Lease.Mac] = *r.Lease
+		}
+	case walOpHold:
+		if r.Assignment != nil && r.Hold != nil {
+			s.held[r.Assignment.MacAddress] = walHeld{assignment: *r.Assignment, hold: *r.Hold}
+		}
+	case walOpUnhold:
+		for _, m := range r.Macs {
+			delete(s.held, m)
+		}
+	}
+}
+
+// unsent folds the undelivered batches (oldest first) and the pending assignments into one table
+func (s *walState) unsent() map[string]Assignment {
+	var ids []batchID
+	for id := range s.inflight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	merged := make(map[string]Assignment)
+	for _, id := range ids {
+		for k, v := range s.inflight[id] {
+			merged[k] = v
+		}
+	}
+	for k, v := range s.pending {
+		merged[k] = v
+	}
+	return merged
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// openWalStore(), called by initPersistence()
+//
+// replays the log in dir and compacts it. a torn record at the end of the log (a crash mid-write) ends the replay,
+// everything before it is kept.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func openWalStore(dir string, fsync string, compact int) (*walStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &walStore{
+		path:    filepath.Join(dir, walFile),
+		fsync:   strings.ToLower(fsync),
+		compact: compact,
+		state:   newWalState(),
+	}
+	if s.fsync == "" {
+		s.fsync = "interval"
+	}
+	if s.compact <= 0 {
+		s.compact = 10000
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		replayed := 0
+		for scanner.Scan() {
+			var r walRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				logger.Warn("persistence: torn record after ", replayed, " records, ignoring the rest of the log")
+				break
+			}
+			s.state.apply(r)
+			replayed++
+		}
+		f.Close()
+		logger.Info("persistence: replayed ", replayed, " records from ", s.path)
+	}
+
+	// batch numbers restart from zero, anything undelivered is pending again
+	s.state.pending = s.state.unsent()
+	s.state.inflight = make(map[batchID]map[string]Assignment)
+
+	if err := s.rewrite(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// rewrite(), called by openWalStore() and append()
+//
+// writes the live state to a new log and swaps it in, the old log stays in place until the rename so a crash during
+// compaction loses nothing.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (s *walStore) rewrite() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	records := 0
+
+	var ids []batchID
+	for id := range s.state.inflight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		for _, a := range s.state.inflight[id] {
+			a := a
+			enc.Encode(walRecord{Op: walOpPut, Assignment: &a})
+			records++
+		}
+		enc.Encode(walRecord{Op: walOpBatch, Batch: id})
+		records++
+	}
+	for _, a := range s.state.pending {
+		a := a
+		enc.Encode(walRecord{Op: walOpPut, Assignment: &a})
+		records++
+	}
+	for _, l := range s.state.leases {
+		l := l
+		enc.Encode(walRecord{Op: walOpLease, Lease: &l})
+		records++
+	}
+	for _, h := range s.state.held {
+		h := h
+		enc.Encode(walRecord{Op: walOpHold, Assignment: &h.assignment, Hold: &h.hold})
+		records++
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.writer = bufio.NewWriter(s.file)
+	s.records = records
+	s.live = records
+	s.dirty = false
+	return nil
+}
+
+func (s *walStore) append(r walRecord) {
+	if s == nil {
+		return
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return
+	}
+
+	s.state.apply(r)
+	s.writer.Write(append(data, '\n'))
+	s.records++
+
+	switch s.fsync {
+	case "always":
+		if err := s.flush(true); err != nil {
+			logger.Error("persistence: unable to write to ", s.path)
+			logger.Error("persistence: ", err.Error())
+		}
+	case "none":
+		s.flush(false)
+	default:
+		s.dirty = true
+	}
+
+	// drop leases that have been expired for a while so the log doesn't grow forever in proxy mode
+	if s.records-s.live > s.compact {
+		for k, l := range s.state.leases {
+			if l.Expired == "1" && time.Since(l.Expires) > 24*time.Hour {
+				delete(s.state.leases, k)
+			}
+		}
+		if err := s.rewrite(); err != nil {
+			logger.Error("persistence: compaction failed")
+			logger.Error("persistence: ", err.Error())
+		}
+	}
+}
+
+func (s *walStore) flush(sync bool) error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// commit makes everything appended so far durable to the fsync policy, called before an assignment is acknowledged.
+// "interval" writes to the file without syncing, leaving the sync to syncLoop.
+func (s *walStore) commit() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil || s.fsync != "interval" {
+		return nil
+	}
+	return s.writer.Flush()
+}
+
+// put records an assignment added to the batch table
+func (s *walStore) put(a Assignment) {
+	s.append(walRecord{Op: walOpPut, Assignment: &a})
+}
+
+// batch records the batch table being drained into batch id
+func (s *walStore) batch(id batchID) {
+	s.append(walRecord{Op: walOpBatch, Batch: id})
+}
+
+// batchOf records batch id as taking just the assignments for macs out of the batch table
+func (s *walStore) batchOf(id batchID, macs []string) {
+	s.append(walRecord{Op: walOpBatch, Batch: id, Macs: macs})
+}
+
+// sent records batch id as delivered, or put back in the batch table
+func (s *walStore) sent(id batchID) {
+	s.append(walRecord{Op: walOpSent, Batch: id})
+}
+
+// hold records x held back against holder, seen and holderSeen are what lastSeen has for the two MACs
+func (s *walStore) hold(x Assignment, seen macSeen, holder string, holderSeen macSeen) {
+	s.append(walRecord{Op: walOpHold, Assignment: &x, Hold: &walHold{
+		Router:       seen.router,
+		Seen:         seen.at,
+		Holder:       holder,
+		HolderRouter: holderSeen.router,
+		HolderSeen:   holderSeen.at,
+	}})
+}
+
+// unhold records the held claim for mac as released or dropped
+func (s *walStore) unhold(mac string) {
+	s.append(walRecord{Op: walOpUnhold, Macs: []string{mac}})
+}
+
+// lease records a proxy mode lease
+func (s *walStore) lease(l lease) {
+	s.append(walRecord{Op: walOpLease, Lease: &walLease{
+		Mac:       l.mac,
+		IP:        l.ip,
+		Router:    l.router.String(),
+		ServerID:  eventIP(l.serverID),
+		CircuitID: l.cid,
+		RemoteID:  l.rid,
+		AgentInfo: hex.EncodeToString(l.agent.raw),
+		LeaseTime: l.leaseTime,
+		T1:        l.t1,
+		T2:        l.t2,
+		Expires:   l.expires,
+		Expired:   l.state.flag(),
+		State:     l.state.String(),
+	}})
+}
+
+// restoreBatchTable puts the replayed, undelivered assignments back in the batch table, and the held claims back in
+// front of their holders
+func (s *walStore) restoreBatchTable(b *recordTable) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b.rwTableMutex.Lock()
+	for k, v := range s.state.pending {
+		b.entry[k] = v
+	}
+	for k, v := range s.state.held {
+		ip := v.assignment.IpAddress
+		b.held[k] = v.assignment
+		b.lastSeen[k] = macSeen{at: v.hold.Seen, router: v.hold.Router, ip: ip, expired: "0"}
+		if _, ok := b.ipIndex[ip]; !ok {
+			b.ipIndex[ip] = v.hold.Holder
+		}
+		if _, ok := b.lastSeen[v.hold.Holder]; !ok {
+			b.lastSeen[v.hold.Holder] = macSeen{at: v.hold.HolderSeen, router: v.hold.HolderRouter, ip: ip, expired: "0"}
+		}
+	}
+	b.rwTableMutex.Unlock()
+
+	if len(s.state.pending) > 0 {
+		logger.Info("persistence: restored ", len(s.state.pending), " undelivered assignments")
+	}
+	if len(s.state.held) > 0 {
+		logger.Info("persistence: restored ", len(s.state.held), " held duplicate IP claim(s)")
+	}
+}
+
+// restoreLeaseTable puts the replayed leases back in the lease table with their deadlines, leases that ran out while
+// we were down expire
+func (s *walStore) restoreLeaseTable(l *leaseRecord) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	l.mutex.Lock()
+	for k, v := range s.state.leases {
+		r := lease{
+			mac:       v.Mac,
+			ip:        v.IP,
+			router:    net.ParseIP(v.Router).To4(),
+			serverID:  net.ParseIP(v.ServerID).To4(),
+			cid:       v.CircuitID,
+			rid:       v.RemoteID,
+			leaseTime: v.LeaseTime,
+			timeStamp: now,
+			t1:        v.T1,
+			t2:        v.T2,
+			expires:   v.Expires,
+			gen:       1,
+		}
+		if v.AgentInfo != "" {
+			r.agent, _ = parseRelayAgentInfoHex(v.AgentInfo)
+		}
+
+		// logs from before lease states only have the expired flag and the expiry
+		if state, ok := parseLeaseState(v.State); ok {
+			r.state = state
+		} else if v.Expired == "1" {
+			r.state = leaseExpired
+		}
+		if r.t1.IsZero() && !r.expires.IsZero() {
+			r.t1, r.t2 = r.expires, r.expires
+		}
+		r.state = r.stateAt(now, l.grace)
+
+		l.entry[k] = r
+		if r.state < leaseExpired {
+			l.ipIndex[r.ip] = k
+			l.schedule(r, now)
+		}
+	}
+	l.mutex.Unlock()
+
+	if len(s.state.leases) > 0 {
+		logger.Info("persistence: restored ", len(s.state.leases), " leases")
+	}
+}
+
+// syncLoop fsyncs the log every interval when there are unsynced writes, for the "interval" policy
+func (s *walStore) syncLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.stopSync:
+			return
+		case <-t.C:
+			s.mutex.Lock()
+			if s.dirty && s.file != nil {
+				if err := s.flush(true); err != nil {
+					logger.Error("persistence: unable to sync ", s.path)
+					logger.Error("persistence: ", err.Error())
+				}
+				s.dirty = false
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// close flushes and syncs the log whatever the fsync policy
+func (s *walStore) close() {
+	if s == nil {
+		return
+	}
+	if s.stopSync != nil {
+		s.stopSync <- true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return
+	}
+	if err := s.flush(true); err != nil {
+		logger.Error("persistence: unable to sync ", s.path, " on exit")
+		logger.Error("persistence: ", err.Error())
+	}
+	s.file.Close()
+	s.file = nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// initPersistence, called by main()
+//
+// opens the log when persistence_path is set and restores the batch table. the lease table is restored by
+// startDHCPProxy() once it has initialised it.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func initPersistence() error {
+	if options.Persistence.Path == "" {
+		return nil
+	}
+
+	s, err := openWalStore(options.Persistence.Path, options.Persistence.Fsync, options.Persistence.CompactRecords)
+	if err != nil {
+		return errors.New("persistence: unable to open " + options.Persistence.Path + ": " + err.Error())
+	}
+
+	if s.fsync == "interval" {
+		interval := time.Duration(options.Persistence.FsyncInterval) * time.Second
+		if interval == 0 {
+			interval = time.Second
+		}
+		s.stopSync = make(chan bool)
+		go s.syncLoop(interval)
+	}
+
+	persist = s
+	persist.restoreBatchTable(&batchTable)
+	logger.Info("persistence: logging to ", s.path, " (fsync ", s.fsync, ")")
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalStoreReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher-wal")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("openWalStore: %v", err)
+	}
+
+	a := func(mac, ip, expired string) Assignment {
+		return Assignment{Expired: expired, IpAddress: ip, MacAddress: mac}
+	}
+
+	// batch 1 is delivered, batch 2 isn't, f3 is still waiting for a batch
+	s.put(a("aa:bb:cc:dd:ee:f0", "192.168.1.10", "0"))
+	s.put(a("aa:bb:cc:dd:ee:f1", "192.168.1.11", "0"))
+	s.batch(1)
+	s.sent(1)
+	s.put(a("aa:bb:cc:dd:ee:f1", "192.168.1.11", "1"))
+	s.put(a("aa:bb:cc:dd:ee:f2", "192.168.1.12", "0"))
+	s.batch(2)
+	s.put(a("aa:bb:cc:dd:ee:f2", "192.168.1.12", "1"))
+	s.put(a("aa:bb:cc:dd:ee:f3", "192.168.1.13", "0"))
+
+	// an expiry flush takes f6 on its own and is delivered, f3 stays pending
+	s.put(a("aa:bb:cc:dd:ee:f6", "192.168.1.16", "1"))
+	s.batchOf(3, []string{"aa:bb:cc:dd:ee:f6"})
+	s.sent(3)
+
+	s.lease(lease{mac: "aa:bb:cc:dd:ee:f4", ip: "192.168.1.14", router: net.ParseIP("192.0.2.1").To4(), rid: "router1", leaseTime: 3600, timeStamp: time.Now(), expires: time.Now().Add(time.Hour), state: leaseActive})
+	s.lease(lease{mac: "aa:bb:cc:dd:ee:f5", ip: "192.168.1.15", leaseTime: 60, timeStamp: time.Now().Add(-time.Hour), expires: time.Now().Add(-59 * time.Minute), state: leaseActive})
+	s.close()
+
+	// simulate a crash halfway through writing a record
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	f.Write([]byte(`{"op":"put","assignment":{"expired":"0","ip_add`))
+	f.Close()
+
+	s, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.close()
+
+	batchTable.initTable()
+	s.restoreBatchTable(&batchTable)
+
+	want := map[string]string{
+		"aa:bb:cc:dd:ee:f1": "1",
+		"aa:bb:cc:dd:ee:f2": "1",
+		"aa:bb:cc:dd:ee:f3": "0",
+	}
+	if len(batchTable.entry) != len(want) {
+		t.Errorf("expected %v restored assignments, got %+v", len(want), batchTable.entry)
+	}
+	for mac, expired := range want {
+		if e, ok := batchTable.entry[mac]; !ok || e.Expired != expired {
+			t.Errorf("%v - expected expired %v, got %+v", mac, expired, e)
+		}
+	}
+
+	var leases leaseRecord
+	leases.init()
+	s.restoreLeaseTable(&leases)
+
+	if l := leases.entry["aa:bb:cc:dd:ee:f4"]; l.state != leaseActive || time.Until(l.expires) < 3590*time.Second || l.rid != "router1" || !l.router.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the running lease to be restored, got %+v", l)
+	}
+	if l := leases.entry["aa:bb:cc:dd:ee:f5"]; l.state != leaseExpired {
+		t.Errorf("expected the lease that ran out while down to be expired, got %+v", l)
+	}
+
+	// the reopened log is compacted down to the live state
+	if s.records != 5 {
+		t.Errorf("expected 5 records after compaction, got %v", s.records)
+	}
+}
+
+func TestWalStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher-wal")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openWalStore(dir, "none", 10)
+	if err != nil {
+		t.Fatalf("openWalStore: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.put(Assignment{Expired: "0", IpAddress: "192.168.1.10", MacAddress: "aa:bb:cc:dd:ee:f0"})
+		s.batch(batchID(i + 1))
+		s.sent(batchID(i + 1))
+	}
+	s.put(Assignment{Expired: "0", IpAddress: "192.168.1.11", MacAddress: "aa:bb:cc:dd:ee:f1"})
+
+	if s.records > 20 {
+		t.Errorf("expected the log to be compacted, %v records", s.records)
+	}
+	s.close()
+
+	s, err = openWalStore(dir, "none", 10)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.close()
+
+	if len(s.state.pending) != 1 || s.state.pending["aa:bb:cc:dd:ee:f1"].IpAddress != "192.168.1.11" {
+		t.Errorf("expected only the undelivered assignment, got %+v", s.state.pending)
+	}
+}
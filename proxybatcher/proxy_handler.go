@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/binary"
 	dhcp "github.com/krolaw/dhcp4"
 	"net"
-	"os"
-	"os/signal"
+	"time"
 )
 
 //2.0 Relay Agent Information Option
@@ -105,19 +103,33 @@ import (
 //which added it when forwarding a server-to-client response back to
 //the client.
 //
-//
+// the proxy's side of this is in proxy_option82.go
 //
 
 var dhcpServers []net.IP
 var proxyServerIP net.IP
 
+// replyIfIndex is the interface a reply goes out on, the one the client's request came in on
+func (h *DHCPHandler) replyIfIndex(p dhcp.Packet) int {
+	_, ifIndex, _ := h.transactions.ingress(p)
+	return ifIndex
+}
+
 type DHCPHandler struct {
-	m map[string]bool
+	transactions *transactionTable
+	relay        *relayAgent
+	links        *linkSelector
 }
 
+// ServeDHCP keeps DHCPHandler a dhcp.Handler, Serve() calls ServeDHCPIf() with the interface the packet came in on
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	return h.ServeDHCPIf(0, p, msgType, options)
+}
+
+func (h *DHCPHandler) ServeDHCPIf(ifIndex int, p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
 
 	packetOptions := p.ParseOptions()
+	ifName := interfaceName(ifIndex)
 
 	switch msgType {
 	//CIADDR (Client IP address)
@@ -125,166 +137,173 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 	//SIADDR (Server IP address)
 	//GIADDR (Gateway IP address)
 	//CHADDR (Client hardware address)
-	case dhcp.Discover:
-		logger.Debug("DISCOVER ", p.YIAddr(), " from ", p.CHAddr())
-		h.m[string(p.XId())] = true
-		p2 := dhcp.NewPacket(dhcp.BootRequest)
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetGIAddr(proxyServerIP)
-		p2.SetXId(p.XId())
-		p2.SetBroadcast(false)
-		for k, v := range p.ParseOptions() {
-			p2.AddOption(k, v)
+	case dhcp.Discover, dhcp.Request:
+		if msgType == dhcp.Discover {
+			logger.Debug("DISCOVER ", p.YIAddr(), " from ", p.CHAddr())
+		} else {
+			logger.Info("REQUEST ", p.YIAddr(), " from ", p.CHAddr())
 		}
-		return p2
-
-	case dhcp.Offer:
-		logger.Debug("OFFER")
-		if !h.m[string(p.XId())] {
+		p2, ok := toServer(p)
+		if !ok {
 			return nil
 		}
-		p2 := dhcp.NewPacket(dhcp.BootReply)
-		p2.SetXId(p.XId())
-		p2.SetFile(p.File())
-		p2.SetFlags(p.Flags())
-		p2.SetYIAddr(p.YIAddr())
-		p2.SetGIAddr(p.GIAddr())
-		p2.SetSIAddr(p.SIAddr())
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetSecs(p.Secs())
-
-		for k, v := range packetOptions {
-			//if k == dhcp.OptionClientIdentifier || k == dhcp.OptionHostName {
-			//	logger.Debug("Option: ", k, " is ", string(v))
-			//} else {
-			//	logger.Debug("Option: ", k, " is ", v)
-			//}
-			p2.AddOption(k, v)
+		drop, inserted := h.relay.forward(ifName, p, packetOptions, &p2)
+		if drop {
+			return nil
+		}
+		var agentInfo int
+		if inserted {
+			agentInfo |= agentInserted
 		}
-		p2.AddOption(dhcp.OptionServerIdentifier, []byte(proxyServerIP.To4()))
+		agentInfo |= h.links.apply(ifName, p, &p2)
+		h.transactions.request(p, msgType, options)
+		h.transactions.setIngress(p, ifIndex, agentInfo)
 
+		// the client selected the proxy, the server is the one whose offer the proxy passed on
+		if id := h.transactions.selected(p); id != nil {
+			p2 = setOption(p2, dhcp.OptionServerIdentifier, id.To4())
+		}
 		return p2
 
-	case dhcp.Request:
-		h.m[string(p.XId())] = true
-		logger.Info("REQUEST ", p.YIAddr(), " from ", p.CHAddr())
-		p2 := dhcp.NewPacket(dhcp.BootRequest)
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetFile(p.File())
-		p2.SetCIAddr(p.CIAddr())
-		p2.SetSIAddr(p.SIAddr())
-		p2.SetGIAddr(proxyServerIP)
-		p2.SetXId(p.XId())
-		p2.SetBroadcast(false)
-
-		for k, v := range packetOptions {
-			p2.AddOption(k, v)
+	case dhcp.Offer:
+		logger.Debug("OFFER")
+		if ok, reason := h.transactions.reply(p, msgType, options); !ok {
+			logger.Warn("proxy: dropped OFFER for ", p.CHAddr(), ", ", reason)
+			return nil
 		}
-		return p2
+		giaddr, _, agentInfo := h.transactions.ingress(p)
+		return toClient(p, giaddr, agentInfo)
 
 	case dhcp.ACK:
-		if !h.m[string(p.XId())] {
+		if ok, reason := h.transactions.reply(p, msgType, options); !ok {
+			logger.Warn("proxy: dropped ACK for ", p.CHAddr(), ", ", reason)
 			return nil
 		}
+		giaddr, _, agentInfo := h.transactions.ingress(p)
 		logger.Debug("ACK")
-		leaseTable.addLease(p.CHAddr().String(), p.YIAddr().String(), binary.BigEndian.Uint32(options[dhcp.OptionIPAddressLeaseTime]), packetOptions)
-		p2 := dhcp.NewPacket(dhcp.BootReply)
-		p2.SetXId(p.XId())
-		p2.SetFile(p.File())
-		p2.SetFlags(p.Flags())
-		p2.SetSIAddr(p.SIAddr())
-		p2.SetYIAddr(p.YIAddr())
-		p2.SetGIAddr(p.GIAddr())
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetSecs(p.Secs())
-		for k, v := range packetOptions {
-			p2.AddOption(k, v)
-		}
-		p2.AddOption(dhcp.OptionServerIdentifier, []byte(proxyServerIP.To4()))
+		leaseTable.track(h.transactions, p, msgType, packetOptions)
 		//batchTable.UpdateBatchTable("0", downStreamGIAddr, p.CHAddr(), p.YIAddr(), "") // active
-		return p2
+		return toClient(p, giaddr, agentInfo)
 
 	case dhcp.NAK:
-		if !h.m[string(p.XId())] {
+		if ok, reason := h.transactions.reply(p, msgType, options); !ok {
+			logger.Warn("proxy: dropped NAK for ", p.CHAddr(), ", ", reason)
 			return nil
 		}
+		giaddr, _, agentInfo := h.transactions.ingress(p)
 		logger.Info("NAK from ", p.SIAddr(), " ", p.YIAddr(), " to ", p.CHAddr())
 		logger.Debug("giaddr is  ", p.GIAddr())
 		logger.Debug("flags are ", p.Flags())
-		p2 := dhcp.NewPacket(dhcp.BootReply)
-		p2.SetXId(p.XId())
-		p2.SetFile(p.File())
-		p2.SetFlags(p.Flags())
-		p2.SetSIAddr(p.SIAddr())
-		p2.SetYIAddr(p.YIAddr())
-		p2.SetGIAddr(p.GIAddr())
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetSecs(p.Secs())
-		for k, v := range packetOptions {
-			if k == dhcp.OptionServerIdentifier {
-				p2.AddOption(k, []byte(proxyServerIP.To4()))
-			} else {
-				p2.AddOption(k, v)
-			}
-		}
-		//		go batchTable.UpdateBatchTable("1", downStreamGIAddr, p.CHAddr(), p.YIAddr(),  "") // expired
-		return p2
+		leaseTable.track(h.transactions, p, msgType, packetOptions)
+		return toClient(p, giaddr, agentInfo)
 
 	case dhcp.Release, dhcp.Decline:
-		p2 := dhcp.NewPacket(dhcp.BootRequest)
-		p2.SetCHAddr(p.CHAddr())
-		p2.SetFile(p.File())
-		p2.SetCIAddr(p.CIAddr())
-		p2.SetSIAddr(p.SIAddr())
-		p2.SetGIAddr(proxyServerIP)
-		p2.SetXId(p.XId())
-		p2.SetBroadcast(false)
-		for k, v := range packetOptions {
-			p2.AddOption(k, v)
+		p2, ok := toServer(p)
+		if !ok {
+			return nil
+		}
+		if drop, _ := h.relay.forward(ifName, p, packetOptions, &p2); drop {
+			return nil
+		}
+		h.links.apply(ifName, p, &p2)
+
+		// the client names the proxy, the server holding the lease ignores a RELEASE or DECLINE that doesn't name it
+		if id := net.IP(packetOptions[dhcp.OptionServerIdentifier]); proxyServerIP != nil && proxyServerIP.Equal(id) {
+			server := leaseTable.serverOf(p.CHAddr().String())
+			if server == nil {
+				server = upstream.ownerOf(p.CHAddr().String())
+			}
+			if server != nil {
+				p2 = setOption(p2, dhcp.OptionServerIdentifier, server.To4())
+			}
 		}
-		//	go batchTable.UpdateBatchTable("1", downStreamGIAddr, p.CHAddr(), p.YIAddr(),  "") // expired
+		leaseTable.track(h.transactions, p, msgType, packetOptions)
 		return p2
 	}
 	return nil
 }
 
-func startDHCPProxy(ctl chan bool) {
+func startDHCPProxy(ctl chan bool) error {
+	// checkConfig() built one already, this can only fail if the interface went away since. the proxy doesn't run
+	// without the untrusted circuit rules it was configured with.
+	relay, err := newRelayAgent()
+	if err != nil {
+		logger.Error("proxy: unable to set up option 82 insertion")
+		logger.Error("proxy: ", err.Error())
+		return err
+	}
+
+	// bind both ports before anything else, a proxy that can't listen on one of them doesn't start
+	upstreamListener, err := ListenIf(options.Proxy.UpstreamInterface, options.Proxy.DownstreamInterface, 67)
+	if err != nil {
+		logger.Error("proxy upstream interface error")
+		logger.Error(err.Error())
+		return err
+	}
+	downstreamListener, err := ListenIf(options.Proxy.DownstreamInterface, options.Proxy.UpstreamInterface, 68)
+	if err != nil {
+		logger.Error("proxy downstream interface error")
+		logger.Error(err.Error())
+		upstreamListener.conn.Close()
+		return err
+	}
+
 	leaseTable.init()
-	go leaseTable.trim(ctl)
+	persist.restoreLeaseTable(&leaseTable)
+
+	// the lease timers get their own stop channel, sharing the scheduler's meant only one of them ever saw the stop
+	timersStop := make(chan bool)
+	go leaseTable.runTimers(timersStop)
 
 	for _, s := range options.Proxy.UpstreamServerIPs {
 		dhcpServers = append(dhcpServers, net.ParseIP(s))
 	}
 	proxyServerIP = net.ParseIP(options.Proxy.ProxyServerIP)
-	handler := &DHCPHandler{m: make(map[string]bool)}
+	links, err := newLinkSelector(options.Proxy.LinkSelection)
+	if err != nil {
+		logger.Error("proxy: link selection is off")
+		logger.Error("proxy: ", err.Error())
+	}
+	handler := &DHCPHandler{transactions: newTransactionTable(time.Duration(options.Proxy.TransactionTTL)*time.Second, options.Proxy.TransactionMax), relay: relay, links: links}
+	sweepStop := make(chan bool)
+	go handler.transactions.sweep(sweepStop)
+	upstream = newUpstreamPool(dhcpServers, options.Proxy.UpstreamPolicy, time.Duration(options.Proxy.TransactionTTL)*time.Second,
+		time.Duration(options.Proxy.UpstreamTimeout)*time.Second, time.Duration(options.Proxy.UpstreamRetry)*time.Second,
+		options.Proxy.UpstreamFailures)
+	monitorStop := make(chan bool)
+	go upstream.monitor(monitorStop)
+
+	upstreamStop := make(chan bool, 1)
+	downstreamStop := make(chan bool, 1)
 
 	go func() {
-		err := ListenAndServeIf(options.Proxy.UpstreamInterface, options.Proxy.DownstreamInterface, 67, handler)
-		if err != nil {
+		if err := upstreamListener.Serve(handler, upstreamStop); err != nil {
 			logger.Error("proxy upstream interface error")
 			logger.Error(err.Error())
 		}
 	}()
 	go func() {
-		err := ListenAndServeIf(options.Proxy.DownstreamInterface, options.Proxy.UpstreamInterface, 68, handler)
-		if err != nil {
+		if err := downstreamListener.Serve(handler, downstreamStop); err != nil {
 			logger.Error("proxy downstream interface error")
 			logger.Error(err.Error())
 		}
 
 	}()
 
-	// listen for stop signals
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	// stop taking in leases before the scheduler, main() dispatches the lease table one last time
+	waitForShutdown()
 
-	<-stop
+	upstreamStop <- true
+	downstreamStop <- true
+	timersStop <- true
+	sweepStop <- true
+	monitorStop <- true
 
 	// true, exit batchScheduler
 	ctl <- true
 
 	logger.Println()
 	logger.Info("proxy exit")
-	return
+	return nil
 
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	dhcp "github.com/krolaw/dhcp4"
 	"github.com/sirupsen/logrus"
 	"net"
@@ -10,8 +11,8 @@ import (
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 //
-// in memory lease information, lease times are automatically trimmed until they hit zero, then they're flagged as
-// expired.
+// in memory lease information, leases move through their T1, T2 and expiry deadlines on the timers in
+// proxy_lease_timers.go, expired leases are flagged as expired for batching to Sonar.
 //
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -21,16 +22,26 @@ type lease struct {
 	mac string
 	ip string
 	router net.IP
+	serverID net.IP // the server that ACKed the lease
 	cid string
 	rid string
-	leaseTime uint32
+	agent relayAgentInfo
+	leaseTime uint32 // from the ACK, seconds
 	timeStamp time.Time
-	isExpired string
+	t1 time.Time
+	t2 time.Time
+	expires time.Time // zero for an infinite lease
+	state leaseState
+	gen uint64
 }
 
 type leaseRecord struct {
 	entry map[string]lease
+	ipIndex map[string]string
 	mutex sync.RWMutex
+	timers leaseTimers
+	wake chan bool
+	grace time.Duration
 }
 
 func (l *leaseRecord) addLease(MAC, IP string, leaseTime uint32, options dhcp.Options) {
@@ -39,26 +50,52 @@ func (l *leaseRecord) addLease(MAC, IP string, leaseTime uint32, options dhcp.Op
 	a := lease{
 		mac:       MAC,
 		ip:        IP,
-		router:    r.To4(),
+		router:    append(net.IP(nil), r.To4()...),
+		serverID:  append(net.IP(nil), net.IP(options[dhcp.OptionServerIdentifier]).To4()...),
 		leaseTime: leaseTime,
 		timeStamp: time.Now(),
-		isExpired: "0",
+		state:     leaseActive,
 	}
-
-	if opt82len := len(options[dhcp.OptionRelayAgentInformation]); opt82len > 2 {
-		o := options[dhcp.OptionRelayAgentInformation]
-		s1 := o[1]
-		a.cid = string(o[2:2+s1])
-		a.rid = string(o[len(a.cid)+4:opt82len])
-
+	a.setDeadlines(a.timeStamp, options)
+
+	if o, ok := options[dhcp.OptionRelayAgentInformation]; ok {
+		if info, err := parseRelayAgentInfo(o); err != nil {
+			logger.Warn("proxy: ignoring option 82 in the lease for ", MAC)
+			logger.Warn("proxy: ", err.Error())
+		} else {
+			a.agent = info
+			a.cid = string(info.circuitID)
+			a.rid = string(info.remoteID)
+		}
 	}
 
 	l.mutex.Lock()
+	a.gen = l.entry[MAC].gen + 1
+	holder := l.indexLease(a)
 	l.entry[MAC] = a
-    l.mutex.Unlock()
+	l.schedule(a, a.timeStamp)
+	persist.lease(a)
+	l.mutex.Unlock()
+
+	select {
+	case l.wake <- true:
+	default:
+	}
+
+	if holder != "" {
+		publishDuplicateIP(a.router, a.mac, a.ip, a.rid, holder, duplicateIPPolicy())
+	}
+
+	events.publish(batchEvent{
+		Type:       eventLease,
+		RouterIP:   eventIP(a.router),
+		MacAddress: a.mac,
+		IpAddress:  a.ip,
+		RemoteID:   a.rid,
+		Expired:    a.state.flag(),
+	})
 
-    if logger.GetLevel() == logrus.DebugLevel {
-		logger.Debug("renewal lease time is : ", options[dhcp.OptionRenewalTimeValue])
+	if logger.GetLevel() == logrus.DebugLevel {
 		l.printDebug()
 	} else {
 		l.printInfo()
@@ -66,54 +103,91 @@ func (l *leaseRecord) addLease(MAC, IP string, leaseTime uint32, options dhcp.Op
 
 }
 
-func (l *leaseRecord) init() {
-	l.entry = make(map[string]lease)
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// expireLease(), called by track() for RELEASE, DECLINE and NAK
+//
+// the client is done with the lease, it's released now rather than expired at its deadline. the lease has to match
+// both the MAC and the IP, a RELEASE for an address the client no longer holds leaves its current lease alone.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (l *leaseRecord) expireLease(MAC string, IP string, reason string) bool {
+	l.mutex.Lock()
+	v, ok := l.entry[MAC]
+	if !ok || v.state >= leaseExpired || v.ip != IP {
+		l.mutex.Unlock()
+		return false
+	}
+	v.state = leaseReleased
+	v.gen++
+	l.entry[MAC] = v
+	if l.ipIndex[v.ip] == MAC {
+		delete(l.ipIndex, v.ip)
+	}
+	persist.lease(v)
+	l.mutex.Unlock()
+
+	logger.Info("proxy: lease ", v.ip, " for ", MAC, " expired by ", reason)
+	events.publish(batchEvent{
+		Type:       eventExpiry,
+		RouterIP:   eventIP(v.router),
+		MacAddress: v.mac,
+		IpAddress:  v.ip,
+		RemoteID:   v.rid,
+		Expired:    v.state.flag(),
+	})
+	return true
 }
 
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// track(), called by ServeDHCPIf() and the snooper's observe()
+//
+// what a DHCP message does to the lease table, the same whether the proxy relayed it or only saw it go past: an ACK
+// binds the lease, a NAK releases the address the client asked for, a RELEASE the address in ciaddr and a DECLINE the
+// address in the requested address option. an ACK without a lease time answers an INFORM and binds nothing.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (l *leaseRecord) track(t *transactionTable, p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) {
+	mac := p.CHAddr().String()
 
-// flag expired leasetimes for batching to Sonar
-func (l *leaseRecord) trim(ctl chan bool) {
-	// define a 10 second trim timer
-	logger.Info("lease trim started")
-
-	t := time.NewTicker(10 * time.Second)
-
-	for {
-		select {
-		case <-ctl:
-			logger.Info("lease trim: exit..")
-			return
-		case <-t.C:
-			updated, expired := 0,0
-			l.mutex.Lock()
-			for k,v := range l.entry {
-				if v.leaseTime < 10 && v.isExpired == "0"{
-					v.leaseTime = 0
-					v.isExpired = "1"
-					l.entry[k] = v
-					expired++
-				} else {
-					if v.isExpired != "1" {
-						v.isExpired = "0"
-						v.leaseTime -= 10
-						l.entry[k] = v
-						updated++
-					}
-				}
-			}
-			l.mutex.Unlock()
-			if logger.GetLevel() == logrus.DebugLevel {
-				l.printDebug()
-				logger.Debug("trim - ", updated, " updated, ", expired, " expired")
-			} else {
-				l.printInfo()
-				logger.Info("trim - ", updated, " updated, ", expired, " expired")
-			}
+	switch msgType {
+	case dhcp.ACK:
+		if leaseTime := options[dhcp.OptionIPAddressLeaseTime]; len(leaseTime) == 4 {
+			l.addLease(mac, p.YIAddr().String(), binary.BigEndian.Uint32(leaseTime), options)
+		}
+	case dhcp.NAK:
+		if ip := t.requested(p); ip != nil {
+			l.expireLease(mac, ip.String(), "NAK")
+		}
+	case dhcp.Release:
+		l.expireLease(mac, p.CIAddr().String(), "RELEASE")
+	case dhcp.Decline:
+		if ip := options[dhcp.OptionRequestedIPAddress]; len(ip) == 4 {
+			l.expireLease(mac, net.IP(ip).String(), "DECLINE")
 		}
 	}
 }
 
+// serverOf is the server that ACKed the lease of MAC, nil when there's no lease or it didn't say
+func (l *leaseRecord) serverOf(MAC string) net.IP {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if v, ok := l.entry[MAC]; ok && len(v.serverID) == 4 {
+		return v.serverID
+	}
+	return nil
+}
+
+func (l *leaseRecord) init() {
+	l.entry = make(map[string]lease)
+	l.ipIndex = make(map[string]string)
+	l.timers = nil
+	l.wake = make(chan bool, 1)
+	l.grace = time.Duration(options.Proxy.LeaseGrace) * time.Second
+}
+
 func (l *leaseRecord) printDebug() {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
 	for i,v := range l.entry {
 		logger.Debug("")
 		logger.Debug("    leaseRecord: ", i)
@@ -121,16 +195,19 @@ func (l *leaseRecord) printDebug() {
 		logger.Debug("      remote id: ", v.rid)
 		logger.Debug("      timestamp: ", v.timeStamp)
 		logger.Debug("     lease time: ", v.leaseTime)
+		logger.Debug("        expires: ", v.expires)
 		logger.Debug("             IP: ", v.ip)
 		logger.Debug("      router IP: ", v.router.String())
 		logger.Debug("            MAC: ", v.mac)
-		logger.Debug("     is expired: ", v.isExpired)
+		logger.Debug("          state: ", v.state)
 		logger.Debug("")
 	}
 }
 
 func (l *leaseRecord) printInfo() {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
 	for _,v := range l.entry {
-		logger.Info("IP: ", v.ip, " MAC: ", v.mac, " expired: ", v.isExpired)
+		logger.Info("IP: ", v.ip, " MAC: ", v.mac, " state: ", v.state)
 	}
 }
\ No newline at end of file
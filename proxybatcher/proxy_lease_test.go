@@ -0,0 +1,105 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyLeaseExpiry(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	server := net.ParseIP("192.0.2.10")
+
+	leaseTable.init()
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0)}
+	for i, mac := range []string{"aa:bb:cc:dd:ee:f0", "aa:bb:cc:dd:ee:f1", "aa:bb:cc:dd:ee:f2"} {
+		leaseTable.addLease(mac, "10.0.0."+strconv.Itoa(i+1), 3600, dhcp.Options{})
+	}
+	expired := func(mac string) bool {
+		leaseTable.mutex.RLock()
+		defer leaseTable.mutex.RUnlock()
+		return leaseTable.entry[mac].state == leaseReleased
+	}
+
+	// RELEASE for an address the client doesn't hold
+	p, o := dhcpTestPacket(dhcp.Release, 1, "aa:bb:cc:dd:ee:f0", server)
+	p.SetCIAddr(net.ParseIP("10.0.0.9"))
+	h.ServeDHCPIf(0, p, dhcp.Release, o)
+	if expired("aa:bb:cc:dd:ee:f0") {
+		t.Errorf("expected a RELEASE for another address to leave the lease alone")
+	}
+
+	// RELEASE, by ciaddr
+	p.SetCIAddr(net.ParseIP("10.0.0.1"))
+	h.ServeDHCPIf(0, p, dhcp.Release, o)
+	if !expired("aa:bb:cc:dd:ee:f0") {
+		t.Errorf("expected the RELEASE to expire the lease")
+	}
+	if _, indexed := leaseTable.ipIndex["10.0.0.1"]; indexed {
+		t.Errorf("expected the released address out of the IP index")
+	}
+
+	// DECLINE, by the requested address
+	p, _ = dhcpTestPacket(dhcp.Decline, 2, "aa:bb:cc:dd:ee:f1", server)
+	p.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("10.0.0.2").To4())
+	h.ServeDHCPIf(0, p, dhcp.Decline, p.ParseOptions())
+	if !expired("aa:bb:cc:dd:ee:f1") {
+		t.Errorf("expected the DECLINE to expire the lease")
+	}
+
+	// NAK, for the address in the REQUEST
+	p, _ = dhcpTestPacket(dhcp.Request, 3, "aa:bb:cc:dd:ee:f2", nil)
+	p.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("10.0.0.3").To4())
+	h.ServeDHCPIf(0, p, dhcp.Request, p.ParseOptions())
+	nak, _ := dhcpTestPacket(dhcp.NAK, 3, "aa:bb:cc:dd:ee:f2", server)
+	if h.ServeDHCPIf(0, nak, dhcp.NAK, nak.ParseOptions()) == nil {
+		t.Fatalf("expected the NAK to be forwarded")
+	}
+	if !expired("aa:bb:cc:dd:ee:f2") {
+		t.Errorf("expected the NAK to expire the lease")
+	}
+
+	// expired leases go to Sonar as expired
+	for _, a := range proxyAssignments() {
+		if a.Expired != "1" {
+			t.Errorf("expected every assignment expired, got %+v", a)
+		}
+	}
+}
+
+func TestProxyReleaseServerID(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	server := net.ParseIP("192.0.2.10")
+	mac := "aa:bb:cc:dd:ee:f0"
+
+	leaseTable.init()
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0)}
+	leaseTable.addLease(mac, "10.0.0.1", 3600, dhcp.Options{dhcp.OptionServerIdentifier: server.To4()})
+
+	// the client learned the proxy's address from the ACK, the server gets its own back
+	p, o := dhcpTestPacket(dhcp.Release, 1, mac, proxyServerIP)
+	p.SetCIAddr(net.ParseIP("10.0.0.1"))
+	up := h.ServeDHCPIf(0, p, dhcp.Release, o)
+	if id := up.ParseOptions()[dhcp.OptionServerIdentifier]; !net.IP(id).Equal(server) {
+		t.Errorf("expected the RELEASE to name %v, got %v", server, net.IP(id))
+	}
+
+	// no lease left, the server that last answered the client
+	savedUpstream := upstream
+	defer func() { upstream = savedUpstream }()
+	upstream = newUpstreamPool([]net.IP{server}, "", time.Minute, time.Minute, time.Minute, 0)
+	ack, _ := dhcpTestPacket(dhcp.ACK, 2, "aa:bb:cc:dd:ee:f1", server)
+	upstream.replied(&net.UDPAddr{IP: server, Port: 67}, ack)
+	p, _ = dhcpTestPacket(dhcp.Decline, 2, "aa:bb:cc:dd:ee:f1", proxyServerIP)
+	p.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("10.0.0.2").To4())
+	up = h.ServeDHCPIf(0, p, dhcp.Decline, p.ParseOptions())
+	if id := up.ParseOptions()[dhcp.OptionServerIdentifier]; !net.IP(id).Equal(server) {
+		t.Errorf("expected the DECLINE to name %v, got %v", server, net.IP(id))
+	}
+}
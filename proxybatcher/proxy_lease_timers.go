@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	dhcp "github.com/krolaw/dhcp4"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// proxy mode lease deadlines. an ACK sets absolute T1 (renewal), T2 (rebinding) and expiry times, from options 58 and
+// 59 when the server sends them and 1/2 and 7/8 of the lease time when it doesn't (RFC 2131 4.4.5). each lease has
+// one timer in a heap for its next deadline, so only leases that are due get touched:
+//
+// active     before T1
+// renewing   past T1, the client should be renewing with its server
+// rebinding  past T2, the client should be rebinding with any server
+// expired    past the lease time plus proxy_lease_grace
+// released   RELEASE, DECLINE or NAK, see expireLease()
+//
+// an infinite lease (0xffffffff) has no deadlines. a new ACK for a lease moves its generation on, the timers of the
+// old generation are dropped as they come up.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type leaseState int
+
+const (
+	leaseActive leaseState = iota
+	leaseRenewing
+	leaseRebinding
+	leaseExpired
+	leaseReleased
+)
+
+const infiniteLease = 0xffffffff
+
+func (s leaseState) String() string {
+	switch s {
+	case leaseActive:
+		return "active"
+	case leaseRenewing:
+		return "renewing"
+	case leaseRebinding:
+		return "rebinding"
+	case leaseExpired:
+		return "expired"
+	case leaseReleased:
+		return "released"
+	}
+	return "unknown"
+}
+
+// parseLeaseState is String() the other way round, for the persistence log
+func parseLeaseState(s string) (leaseState, bool) {
+	for st := leaseActive; st <= leaseReleased; st++ {
+		if st.String() == s {
+			return st, true
+		}
+	}
+	return leaseActive, false
+}
+
+// flag is the expired flag Sonar takes, "1" once the client no longer holds the lease
+func (s leaseState) flag() string {
+	if s >= leaseExpired {
+		return "1"
+	}
+	return "0"
+}
+
+// setDeadlines works the lease's T1, T2 and expiry out from an ACK received at now
+func (a *lease) setDeadlines(now time.Time, options dhcp.Options) {
+	a.t1, a.t2, a.expires = time.Time{}, time.Time{}, time.Time{}
+	if a.leaseTime == infiniteLease {
+		return
+	}
+
+	lt := time.Duration(a.leaseTime) * time.Second
+	t1, t2 := lt/2, lt*7/8
+	if v := options[dhcp.OptionRenewalTimeValue]; len(v) == 4 {
+		t1 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	if v := options[dhcp.OptionRebindingTimeValue]; len(v) == 4 {
+		t2 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	if t2 > lt || t2 < t1 {
+		t1, t2 = lt/2, lt*7/8
+	}
+
+	a.t1, a.t2, a.expires = now.Add(t1), now.Add(t2), now.Add(lt)
+}
+
+// stateAt is the state the lease's deadlines put it in at now, a released lease stays released
+func (a lease) stateAt(now time.Time, grace time.Duration) leaseState {
+	switch {
+	case a.state == leaseReleased || a.state == leaseExpired:
+		return a.state
+	case a.expires.IsZero():
+		return leaseActive
+	case !now.Before(a.expires.Add(grace)):
+		return leaseExpired
+	case !now.Before(a.t2):
+		return leaseRebinding
+	case !now.Before(a.t1):
+		return leaseRenewing
+	}
+	return leaseActive
+}
+
+// nextDeadline is the next time the lease changes state after now, zero when it won't
+func (a lease) nextDeadline(now time.Time, grace time.Duration) time.Time {
+	if a.state >= leaseExpired || a.expires.IsZero() {
+		return time.Time{}
+	}
+	for _, d := range []time.Time{a.t1, a.t2, a.expires.Add(grace)} {
+		if d.After(now) {
+			return d
+		}
+	}
+	return a.expires.Add(grace)
+}
+
+type leaseTimer struct {
+	at  time.Time
+	mac string
+	gen uint64
+}
+
+// leaseTimers is a min-heap of lease deadlines, see container/heap
+type leaseTimers []leaseTimer
+
+func (h leaseTimers) Len() int            { return len(h) }
+func (h leaseTimers) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h leaseTimers) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *leaseTimers) Push(x interface{}) { *h = append(*h, x.(leaseTimer)) }
+func (h *leaseTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// schedule puts the lease's next deadline on the heap. called with the lease table locked.
+func (l *leaseRecord) schedule(a lease, now time.Time) {
+	if at := a.nextDeadline(now, l.grace); !at.IsZero() {
+		heap.Push(&l.timers, leaseTimer{at: at, mac: a.mac, gen: a.gen})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// advance(), called by runTimers() when the earliest deadline is due
+//
+// moves the due leases on to their new state and reschedules them, leases that expire are persisted and published.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (l *leaseRecord) advance(now time.Time) {
+	var expiries []lease
+
+	l.mutex.Lock()
+	for len(l.timers) > 0 && !l.timers[0].at.After(now) {
+		t := heap.Pop(&l.timers).(leaseTimer)
+		v, ok := l.entry[t.mac]
+		if !ok || v.gen != t.gen {
+			continue
+		}
+		if state := v.stateAt(now, l.grace); state != v.state {
+			logger.Debug("lease timers: ", v.ip, " for ", v.mac, " is ", state)
+			v.state = state
+			l.entry[t.mac] = v
+			if state == leaseExpired {
+				if l.ipIndex[v.ip] == v.mac {
+					delete(l.ipIndex, v.ip)
+				}
+				persist.lease(v)
+				expiries = append(expiries, v)
+			}
+		}
+		l.schedule(v, now)
+	}
+	l.mutex.Unlock()
+
+	for _, v := range expiries {
+		logger.Info("lease timers: ", v.ip, " for ", v.mac, " expired")
+		events.publish(batchEvent{
+			Type:       eventExpiry,
+			RouterIP:   eventIP(v.router),
+			MacAddress: v.mac,
+			IpAddress:  v.ip,
+			RemoteID:   v.rid,
+			Expired:    v.state.flag(),
+		})
+	}
+}
+
+// runTimers sleeps until the earliest lease deadline, or a new lease wakes it, until stop signal is sent
+func (l *leaseRecord) runTimers(ctl chan bool) {
+	logger.Info("lease timers started")
+
+	for {
+		wait := time.Hour
+		l.mutex.RLock()
+		if len(l.timers) > 0 {
+			wait = time.Until(l.timers[0].at)
+		}
+		l.mutex.RUnlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctl:
+			timer.Stop()
+			logger.Info("lease timers: exit..")
+			return
+		case <-l.wake:
+			timer.Stop()
+		case now := <-timer.C:
+			l.advance(now)
+		}
+	}
+}
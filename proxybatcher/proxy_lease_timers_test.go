@@ -0,0 +1,115 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"testing"
+	"time"
+)
+
+func TestLeaseDeadlines(t *testing.T) {
+	now := time.Now()
+
+	a := lease{leaseTime: 3600}
+	a.setDeadlines(now, dhcp.Options{})
+	if a.t1 != now.Add(30*time.Minute) || a.t2 != now.Add(3150*time.Second) || a.expires != now.Add(time.Hour) {
+		t.Errorf("expected the RFC 2131 default T1 and T2, got %v %v %v", a.t1.Sub(now), a.t2.Sub(now), a.expires.Sub(now))
+	}
+
+	a.setDeadlines(now, dhcp.Options{dhcp.OptionRenewalTimeValue: {0, 0, 0, 100}, dhcp.OptionRebindingTimeValue: {0, 0, 0, 200}})
+	if a.t1 != now.Add(100*time.Second) || a.t2 != now.Add(200*time.Second) {
+		t.Errorf("expected T1 and T2 from the ACK, got %v %v", a.t1.Sub(now), a.t2.Sub(now))
+	}
+
+	// T2 past the lease time doesn't make sense, the defaults are used
+	a.setDeadlines(now, dhcp.Options{dhcp.OptionRebindingTimeValue: {0, 0, 0x10, 0}})
+	if a.t2 != now.Add(3150*time.Second) {
+		t.Errorf("expected the default T2, got %v", a.t2.Sub(now))
+	}
+
+	a.leaseTime = infiniteLease
+	a.setDeadlines(now, dhcp.Options{})
+	if !a.expires.IsZero() || a.stateAt(now.Add(1000*time.Hour), 0) != leaseActive || !a.nextDeadline(now, 0).IsZero() {
+		t.Errorf("expected an infinite lease to stay active without deadlines")
+	}
+
+	if s, ok := parseLeaseState("rebinding"); !ok || s != leaseRebinding {
+		t.Errorf("expected rebinding, got %v %v", s, ok)
+	}
+}
+
+func TestLeaseTimers(t *testing.T) {
+	saved := options.Proxy.LeaseGrace
+	defer func() { options.Proxy.LeaseGrace = saved }()
+	options.Proxy.LeaseGrace = 30
+
+	leaseTable.init()
+	times := dhcp.Options{dhcp.OptionRenewalTimeValue: {0, 0, 0, 10}, dhcp.OptionRebindingTimeValue: {0, 0, 0, 20}}
+	leaseTable.addLease("aa:bb:cc:dd:ee:f0", "10.0.0.1", 100, times)
+	leaseTable.addLease("aa:bb:cc:dd:ee:f1", "10.0.0.2", 86400, dhcp.Options{})
+	start := leaseTable.entry["aa:bb:cc:dd:ee:f0"].timeStamp
+
+	state := func(mac string) leaseState {
+		leaseTable.mutex.RLock()
+		defer leaseTable.mutex.RUnlock()
+		return leaseTable.entry[mac].state
+	}
+
+	for _, step := range []struct {
+		after time.Duration
+		want  leaseState
+	}{
+		{5 * time.Second, leaseActive},
+		{15 * time.Second, leaseRenewing},
+		{25 * time.Second, leaseRebinding},
+		{110 * time.Second, leaseRebinding}, // past the lease time, within the grace period
+		{131 * time.Second, leaseExpired},
+	} {
+		leaseTable.advance(start.Add(step.after))
+		if got := state("aa:bb:cc:dd:ee:f0"); got != step.want {
+			t.Errorf("after %v expected %v, got %v", step.after, step.want, got)
+		}
+	}
+	if got := state("aa:bb:cc:dd:ee:f1"); got != leaseActive || len(leaseTable.timers) != 1 {
+		t.Errorf("expected the day long lease to be left alone with just its timer, got %v and %v timers", got, len(leaseTable.timers))
+	}
+
+	// a new ACK leaves the old timers behind
+	leaseTable.addLease("aa:bb:cc:dd:ee:f1", "10.0.0.2", 1000, dhcp.Options{})
+	leaseTable.advance(start.Add(24 * time.Hour))
+	if got := state("aa:bb:cc:dd:ee:f1"); got != leaseExpired {
+		t.Errorf("expected the renewed lease to expire on its new deadline, got %v", got)
+	}
+	if len(leaseTable.timers) != 0 {
+		t.Errorf("expected no timers left, got %v", len(leaseTable.timers))
+	}
+}
+
+func TestLeaseTimersRun(t *testing.T) {
+	leaseTable.init()
+	ctl := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		leaseTable.runTimers(ctl)
+		close(done)
+	}()
+
+	// the runner is asleep on an empty heap, the new lease wakes it
+	leaseTable.addLease("aa:bb:cc:dd:ee:f0", "10.0.0.1", 1, dhcp.Options{})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leaseTable.mutex.RLock()
+		state := leaseTable.entry["aa:bb:cc:dd:ee:f0"].state
+		leaseTable.mutex.RUnlock()
+		if state == leaseExpired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lease to expire, got %v", state)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ctl <- true
+	<-done
+}
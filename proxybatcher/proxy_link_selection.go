@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// the proxy puts its own address in giaddr so the replies come back through it, which leaves the upstream server
+// choosing the pool from the proxy's subnet. proxy_link_selection entries tell the server the client's real subnet
+// with the RFC 3527 link selection sub-option of option 82:
+//
+// subnet              matches a downstream relay's giaddr, the giaddr is the link unless link is set
+// interface           matches clients on the interface itself (giaddr zero), link is required
+// server_id_override  also adds the RFC 5107 server identifier override with proxy_server_ip, so the server names
+//                     the proxy in its replies and renewals come through it
+//
+// the sub-options go in the option 82 the proxy adds, or on the end of the downstream relay's. they're taken back out
+// of the replies.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// what the proxy did to option 82 in a transaction's client packets, undone in the replies
+const (
+	agentInserted = 1 << iota // added the option
+	agentExtended             // added sub-options to the downstream relay's option
+)
+
+type linkSelection struct {
+	subnet   *net.IPNet
+	iface    string
+	link     net.IP
+	override bool
+}
+
+type linkSelector struct {
+	entries []linkSelection
+}
+
+// newLinkSelector parses proxy_link_selection, nil when there's nothing configured
+func newLinkSelector(config []linkSelectionConfig) (*linkSelector, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+	l := &linkSelector{}
+	for _, c := range config {
+		e := linkSelection{iface: c.Interface, override: c.ServerIDOverride}
+		if c.Subnet != "" {
+			_, subnet, err := net.ParseCIDR(c.Subnet)
+			if err != nil {
+				return nil, errors.New("(proxy_link_selection) unable to parse subnet " + c.Subnet)
+			}
+			e.subnet = subnet
+		}
+		if c.Link != "" {
+			if e.link = net.ParseIP(c.Link).To4(); e.link == nil {
+				return nil, errors.New("(proxy_link_selection) link " + c.Link + " isn't an IPv4 address")
+			}
+		}
+		if (e.subnet == nil) == (e.iface == "") {
+			return nil, errors.New("(proxy_link_selection) entries take a subnet or an interface")
+		}
+		if e.iface != "" && e.link == nil {
+			return nil, errors.New("(proxy_link_selection) interface " + e.iface + " needs a link")
+		}
+		l.entries = append(l.entries, e)
+	}
+	return l, nil
+}
+
+// match finds the entry for a client packet, by its giaddr when a downstream relay set one, its interface otherwise
+func (l *linkSelector) match(giaddr net.IP, ifName string) (link net.IP, override bool, ok bool) {
+	relayed := !giaddr.Equal(net.IPv4zero)
+	for _, e := range l.entries {
+		switch {
+		case relayed && e.subnet != nil && e.subnet.Contains(giaddr):
+			if e.link == nil {
+				return giaddr.To4(), e.override, true
+			}
+			return e.link, e.override, true
+		case !relayed && e.iface != "" && e.iface == ifName:
+			return e.link, e.override, true
+		}
+	}
+	return nil, false, false
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// apply(), called by ServeDHCPIf() for client packets, after forward() had its go at option 82
+//
+// returns agentInserted when the sub-options went in an option 82 of their own, agentExtended when they went on the
+// end of the downstream relay's. a downstream relay that already sent a link selection keeps it.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (l *linkSelector) apply(ifName string, p dhcp.Packet, out *dhcp.Packet) int {
+	if l == nil {
+		return 0
+	}
+	link, override, ok := l.match(p.GIAddr(), ifName)
+	if !ok {
+		return 0
+	}
+
+	existing, present := out.ParseOptions()[dhcp.OptionRelayAgentInformation]
+	var info relayAgentInfo
+	if present {
+		var err error
+		if info, err = parseRelayAgentInfo(existing); err != nil || info.linkSelection != nil {
+			return 0
+		}
+	}
+
+	subs := append([]byte{agentLinkSelection, 4}, link...)
+	if override && proxyServerIP != nil && info.serverOverride == nil {
+		subs = append(append(subs, agentServerOverride, 4), proxyServerIP.To4()...)
+	}
+
+	if !present {
+		*out = insertOption(*out, dhcp.OptionRelayAgentInformation, subs)
+		return agentInserted
+	}
+	if len(existing)+len(subs) > 255 {
+		logger.Warn("proxy: no room in option 82 from ", p.CHAddr(), " for link selection")
+		return 0
+	}
+	*out = setOption(*out, dhcp.OptionRelayAgentInformation, append(append([]byte(nil), existing...), subs...))
+
+	// the proxy's own option 82 is stripped whole
+	if _, downstream := p.ParseOptions()[dhcp.OptionRelayAgentInformation]; !downstream {
+		return 0
+	}
+	return agentExtended
+}
+
+// stripLinkSelection takes the sub-options the proxy added out of the option 82 a server echoed
+func stripLinkSelection(p dhcp.Packet) dhcp.Packet {
+	data, ok := p.ParseOptions()[dhcp.OptionRelayAgentInformation]
+	if !ok {
+		return p
+	}
+	var kept []byte
+	for len(data) >= 2 && len(data) >= 2+int(data[1]) {
+		if data[0] != agentLinkSelection && data[0] != agentServerOverride {
+			kept = append(kept, data[:2+int(data[1])]...)
+		}
+		data = data[2+int(data[1]):]
+	}
+	if len(kept) == 0 {
+		return removeOption(p, dhcp.OptionRelayAgentInformation)
+	}
+	return setOption(p, dhcp.OptionRelayAgentInformation, kept)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLinkSelection(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	server := net.ParseIP("192.0.2.10")
+
+	for name, bad := range map[string][]linkSelectionConfig{
+		"subnet":   {{Subnet: "10.1.0.0/33"}},
+		"neither":  {{Link: "10.1.0.1"}},
+		"both":     {{Subnet: "10.1.0.0/16", Interface: "eth1", Link: "10.1.0.1"}},
+		"no link":  {{Interface: "eth1"}},
+		"bad link": {{Subnet: "10.1.0.0/16", Link: "fe80::1"}},
+	} {
+		if _, err := newLinkSelector(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	links, err := newLinkSelector([]linkSelectionConfig{
+		{Subnet: "10.1.0.0/16", ServerIDOverride: true},
+		{Interface: "eth1", Link: "10.2.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0), links: links}
+
+	exchange := func(xid uint32, giaddr net.IP, agent []byte) (up dhcp.Packet, down dhcp.Packet) {
+		p, _ := dhcpTestPacket(dhcp.Discover, xid, "aa:bb:cc:dd:ee:f0", nil)
+		p.SetGIAddr(giaddr)
+		if agent != nil {
+			p.AddOption(dhcp.OptionRelayAgentInformation, agent)
+		}
+		up = h.ServeDHCPIf(0, p, dhcp.Discover, p.ParseOptions())
+
+		offer, _ := dhcpTestPacket(dhcp.Offer, xid, "aa:bb:cc:dd:ee:f0", server)
+		if echo, ok := up.ParseOptions()[dhcp.OptionRelayAgentInformation]; ok {
+			offer.AddOption(dhcp.OptionRelayAgentInformation, echo)
+		}
+		return up, h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	}
+
+	// relayed from 10.1.0.1, the giaddr is the link and the proxy the server
+	up, down := exchange(1, net.ParseIP("10.1.0.1"), nil)
+	info, err := parseRelayAgentInfo(up.ParseOptions()[dhcp.OptionRelayAgentInformation])
+	if err != nil || !info.linkSelection.Equal(net.ParseIP("10.1.0.1")) || !info.serverOverride.Equal(proxyServerIP) {
+		t.Errorf("expected link selection 10.1.0.1 and server override, got %+v %v", info, err)
+	}
+	if !up.GIAddr().Equal(proxyServerIP) {
+		t.Errorf("expected giaddr to stay the proxy, got %v", up.GIAddr())
+	}
+	if _, ok := down.ParseOptions()[dhcp.OptionRelayAgentInformation]; ok {
+		t.Errorf("expected the proxy's option 82 stripped from the OFFER")
+	}
+
+	// the downstream relay's option 82 gets the sub-options on the end, and back without them
+	relayInfo := []byte{agentCircuitID, 2, 'c', '1'}
+	up, down = exchange(2, net.ParseIP("10.1.2.3"), relayInfo)
+	if info, _ := parseRelayAgentInfo(up.ParseOptions()[dhcp.OptionRelayAgentInformation]); string(info.circuitID) != "c1" || !info.linkSelection.Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("expected the relay's circuit id and a link selection, got %+v", info)
+	}
+	if got := down.ParseOptions()[dhcp.OptionRelayAgentInformation]; !bytes.Equal(got, relayInfo) {
+		t.Errorf("expected the relay's option 82 back as it sent it, got %v", got)
+	}
+
+	// no match, untouched
+	if up, _ := exchange(3, net.ParseIP("10.9.0.1"), nil); up.ParseOptions()[dhcp.OptionRelayAgentInformation] != nil {
+		t.Errorf("expected no option 82 outside the configured subnets")
+	}
+
+	// clients on the interface itself
+	if link, override, ok := links.match(net.IPv4zero, "eth1"); !ok || override || !link.Equal(net.ParseIP("10.2.0.1")) {
+		t.Errorf("expected link 10.2.0.1 for eth1, got %v %v %v", link, override, ok)
+	}
+}
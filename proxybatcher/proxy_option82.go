@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// RFC 3046 relay agent information (option 82) insertion, see the excerpt in proxy_handler.go. with proxy_option82
+// enabled the proxy adds option 82 to client packets it's the first hop for (giaddr zero), built from the
+// proxy_option82_circuit_id and proxy_option82_remote_id sources:
+//
+// interface  the name of the interface the packet came in on
+// vlan       the VLAN id from the interface name (eth0.100, vlan100)
+// giaddr     the giaddr the proxy forwards with (proxy_server_ip)
+// static     the per-interface strings in proxy_option82_static
+// none       sub-option left out (remote id default)
+//
+// a client packet from an untrusted circuit (not in proxy_option82_trusted) that already carries option 82 is
+// discarded, one from a trusted circuit is forwarded with the option it has. a packet that would grow past
+// proxy_option82_max_size (the upstream MTU when unset) is forwarded without the option. the option is stripped from
+// server replies to transactions the proxy added it to.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	agentCircuitID = 1
+	agentRemoteID  = 2
+)
+
+var option82Sources = []string{"interface", "vlan", "giaddr", "static", "none"}
+
+type relayAgent struct {
+	circuitID string
+	remoteID  string
+	static    map[string]option82Static
+	trusted   map[string]bool
+	maxSize   int
+
+	mutex     sync.Mutex
+	discarded int
+	oversized int
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newRelayAgent(), called by checkConfig() and startDHCPProxy()
+//
+// nil when proxy_option82 is off, the handler then forwards option 82 the way it comes. without
+// proxy_option82_max_size the limit is the upstream interface MTU, less the IP and UDP headers.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func newRelayAgent() (*relayAgent, error) {
+	if !options.Proxy.Option82 {
+		return nil, nil
+	}
+
+	r := &relayAgent{
+		circuitID: strings.ToLower(options.Proxy.Option82CircuitID),
+		remoteID:  strings.ToLower(options.Proxy.Option82RemoteID),
+		static:    make(map[string]option82Static),
+		trusted:   make(map[string]bool),
+		maxSize:   options.Proxy.Option82MaxSize,
+	}
+	if r.circuitID == "" {
+		r.circuitID = "interface"
+	}
+	if r.remoteID == "" {
+		r.remoteID = "none"
+	}
+	for _, s := range options.Proxy.Option82Static {
+		r.static[s.Interface] = s
+	}
+	for _, t := range options.Proxy.Option82Trusted {
+		r.trusted[t] = true
+	}
+
+	if r.maxSize == 0 {
+		iface, err := net.InterfaceByName(options.Proxy.UpstreamInterface)
+		if err != nil {
+			return nil, errors.New("unable to get the MTU of " + options.Proxy.UpstreamInterface + ": " + err.Error())
+		}
+		r.maxSize = iface.MTU - 28
+	}
+	return r, nil
+}
+
+// vlanFromInterface takes the VLAN id from a VLAN interface name, "eth0.100" or "vlan100"
+func vlanFromInterface(name string) string {
+	var id string
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		id = name[i+1:]
+	} else if strings.HasPrefix(strings.ToLower(name), "vlan") {
+		id = name[4:]
+	}
+	if n, err := strconv.Atoi(id); err != nil || n < 1 || n > 4094 {
+		return ""
+	}
+	return id
+}
+
+func (r *relayAgent) source(source string, ifName string, sub int) string {
+	switch source {
+	case "interface":
+		return ifName
+	case "vlan":
+		return vlanFromInterface(ifName)
+	case "giaddr":
+		if proxyServerIP == nil {
+			return ""
+		}
+		return proxyServerIP.String()
+	case "static":
+		if sub == agentCircuitID {
+			return r.static[ifName].CircuitID
+		}
+		return r.static[ifName].RemoteID
+	}
+	return ""
+}
+
+// agentInfo builds the option 82 value for a packet from ifName, empty when neither sub-option has a value
+func (r *relayAgent) agentInfo(ifName string) []byte {
+	var info []byte
+	for _, s := range []struct {
+		code   byte
+		source string
+	}{{agentCircuitID, r.circuitID}, {agentRemoteID, r.remoteID}} {
+		v := r.source(s.source, ifName, int(s.code))
+		if v == "" {
+			continue
+		}
+		if len(v) > 255 {
+			v = v[:255]
+		}
+		info = append(info, s.code, byte(len(v)))
+		info = append(info, v...)
+	}
+	if len(info) > 255 {
+		return nil
+	}
+	return info
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// forward(), called by ServeDHCPIf() for client packets, with out the copy of p going upstream
+//
+// applies the RFC 3046 agent rules to out. returns drop when the packet has to be discarded, and inserted when
+// option 82 was added (so it's stripped from the replies).
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (r *relayAgent) forward(ifName string, p dhcp.Packet, packetOptions dhcp.Options, out *dhcp.Packet) (drop bool, inserted bool) {
+	if r == nil {
+		return false, false
+	}
+
+	_, present := packetOptions[dhcp.OptionRelayAgentInformation]
+	firstHop := p.GIAddr().Equal(net.IPv4zero)
+
+	if present {
+		if firstHop && !r.trusted[ifName] {
+			r.mutex.Lock()
+			r.discarded++
+			r.mutex.Unlock()
+			logger.Warn("proxy: discarded packet from ", p.CHAddr(), " on untrusted circuit ", ifName, " with option 82 already present")
+			return true, false
+		}
+		return false, false
+	}
+	if !firstHop {
+		return false, false
+	}
+
+	info := r.agentInfo(ifName)
+	if len(info) == 0 {
+		return false, false
+	}
+	if len(*out)+2+len(info) > r.maxSize {
+		r.mutex.Lock()
+		r.oversized++
+		r.mutex.Unlock()
+		logger.Warn("proxy: packet from ", p.CHAddr(), " forwarded without option 82, it would exceed ", r.maxSize, " bytes")
+		return false, false
+	}
+
+	*out = insertOption(*out, dhcp.OptionRelayAgentInformation, info)
+	return false, true
+}
+
+// interfaceName looks up the name of the interface a packet came in on, empty when it isn't known
+func interfaceName(ifIndex int) string {
+	if ifIndex <= 0 {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
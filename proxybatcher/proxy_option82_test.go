@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayAgentForward(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+
+	r := &relayAgent{
+		circuitID: "vlan",
+		remoteID:  "static",
+		static:    map[string]option82Static{"eth0.100": {Interface: "eth0.100", RemoteID: "olt-1"}},
+		trusted:   map[string]bool{"eth1": true},
+		maxSize:   576,
+	}
+
+	if v := vlanFromInterface("vlan200"); v != "200" {
+		t.Errorf("expected vlan 200, got %q", v)
+	}
+	if v := vlanFromInterface("eth0"); v != "" {
+		t.Errorf("expected no vlan for eth0, got %q", v)
+	}
+
+	// first hop, option 82 added last
+	p, o := dhcpTestPacket(dhcp.Discover, 1, "aa:bb:cc:dd:ee:f0", nil)
+	out := dhcp.NewPacket(dhcp.BootRequest)
+	for k, v := range o {
+		out.AddOption(k, v)
+	}
+	drop, inserted := r.forward("eth0.100", p, o, &out)
+	if drop || !inserted {
+		t.Fatalf("expected option 82 to be inserted, got drop %v inserted %v", drop, inserted)
+	}
+	want := []byte{agentCircuitID, 3, '1', '0', '0', agentRemoteID, 5, 'o', 'l', 't', '-', '1'}
+	if got := out.ParseOptions()[dhcp.OptionRelayAgentInformation]; !bytes.Equal(got, want) {
+		t.Errorf("expected agent info %v, got %v", want, got)
+	}
+
+	// already present, discarded from an untrusted circuit, forwarded as is from a trusted one
+	p.AddOption(dhcp.OptionRelayAgentInformation, []byte{agentCircuitID, 1, 'x'})
+	o = p.ParseOptions()
+	if drop, _ := r.forward("eth0.100", p, o, &out); !drop || r.discarded != 1 {
+		t.Errorf("expected the untrusted packet to be discarded and counted, got drop %v count %v", drop, r.discarded)
+	}
+	if drop, inserted := r.forward("eth1", p, o, &out); drop || inserted {
+		t.Errorf("expected the trusted packet to be forwarded without a second option 82")
+	}
+
+	// relayed by another agent, left alone
+	p, o = dhcpTestPacket(dhcp.Discover, 2, "aa:bb:cc:dd:ee:f0", nil)
+	p.SetGIAddr(net.ParseIP("10.0.0.1"))
+	out = dhcp.NewPacket(dhcp.BootRequest)
+	if _, inserted := r.forward("eth0.100", p, o, &out); inserted {
+		t.Errorf("expected no option 82 when giaddr is already set")
+	}
+
+	// too big, forwarded without and counted
+	p, o = dhcpTestPacket(dhcp.Discover, 3, "aa:bb:cc:dd:ee:f0", nil)
+	out = dhcp.NewPacket(dhcp.BootRequest)
+	out.AddOption(dhcp.OptionVendorClassIdentifier, bytes.Repeat([]byte{'v'}, 255))
+	out.AddOption(dhcp.OptionHostName, bytes.Repeat([]byte{'h'}, 100))
+	if drop, inserted := r.forward("eth0.100", p, o, &out); drop || inserted || r.oversized != 1 {
+		t.Errorf("expected the oversized packet to be forwarded without option 82, got drop %v inserted %v count %v", drop, inserted, r.oversized)
+	}
+
+	// a nil agent passes everything through
+	var off *relayAgent
+	if drop, inserted := off.forward("eth0.100", p, o, &out); drop || inserted {
+		t.Errorf("expected no change with option 82 insertion off")
+	}
+}
+
+func TestProxyStripsOption82(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+
+	h := &DHCPHandler{
+		transactions: newTransactionTable(time.Minute, 0),
+		relay:        &relayAgent{circuitID: "giaddr", remoteID: "none", maxSize: 1472},
+	}
+
+	p, o := dhcpTestPacket(dhcp.Discover, 10, "aa:bb:cc:dd:ee:f0", nil)
+	up := h.ServeDHCPIf(0, p, dhcp.Discover, o)
+	if _, ok := up.ParseOptions()[dhcp.OptionRelayAgentInformation]; !ok {
+		t.Fatalf("expected option 82 on the forwarded DISCOVER")
+	}
+
+	// the server echoes it, the client doesn't see it
+	offer, _ := dhcpTestPacket(dhcp.Offer, 10, "aa:bb:cc:dd:ee:f0", net.ParseIP("192.0.2.10"))
+	offer.AddOption(dhcp.OptionRelayAgentInformation, up.ParseOptions()[dhcp.OptionRelayAgentInformation])
+	down := h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	if down == nil {
+		t.Fatalf("expected the OFFER to be forwarded")
+	}
+	if _, ok := down.ParseOptions()[dhcp.OptionRelayAgentInformation]; ok {
+		t.Errorf("expected option 82 to be stripped from the OFFER")
+	}
+
+	// not added by the proxy, not stripped
+	h.relay = nil
+	p, o = dhcpTestPacket(dhcp.Discover, 11, "aa:bb:cc:dd:ee:f1", nil)
+	h.ServeDHCPIf(0, p, dhcp.Discover, o)
+	offer, _ = dhcpTestPacket(dhcp.Offer, 11, "aa:bb:cc:dd:ee:f1", net.ParseIP("192.0.2.10"))
+	offer.AddOption(dhcp.OptionRelayAgentInformation, []byte{agentCircuitID, 1, 'x'})
+	if down := h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions()); down == nil || down.ParseOptions()[dhcp.OptionRelayAgentInformation] == nil {
+		t.Errorf("expected option 82 the proxy didn't add to be forwarded")
+	}
+}
+
+func TestNewRelayAgentMTU(t *testing.T) {
+	saved := options.Proxy
+	defer func() { options.Proxy = saved }()
+	options.Proxy.Option82 = true
+	options.Proxy.UpstreamInterface = "missing0"
+
+	// without a max size the MTU has to come from the upstream interface
+	options.Proxy.Option82MaxSize = 0
+	if r, err := newRelayAgent(); err == nil || r != nil {
+		t.Errorf("expected an error for an upstream interface that isn't there")
+	}
+
+	options.Proxy.Option82MaxSize = 1200
+	if r, err := newRelayAgent(); err != nil || r.maxSize != 1200 {
+		t.Errorf("expected proxy_option82_max_size to stand in for the MTU, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// in place packet rewriting for the proxy. packets are forwarded as they came in, with only the fields the proxy has
+// to change touched: giaddr, hops, server identifier and option 82. the options keep their order, and the sname and
+// file fields are left alone -- unless option 52 (overload) puts options in them, then a server identifier in there
+// is rewritten too.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	optionsStart = 240
+	snameStart   = 44
+	fileStart    = 108
+	fileEnd      = 236
+	maxHops      = 16 // RFC 1542 4.1.1
+)
+
+type optionAt struct {
+	code dhcp.OptionCode
+	at   int // offset of the code byte
+	size int
+}
+
+// scanOptions walks the options in p[start:end], end is the offset of the End option (-1 when there isn't one)
+func scanOptions(p dhcp.Packet, start int, end int) (found []optionAt, endAt int) {
+	for i := start; i < end; {
+		switch dhcp.OptionCode(p[i]) {
+		case dhcp.Pad:
+			i++
+			continue
+		case dhcp.End:
+			return found, i
+		}
+		if i+2 > end || i+2+int(p[i+1]) > end {
+			return found, -1
+		}
+		found = append(found, optionAt{code: dhcp.OptionCode(p[i]), at: i, size: int(p[i+1])})
+		i += 2 + int(p[i+1])
+	}
+	return found, -1
+}
+
+// packetOptions finds every option in p, the options field first and then the fields option 52 overloads
+func packetOptions(p dhcp.Packet) []optionAt {
+	if len(p) < optionsStart {
+		return nil
+	}
+	found, _ := scanOptions(p, optionsStart, len(p))
+	for _, o := range found {
+		if o.code != dhcp.OptionOverload || o.size != 1 {
+			continue
+		}
+		overload := p[o.at+2]
+		if overload&1 != 0 {
+			file, _ := scanOptions(p, fileStart, fileEnd)
+			found = append(found, file...)
+		}
+		if overload&2 != 0 {
+			sname, _ := scanOptions(p, snameStart, fileStart)
+			found = append(found, sname...)
+		}
+		break
+	}
+	return found
+}
+
+// insertOption adds an option last in the options field, ahead of End and any padding after it
+func insertOption(p dhcp.Packet, code dhcp.OptionCode, value []byte) dhcp.Packet {
+	_, end := scanOptions(p, optionsStart, len(p))
+	tail := []byte{byte(dhcp.End)}
+	if end >= 0 {
+		tail = p[end:]
+	} else {
+		end = len(p)
+	}
+
+	out := make(dhcp.Packet, 0, len(p)+2+len(value)+1)
+	out = append(out, p[:end]...)
+	out = append(out, byte(code), byte(len(value)))
+	out = append(out, value...)
+	return append(out, tail...)
+}
+
+// removeOption takes code out of the options field, and pads it out of sname and file
+func removeOption(p dhcp.Packet, code dhcp.OptionCode) dhcp.Packet {
+	found := packetOptions(p)
+	for n := len(found) - 1; n >= 0; n-- {
+		o := found[n]
+		if o.code != code {
+			continue
+		}
+		if o.at >= optionsStart {
+			p = append(p[:o.at:o.at], p[o.at+2+o.size:]...)
+			continue
+		}
+		for i := o.at; i < o.at+2+o.size; i++ {
+			p[i] = byte(dhcp.Pad)
+		}
+	}
+	return p
+}
+
+// setOption overwrites code where it is when the length matches, otherwise it's removed and added last
+func setOption(p dhcp.Packet, code dhcp.OptionCode, value []byte) dhcp.Packet {
+	for _, o := range packetOptions(p) {
+		if o.code == code && o.size == len(value) {
+			copy(p[o.at+2:], value)
+			return p
+		}
+	}
+	return insertOption(removeOption(p, code), code, value)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// toServer(), called by ServeDHCPIf() for client packets
+//
+// a copy of p with giaddr set to the proxy and hops counted. false for a packet that's been through too many relays.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func toServer(p dhcp.Packet) (dhcp.Packet, bool) {
+	if p.Hops() > maxHops {
+		logger.Warn("proxy: dropped packet from ", p.CHAddr(), ", ", p.Hops(), " hops")
+		return nil, false
+	}
+	out := append(dhcp.Packet(nil), p...)
+	out.SetHops(p.Hops() + 1)
+	out.SetGIAddr(proxyServerIP)
+	return out, true
+}
+
+// toClient is a copy of the server's reply p with giaddr put back, the proxy's option 82 changes undone and the proxy
+// as the server identifier
+func toClient(p dhcp.Packet, giaddr net.IP, agentInfo int) dhcp.Packet {
+	out := append(dhcp.Packet(nil), p...)
+	out.SetGIAddr(giaddr)
+	if agentInfo&agentInserted != 0 {
+		out = removeOption(out, dhcp.OptionRelayAgentInformation)
+	} else if agentInfo&agentExtended != 0 {
+		out = stripLinkSelection(out)
+	}
+	return setOption(out, dhcp.OptionServerIdentifier, proxyServerIP.To4())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawTestPacket builds a packet the way a client might: options in its own order, padding after End
+func rawTestPacket(op dhcp.OpCode, options ...[]byte) dhcp.Packet {
+	p := dhcp.NewPacket(op)[:optionsStart]
+	for _, o := range options {
+		p = append(p, o...)
+	}
+	return append(p, byte(dhcp.End), 0, 0, 0)
+}
+
+func TestPacketRewriting(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+
+	in := rawTestPacket(dhcp.BootRequest,
+		[]byte{byte(dhcp.OptionDHCPMessageType), 1, byte(dhcp.Discover)},
+		[]byte{byte(dhcp.OptionHostName), 2, 'h', '1'},
+		[]byte{224, 1, 'x'}, // private use, unknown to us
+		[]byte{byte(dhcp.OptionParameterRequestList), 2, 1, 3},
+	)
+	in.SetSecs([]byte{0, 9})
+	in.SetBroadcast(true)
+	in.SetCIAddr(net.ParseIP("10.0.0.9"))
+	in.SetSName([]byte("boot"))
+	in.SetHops(2)
+
+	out, ok := toServer(in)
+	if !ok {
+		t.Fatalf("expected the packet to be forwarded")
+	}
+	if out.Hops() != 3 || !out.GIAddr().Equal(proxyServerIP) {
+		t.Errorf("expected hops 3 and giaddr %v, got %v %v", proxyServerIP, out.Hops(), out.GIAddr())
+	}
+	// everything but hops and giaddr as it came in
+	if !bytes.Equal(out[:3], in[:3]) || !bytes.Equal(out[4:24], in[4:24]) || !bytes.Equal(out[28:], in[28:]) {
+		t.Errorf("expected the rest of the packet unchanged")
+	}
+
+	// option 82 goes last, the padding stays after End
+	out = insertOption(out, dhcp.OptionRelayAgentInformation, []byte{1, 1, 'c'})
+	found := packetOptions(out)
+	if last := found[len(found)-1]; last.code != dhcp.OptionRelayAgentInformation || len(found) != 5 {
+		t.Errorf("expected option 82 added last, got %+v", found)
+	}
+	if !bytes.HasSuffix(out, []byte{byte(dhcp.End), 0, 0, 0}) {
+		t.Errorf("expected the padding after End to stay")
+	}
+	out = removeOption(out, dhcp.OptionRelayAgentInformation)
+	if !bytes.Equal(out[optionsStart:], in[optionsStart:]) {
+		t.Errorf("expected option 82 removed without touching the rest")
+	}
+
+	// a server identifier in the overloaded file field is rewritten where it is
+	reply := rawTestPacket(dhcp.BootReply,
+		[]byte{byte(dhcp.OptionDHCPMessageType), 1, byte(dhcp.Offer)},
+		[]byte{byte(dhcp.OptionOverload), 1, 1},
+	)
+	copy(reply[fileStart:], []byte{byte(dhcp.OptionServerIdentifier), 4, 192, 0, 2, 10, byte(dhcp.End)})
+	down := toClient(reply, net.IPv4zero, 0)
+	if !bytes.Equal(down[fileStart+2:fileStart+6], proxyServerIP.To4()) || len(down) != len(reply) {
+		t.Errorf("expected the overloaded server identifier rewritten in place, got %v", down[fileStart:fileStart+7])
+	}
+
+	// too many hops
+	in.SetHops(maxHops + 1)
+	if _, ok := toServer(in); ok {
+		t.Errorf("expected a packet over %v hops to be dropped", maxHops)
+	}
+}
+
+func TestProxySelectedServer(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	server := net.ParseIP("192.0.2.10")
+	mac := "aa:bb:cc:dd:ee:f0"
+
+	leaseTable.init()
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0)}
+
+	p, o := dhcpTestPacket(dhcp.Discover, 1, mac, nil)
+	h.ServeDHCPIf(0, p, dhcp.Discover, o)
+
+	offer, _ := dhcpTestPacket(dhcp.Offer, 1, mac, server)
+	down := h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	if id := down.ParseOptions()[dhcp.OptionServerIdentifier]; !net.IP(id).Equal(proxyServerIP) {
+		t.Fatalf("expected the client to see the proxy as the server, got %v", net.IP(id))
+	}
+
+	// the client selects the proxy, the server gets its own address back
+	p, o = dhcpTestPacket(dhcp.Request, 1, mac, proxyServerIP)
+	up := h.ServeDHCPIf(0, p, dhcp.Request, o)
+	if id := up.ParseOptions()[dhcp.OptionServerIdentifier]; !net.IP(id).Equal(server) {
+		t.Errorf("expected the REQUEST to name %v, got %v", server, net.IP(id))
+	}
+
+	ack, _ := dhcpTestPacket(dhcp.ACK, 1, mac, server)
+	ack.AddOption(dhcp.OptionIPAddressLeaseTime, []byte{0, 0, 14, 16})
+	if h.ServeDHCPIf(0, ack, dhcp.ACK, ack.ParseOptions()) == nil {
+		t.Errorf("expected the ACK from the selected server to be forwarded")
+	}
+}
+
+func TestProxySelectedServerOfTwo(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	servers := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.20")}
+	offered := []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.20")}
+	mac := "aa:bb:cc:dd:ee:f0"
+
+	leaseTable.init()
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0)}
+
+	p, o := dhcpTestPacket(dhcp.Discover, 1, mac, nil)
+	h.ServeDHCPIf(0, p, dhcp.Discover, o)
+	for i, server := range servers {
+		offer, _ := dhcpTestPacket(dhcp.Offer, 1, mac, server)
+		offer.SetYIAddr(offered[i])
+		h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	}
+
+	// the client takes the second offer, both look like the proxy's
+	p, _ = dhcpTestPacket(dhcp.Request, 1, mac, proxyServerIP)
+	p.AddOption(dhcp.OptionRequestedIPAddress, offered[1].To4())
+	up := h.ServeDHCPIf(0, p, dhcp.Request, p.ParseOptions())
+	if id := up.ParseOptions()[dhcp.OptionServerIdentifier]; !net.IP(id).Equal(servers[1]) {
+		t.Errorf("expected the REQUEST to name %v, got %v", servers[1], net.IP(id))
+	}
+
+	ack, _ := dhcpTestPacket(dhcp.ACK, 1, mac, servers[1])
+	ack.SetYIAddr(offered[1])
+	ack.AddOption(dhcp.OptionIPAddressLeaseTime, []byte{0, 0, 14, 16})
+	if h.ServeDHCPIf(0, ack, dhcp.ACK, ack.ParseOptions()) == nil {
+		t.Errorf("expected the ACK from the second server to be forwarded")
+	}
+}
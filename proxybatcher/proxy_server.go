@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	dhcp "github.com/krolaw/dhcp4"
 	"golang.org/x/net/ipv4"
 	"net"
@@ -31,25 +32,44 @@ func (s *serveIfConn) WriteTo(b []byte, addr net.Addr, src net.IP, index int) (n
 	return s.conn.WriteTo(b, s.cm, addr)
 }
 
-func ListenAndServeIf(interfaceName string, otherName string, port int, handler dhcp.Handler) error {
+// ifListener is the DHCP port ListenIf() opened, bound before anything is served so startDHCPProxy() can fail on it
+type ifListener struct {
+	conn       net.PacketConn
+	ifIndex    int
+	otherIndex int
+}
+
+func ListenIf(interfaceName string, otherName string, port int) (*ifListener, error) {
 	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logger.Debug("listen on ", interfaceName, iface.Index, port)
 	other, err := net.InterfaceByName(otherName)
 	if err != nil {
-		logger.Error("Proxy ListenAndServeIf: net.InterfaceByName " + err.Error())
-		return err
+		logger.Error("Proxy ListenIf: net.InterfaceByName " + err.Error())
+		return nil, err
 	}
 	p := strconv.Itoa(port)
 	l, err := net.ListenPacket("udp4", ":"+p)
 	if err != nil {
-		logger.Error("Proxy ListenAndServeIf: net.ListenPacket " + err.Error())
-		return err
+		logger.Error("Proxy ListenIf: net.ListenPacket " + err.Error())
+		return nil, err
 	}
-	defer l.Close()
-	return ServeIf(iface.Index, other.Index, l, handler)
+	return &ifListener{conn: l, ifIndex: iface.Index, otherIndex: other.Index}, nil
+}
+
+// Serve serves the port until stop signal is sent
+func (l *ifListener) Serve(handler dhcp.Handler, ctl chan bool) error {
+	defer l.conn.Close()
+
+	// closing the socket is what gets Serve() out of its read
+	go func() {
+		<-ctl
+		l.conn.Close()
+	}()
+
+	return ServeIf(l.ifIndex, l.otherIndex, l.conn, handler)
 }
 
 func ServeIf(ifIndex int, otherIndex int, conn net.PacketConn, handler dhcp.Handler) error {
@@ -61,11 +81,48 @@ func ServeIf(ifIndex int, otherIndex int, conn net.PacketConn, handler dhcp.Hand
 	return Serve(&serveIfConn{ifIndex: ifIndex, otherIndex: otherIndex, conn: p}, handler)
 }
 
+// ifHandler is a dhcp.Handler that also takes the interface a packet came in on, and sends replies back out of it
+type ifHandler interface {
+	ServeDHCPIf(ifIndex int, req dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet
+	replyIfIndex(res dhcp.Packet) int
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// replyDestination(), called by Serve() for replies going downstream
+//
+// RFC 2131 4.1, with the giaddr of the reply put back to the one the client's request had:
+//
+// giaddr set        the relay agent that forwarded the request, on port 67
+// NAK               broadcast, a NAKed client has no address to unicast to
+// ciaddr set        the client, on the address it already has
+// otherwise         broadcast
+//
+// without the broadcast flag RFC 2131 would have the reply unicast to yiaddr and chaddr, but that needs an ARP entry
+// the proxy can't write -- the kernel's ARP goes unanswered by a client that doesn't hold the address yet, and plenty
+// of clients (dhclient for one) don't set the flag. 4.1 allows the broadcast when unicast isn't possible.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func replyDestination(res dhcp.Packet) *net.UDPAddr {
+	if giaddr := res.GIAddr(); !giaddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: append(net.IP(nil), giaddr...), Port: 67}
+	}
+	if t := res.ParseOptions()[dhcp.OptionDHCPMessageType]; len(t) == 1 && dhcp.MessageType(t[0]) == dhcp.NAK {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	}
+	if ciaddr := res.CIAddr(); !ciaddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: append(net.IP(nil), ciaddr...), Port: 68}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+}
+
 func Serve(conn *serveIfConn, handler dhcp.Handler) error {
 	buffer := make([]byte, 1500)
 	for {
-		n, _, err := conn.ReadFrom(buffer)
+		n, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			logger.Error("Proxy Serve: conn.ReadFrom " + err.Error())
 			return err
 		}
@@ -76,6 +133,13 @@ func Serve(conn *serveIfConn, handler dhcp.Handler) error {
 		if req.HLen() > 16 { // Invalid size
 			continue
 		}
+		if req.OpCode() == dhcp.BootReply && !fromUpstream(addr) { // replies only come from the upstream servers
+			logger.Warn("proxy: dropped server reply from ", addr, ", not one of proxy_upstream_dhcp_ips")
+			continue
+		}
+		if req.OpCode() == dhcp.BootReply {
+			upstream.replied(addr, req)
+		}
 		options := req.ParseOptions()
 		var reqType dhcp.MessageType
 		if t := options[dhcp.OptionDHCPMessageType]; len(t) != 1 {
@@ -86,10 +150,16 @@ func Serve(conn *serveIfConn, handler dhcp.Handler) error {
 				continue
 			}
 		}
-		if res := handler.ServeDHCP(req, reqType, options); res != nil {
+		var res dhcp.Packet
+		if h, ok := handler.(ifHandler); ok && conn.cm != nil {
+			res = h.ServeDHCPIf(conn.cm.IfIndex, req, reqType, options)
+		} else {
+			res = handler.ServeDHCP(req, reqType, options)
+		}
+		if res != nil {
 			if res.OpCode() == 1 {
 				//logger.Debug("upstream, writing to dhcp server as client (using source port 68 (bootpc))")
-				for _, ip := range dhcpServers {
+				for _, ip := range upstream.targets(res) {
 					_, err= conn.WriteTo(res, &net.UDPAddr{IP: ip, Port: 67}, proxyServerIP, conn.otherIndex)
 					if err != nil {
 						logger.Error(err)
@@ -97,17 +167,15 @@ func Serve(conn *serveIfConn, handler dhcp.Handler) error {
 				}
 			} else {
 				//logger.Debug("downstream, writing to client as dhcp server (using source port 67 (bootps))")
-				//_, err = conn.WriteTo(res, &net.UDPAddr{IP: net.ParseIP("192.168.50.1"), Port: 67}, ProxyServerIP, conn.ifIndex)
-
-				opt := res.ParseOptions()
-				o := string(opt[dhcp.OptionRouter])
-				if len(o) == 4 {
-					_, err = conn.WriteTo(res, &net.UDPAddr{IP: net.IPv4(byte(o[0]), byte(o[1]), byte(o[2]), byte(o[3])), Port: 67}, proxyServerIP, conn.ifIndex)
-					if err != nil {
-						logger.Error(err)
+				index := conn.ifIndex
+				if h, ok := handler.(ifHandler); ok {
+					if i := h.replyIfIndex(res); i > 0 {
+						index = i
 					}
-				} else {
-					logger.Error("invalid send address ", o)
+				}
+				_, err = conn.WriteTo(res, replyDestination(res), proxyServerIP, index)
+				if err != nil {
+					logger.Error(err)
 				}
 			}
 		}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// proxy transaction table. every DISCOVER and REQUEST forwarded upstream opens (or moves on) a transaction keyed by
+// XID + CHADDR, and a server reply is only relayed back when it fits the transaction:
+//
+// DISCOVER  ->  discover   OFFER       accepted in discover or offered (more than one server can offer)
+// REQUEST   ->  request    ACK / NAK   accepted in request, from the server the client selected when it named one
+//
+// anything else -- an unknown transaction, a reply out of sequence, an ACK from a server the client didn't select --
+// is dropped. transactions are evicted proxy_transaction_ttl after their last packet, and the table is capped at
+// proxy_transaction_max entries, oldest evicted first.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type txnState int
+
+const (
+	txnDiscover txnState = iota + 1
+	txnOffered
+	txnRequest
+	txnAcked
+	txnNaked
+)
+
+func (s txnState) String() string {
+	switch s {
+	case txnDiscover:
+		return "discover"
+	case txnOffered:
+		return "offered"
+	case txnRequest:
+		return "request"
+	case txnAcked:
+		return "acked"
+	case txnNaked:
+		return "naked"
+	}
+	return "unknown"
+}
+
+type txnKey struct {
+	xid    uint32
+	chaddr string
+}
+
+type transaction struct {
+	state     txnState
+	serverID  net.IP
+	offers    map[string]net.IP // offering server by yiaddr, the proxy only shows its own address to the client
+	updated   time.Time
+	giaddr    net.IP // the client packet's, zero unless a downstream relay forwarded it
+	ifIndex   int    // the interface the client packet came in on
+	requested net.IP // the address in the REQUEST, the lease a NAK turns down
+	agentInfo int    // agentInserted, agentExtended
+}
+
+type transactionTable struct {
+	mutex    sync.Mutex
+	entry    map[txnKey]*transaction
+	ttl      time.Duration
+	max      int
+	rejected int
+}
+
+func newTransactionTable(ttl time.Duration, max int) *transactionTable {
+	if ttl <= 0 {
+		ttl = 60 * time.Second
+	}
+	if max <= 0 {
+		max = 65536
+	}
+	return &transactionTable{entry: make(map[txnKey]*transaction), ttl: ttl, max: max}
+}
+
+func transactionKey(p dhcp.Packet) txnKey {
+	return txnKey{xid: binary.BigEndian.Uint32(p.XId()), chaddr: p.CHAddr().String()}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// request(), called by ServeDHCP() for client packets forwarded upstream
+//
+// a DISCOVER starts the transaction over, a REQUEST moves it to request -- including renewals and INIT-REBOOT, which
+// never saw a DISCOVER. the server identifier in a REQUEST is the server the client selected, the proxy's own address
+// standing in for the server that offered the address the client requests.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (t *transactionTable) request(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) {
+	key := transactionKey(p)
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	txn, ok := t.entry[key]
+	if !ok {
+		if len(t.entry) >= t.max {
+			t.evict(now)
+		}
+		txn = &transaction{}
+		t.entry[key] = txn
+	}
+	txn.updated = now
+	txn.giaddr = append(net.IP(nil), p.GIAddr().To4()...)
+
+	switch msgType {
+	case dhcp.Discover:
+		txn.state = txnDiscover
+		txn.serverID = nil
+		txn.offers = nil
+	case dhcp.Request:
+		txn.state = txnRequest
+		txn.serverID = nil
+		txn.requested = nil
+		if ip := options[dhcp.OptionRequestedIPAddress]; len(ip) == 4 {
+			txn.requested = append(net.IP(nil), ip...)
+		} else if !p.CIAddr().Equal(net.IPv4zero) {
+			txn.requested = append(net.IP(nil), p.CIAddr().To4()...)
+		}
+		if id := options[dhcp.OptionServerIdentifier]; len(id) == 4 {
+			txn.serverID = append(net.IP(nil), id...)
+			if proxyServerIP != nil && proxyServerIP.Equal(txn.serverID) {
+				txn.serverID = txn.offeredBy(txn.requested)
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// reply(), called by ServeDHCP() for server replies
+//
+// returns whether the reply belongs to an open transaction and fits its state, the reason when it doesn't. the
+// transaction moves on when it does.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (t *transactionTable) reply(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (bool, string) {
+	key := transactionKey(p)
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	txn, ok := t.entry[key]
+	if !ok || now.Sub(txn.updated) > t.ttl {
+		t.rejected++
+		return false, "no open transaction"
+	}
+
+	switch msgType {
+	case dhcp.Offer:
+		if txn.state != txnDiscover && txn.state != txnOffered {
+			t.rejected++
+			return false, "OFFER in state " + txn.state.String()
+		}
+		txn.state = txnOffered
+		if id := options[dhcp.OptionServerIdentifier]; len(id) == 4 {
+			if txn.offers == nil {
+				txn.offers = make(map[string]net.IP)
+			}
+			txn.offers[p.YIAddr().String()] = append(net.IP(nil), id...)
+		}
+	case dhcp.ACK, dhcp.NAK:
+		if txn.state != txnRequest {
+			t.rejected++
+			return false, dhcpMessageName(msgType) + " in state " + txn.state.String()
+		}
+		if id := net.IP(options[dhcp.OptionServerIdentifier]); txn.serverID != nil && !txn.serverID.Equal(id) {
+			t.rejected++
+			return false, dhcpMessageName(msgType) + " from server " + id.String() + ", client selected " + txn.serverID.String()
+		}
+		txn.state = txnAcked
+		if msgType == dhcp.NAK {
+			txn.state = txnNaked
+		}
+	default:
+		t.rejected++
+		return false, "unexpected " + dhcpMessageName(msgType)
+	}
+
+	txn.updated = now
+	return true, ""
+}
+
+// offeredBy is the server whose OFFER the client took, found by the address it requests. without one, or for an
+// address nobody offered, it's only known when a single server made an offer.
+func (txn *transaction) offeredBy(requested net.IP) net.IP {
+	if requested != nil {
+		if id, ok := txn.offers[requested.String()]; ok {
+			return id
+		}
+	}
+	if len(txn.offers) == 1 {
+		for _, id := range txn.offers {
+			return id
+		}
+	}
+	return nil
+}
+
+// setIngress records where the client packets of an open transaction came from, and what the proxy did to their option
+// 82
+func (t *transactionTable) setIngress(p dhcp.Packet, ifIndex int, agentInfo int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if txn, ok := t.entry[transactionKey(p)]; ok {
+		txn.ifIndex = ifIndex
+		txn.agentInfo = agentInfo
+	}
+}
+
+// selected is the server the client picked in its REQUEST, nil when it didn't pick one
+func (t *transactionTable) selected(p dhcp.Packet) net.IP {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if txn, ok := t.entry[transactionKey(p)]; ok {
+		return txn.serverID
+	}
+	return nil
+}
+
+// requested is the address the client asked for in its REQUEST, nil when there wasn't one
+func (t *transactionTable) requested(p dhcp.Packet) net.IP {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if txn, ok := t.entry[transactionKey(p)]; ok {
+		return txn.requested
+	}
+	return nil
+}
+
+// ingress is where a reply goes back to: the client's giaddr (zero when it wasn't relayed) and interface. agentInfo
+// is what the proxy did to option 82, for the reply to undo.
+func (t *transactionTable) ingress(p dhcp.Packet) (giaddr net.IP, ifIndex int, agentInfo int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	txn, ok := t.entry[transactionKey(p)]
+	if !ok {
+		return net.IPv4zero.To4(), 0, 0
+	}
+	if txn.giaddr == nil {
+		return net.IPv4zero.To4(), txn.ifIndex, txn.agentInfo
+	}
+	return txn.giaddr, txn.ifIndex, txn.agentInfo
+}
+
+// evict drops expired transactions, and the oldest one if that doesn't make room. called with the table locked.
+func (t *transactionTable) evict(now time.Time) {
+	var oldest txnKey
+	var oldestAt time.Time
+	for k, v := range t.entry {
+		if now.Sub(v.updated) > t.ttl {
+			delete(t.entry, k)
+			continue
+		}
+		if oldestAt.IsZero() || v.updated.Before(oldestAt) {
+			oldest, oldestAt = k, v.updated
+		}
+	}
+	if len(t.entry) >= t.max {
+		delete(t.entry, oldest)
+	}
+}
+
+// sweep evicts expired transactions every ttl until stop signal is sent
+func (t *transactionTable) sweep(ctl chan bool) {
+	tick := time.NewTicker(t.ttl)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			return
+		case now := <-tick.C:
+			t.mutex.Lock()
+			for k, v := range t.entry {
+				if now.Sub(v.updated) > t.ttl {
+					delete(t.entry, k)
+				}
+			}
+			open, rejected := len(t.entry), t.rejected
+			t.rejected = 0
+			t.mutex.Unlock()
+
+			logger.Debug("proxy transactions: ", open, " open, ", rejected, " replies rejected")
+		}
+	}
+}
+
+func dhcpMessageName(t dhcp.MessageType) string {
+	switch t {
+	case dhcp.Discover:
+		return "DISCOVER"
+	case dhcp.Offer:
+		return "OFFER"
+	case dhcp.Request:
+		return "REQUEST"
+	case dhcp.Decline:
+		return "DECLINE"
+	case dhcp.ACK:
+		return "ACK"
+	case dhcp.NAK:
+		return "NAK"
+	case dhcp.Release:
+		return "RELEASE"
+	case dhcp.Inform:
+		return "INFORM"
+	}
+	return "message type " + strconv.Itoa(int(t))
+}
+
+// fromUpstream reports whether a reply came from one of proxy_upstream_dhcp_ips
+func fromUpstream(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip := range dhcpServers {
+		if ip.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+// dhcpTestPacket builds a client or server packet for the transaction tests
+func dhcpTestPacket(msgType dhcp.MessageType, xid uint32, mac string, serverID net.IP) (dhcp.Packet, dhcp.Options) {
+	op := dhcp.BootRequest
+	if msgType == dhcp.Offer || msgType == dhcp.ACK || msgType == dhcp.NAK {
+		op = dhcp.BootReply
+	}
+
+	p := dhcp.NewPacket(op)
+	p.SetXId([]byte{byte(xid >> 24), byte(xid >> 16), byte(xid >> 8), byte(xid)})
+	hw, _ := net.ParseMAC(mac)
+	p.SetCHAddr(hw)
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(msgType)})
+	if serverID != nil {
+		p.AddOption(dhcp.OptionServerIdentifier, serverID.To4())
+	}
+	return p, p.ParseOptions()
+}
+
+func TestTransactionTable(t *testing.T) {
+	server1 := net.ParseIP("192.0.2.10")
+	server2 := net.ParseIP("192.0.2.20")
+	mac := "aa:bb:cc:dd:ee:f0"
+
+	txns := newTransactionTable(time.Minute, 0)
+
+	step := func(msgType dhcp.MessageType, xid uint32, mac string, serverID net.IP) (bool, string) {
+		p, o := dhcpTestPacket(msgType, xid, mac, serverID)
+		if p.OpCode() == dhcp.BootRequest {
+			txns.request(p, msgType, o)
+			return true, ""
+		}
+		return txns.reply(p, msgType, o)
+	}
+
+	tests := []struct {
+		name     string
+		msgType  dhcp.MessageType
+		xid      uint32
+		mac      string
+		serverID net.IP
+		want     bool
+	}{
+		{"offer without discover", dhcp.Offer, 1, mac, server1, false},
+		{"discover", dhcp.Discover, 1, mac, nil, true},
+		{"ack before request", dhcp.ACK, 1, mac, server1, false},
+		{"offer", dhcp.Offer, 1, mac, server1, true},
+		{"second offer", dhcp.Offer, 1, mac, server2, true},
+		{"offer for another client", dhcp.Offer, 1, "aa:bb:cc:dd:ee:f1", server1, false},
+		{"offer for another xid", dhcp.Offer, 2, mac, server1, false},
+		{"request selecting server1", dhcp.Request, 1, mac, server1, true},
+		{"ack from the other server", dhcp.ACK, 1, mac, server2, false},
+		{"offer after request", dhcp.Offer, 1, mac, server1, false},
+		{"ack", dhcp.ACK, 1, mac, server1, true},
+		{"duplicate ack", dhcp.ACK, 1, mac, server1, false},
+		{"renewal request", dhcp.Request, 3, mac, nil, true},
+		{"renewal nak from any server", dhcp.NAK, 3, mac, server2, true},
+	}
+
+	for _, v := range tests {
+		if ok, reason := step(v.msgType, v.xid, v.mac, v.serverID); ok != v.want {
+			t.Errorf("%v - expected %v, got %v (%v)", v.name, v.want, ok, reason)
+		}
+	}
+
+	if txns.rejected != 7 {
+		t.Errorf("expected 7 rejected replies, got %v", txns.rejected)
+	}
+}
+
+func TestTransactionTableEviction(t *testing.T) {
+	txns := newTransactionTable(time.Minute, 2)
+
+	for i, mac := range []string{"aa:bb:cc:dd:ee:f0", "aa:bb:cc:dd:ee:f1", "aa:bb:cc:dd:ee:f2"} {
+		p, o := dhcpTestPacket(dhcp.Discover, uint32(i), mac, nil)
+		txns.request(p, dhcp.Discover, o)
+		time.Sleep(time.Millisecond)
+	}
+	if len(txns.entry) != 2 {
+		t.Errorf("expected the table to be capped at 2, got %v", len(txns.entry))
+	}
+
+	// the oldest transaction made room
+	p, o := dhcpTestPacket(dhcp.Offer, 0, "aa:bb:cc:dd:ee:f0", nil)
+	if ok, _ := txns.reply(p, dhcp.Offer, o); ok {
+		t.Errorf("expected the oldest transaction to be evicted")
+	}
+
+	// expired transactions don't take replies
+	p, o = dhcpTestPacket(dhcp.Offer, 2, "aa:bb:cc:dd:ee:f2", nil)
+	txns.mutex.Lock()
+	txns.entry[transactionKey(p)].updated = time.Now().Add(-2 * time.Minute)
+	txns.mutex.Unlock()
+	if ok, _ := txns.reply(p, dhcp.Offer, o); ok {
+		t.Errorf("expected the expired transaction to be rejected")
+	}
+}
+
+func TestFromUpstream(t *testing.T) {
+	saved := dhcpServers
+	defer func() { dhcpServers = saved }()
+	dhcpServers = []net.IP{net.ParseIP("192.0.2.10")}
+
+	if !fromUpstream(&net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 67}) {
+		t.Errorf("expected the upstream server to be accepted")
+	}
+	if fromUpstream(&net.UDPAddr{IP: net.ParseIP("192.0.2.99"), Port: 67}) {
+		t.Errorf("expected an unknown server to be rejected")
+	}
+}
+
+func TestReplyDelivery(t *testing.T) {
+	saved := proxyServerIP
+	defer func() { proxyServerIP = saved }()
+	proxyServerIP = net.ParseIP("192.0.2.1")
+	server := net.ParseIP("192.0.2.10")
+
+	h := &DHCPHandler{transactions: newTransactionTable(time.Minute, 0)}
+
+	// relayed by a downstream agent, the OFFER goes back to it with its giaddr
+	p, o := dhcpTestPacket(dhcp.Discover, 1, "aa:bb:cc:dd:ee:f0", nil)
+	p.SetGIAddr(net.ParseIP("10.0.0.1"))
+	h.ServeDHCPIf(7, p, dhcp.Discover, o)
+
+	offer, _ := dhcpTestPacket(dhcp.Offer, 1, "aa:bb:cc:dd:ee:f0", server)
+	offer.SetGIAddr(proxyServerIP)
+	offer.SetYIAddr(net.ParseIP("10.0.0.50"))
+	down := h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	if dst := replyDestination(down); !dst.IP.Equal(net.ParseIP("10.0.0.1")) || dst.Port != 67 {
+		t.Errorf("expected the OFFER to go to the relay on port 67, got %v", dst)
+	}
+	if i := h.replyIfIndex(down); i != 7 {
+		t.Errorf("expected the reply out of interface 7, got %v", i)
+	}
+
+	// direct, no broadcast flag, still broadcast -- the client doesn't answer ARP for yiaddr yet
+	p, o = dhcpTestPacket(dhcp.Discover, 2, "aa:bb:cc:dd:ee:f1", nil)
+	h.ServeDHCPIf(0, p, dhcp.Discover, o)
+	offer, _ = dhcpTestPacket(dhcp.Offer, 2, "aa:bb:cc:dd:ee:f1", server)
+	offer.SetGIAddr(proxyServerIP)
+	offer.SetYIAddr(net.ParseIP("10.0.0.51"))
+	down = h.ServeDHCPIf(0, offer, dhcp.Offer, offer.ParseOptions())
+	if dst := replyDestination(down); !dst.IP.Equal(net.IPv4bcast) || dst.Port != 68 {
+		t.Errorf("expected the OFFER broadcast on port 68, got %v", dst)
+	}
+
+	// broadcast flag
+	down.SetBroadcast(true)
+	if dst := replyDestination(down); !dst.IP.Equal(net.IPv4bcast) {
+		t.Errorf("expected a broadcast with the broadcast flag, got %v", dst)
+	}
+
+	// renewing client, ciaddr
+	down.SetCIAddr(net.ParseIP("10.0.0.51"))
+	down.SetYIAddr(net.IPv4zero)
+	if dst := replyDestination(down); !dst.IP.Equal(net.ParseIP("10.0.0.51")) || dst.Port != 68 {
+		t.Errorf("expected the reply to ciaddr, got %v", dst)
+	}
+
+	// NAKs are broadcast
+	nak, _ := dhcpTestPacket(dhcp.NAK, 3, "aa:bb:cc:dd:ee:f2", server)
+	nak.SetCIAddr(net.ParseIP("10.0.0.52"))
+	if dst := replyDestination(nak); !dst.IP.Equal(net.IPv4bcast) || dst.Port != 68 {
+		t.Errorf("expected the NAK broadcast, got %v", dst)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/binary"
+	dhcp "github.com/krolaw/dhcp4"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// upstream DHCP server selection, proxy_upstream_policy picks which of proxy_upstream_dhcp_ips a client packet goes to:
+//
+// broadcast    every server (the default, each one answers)
+// failover     the first healthy server, in the order they're configured
+// round_robin  the next healthy server in turn
+// mac_hash     the server the client MAC hashes to, the next healthy one after it when that's down
+//
+// a DISCOVER or REQUEST that gets no reply from a server within proxy_upstream_timeout counts as a failure, after
+// proxy_upstream_failures in a row the server is down and only tried again after proxy_upstream_retry. a REQUEST is
+// only waited on from the server it names, or the one holding the lease -- under broadcast the others never answer it.
+// outside broadcast, a REQUEST, RELEASE or DECLINE goes to the server that last answered the client, it holds the
+// lease. a server owns the client until the lease it ACKed runs out (an OFFER holds it for proxy_transaction_ttl), it
+// NAKs the client or the client releases the lease.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+var upstreamPolicies = []string{"broadcast", "failover", "round_robin", "mac_hash"}
+
+var upstream *upstreamPool
+
+type upstreamServer struct {
+	ip       net.IP
+	sent     int
+	replies  int
+	failures int
+	failing  int           // failures in a row
+	down     time.Time     // zero while healthy
+	latency  time.Duration // moving average
+}
+
+type upstreamOwner struct {
+	server int
+	until  time.Time // zero for an infinite lease
+}
+
+type upstreamPending struct {
+	at      time.Time
+	servers []int
+}
+
+type upstreamPool struct {
+	mutex     sync.Mutex
+	policy    string
+	servers   []*upstreamServer
+	next      int
+	owner     map[string]upstreamOwner
+	pending   map[txnKey]upstreamPending
+	ttl       time.Duration
+	timeout   time.Duration
+	retry     time.Duration
+	failAfter int
+}
+
+func newUpstreamPool(servers []net.IP, policy string, ttl time.Duration, timeout time.Duration, retry time.Duration, failAfter int) *upstreamPool {
+	policy = strings.ToLower(policy)
+	if policy == "" {
+		policy = "broadcast"
+	}
+	if ttl <= 0 {
+		ttl = 60 * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	if retry <= 0 {
+		retry = 30 * time.Second
+	}
+	if failAfter <= 0 {
+		failAfter = 3
+	}
+	u := &upstreamPool{
+		policy:    policy,
+		owner:     make(map[string]upstreamOwner),
+		pending:   make(map[txnKey]upstreamPending),
+		ttl:       ttl,
+		timeout:   timeout,
+		retry:     retry,
+		failAfter: failAfter,
+	}
+	for _, ip := range servers {
+		u.servers = append(u.servers, &upstreamServer{ip: ip})
+	}
+	return u
+}
+
+// healthy is true for a server that isn't down, or has been down for long enough to be tried again
+func (u *upstreamPool) healthy(i int, now time.Time) bool {
+	s := u.servers[i]
+	return s.down.IsZero() || now.Sub(s.down) >= u.retry
+}
+
+// index is the position of ip in the pool, -1 when it isn't one of the servers
+func (u *upstreamPool) index(ip net.IP) int {
+	for i, s := range u.servers {
+		if s.ip.Equal(ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+// firstHealthy looks for a healthy server starting at from, -1 when they're all down
+func (u *upstreamPool) firstHealthy(from int, now time.Time) int {
+	for n := 0; n < len(u.servers); n++ {
+		if i := (from + n) % len(u.servers); u.healthy(i, now) {
+			return i
+		}
+	}
+	return -1
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// targets(), called by Serve() for every client packet forwarded upstream
+//
+// picks the servers for p under proxy_upstream_policy, and starts waiting on their replies when p expects one. with
+// every server down, p goes to all of them -- one of them may be back.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (u *upstreamPool) targets(p dhcp.Packet) []net.IP {
+	if u == nil {
+		return dhcpServers
+	}
+	now := time.Now()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.expire(now)
+
+	if len(u.servers) == 0 {
+		return nil
+	}
+
+	options := p.ParseOptions()
+	var msgType dhcp.MessageType
+	if t := options[dhcp.OptionDHCPMessageType]; len(t) == 1 {
+		msgType = dhcp.MessageType(t[0])
+	}
+	mac := p.CHAddr().String()
+	owner, owned := u.owner[mac]
+
+	chosen := -1
+	if u.policy != "broadcast" {
+		if owned && msgType != dhcp.Discover && u.healthy(owner.server, now) {
+			chosen = owner.server
+		} else {
+			switch u.policy {
+			case "failover":
+				chosen = u.firstHealthy(0, now)
+			case "round_robin":
+				chosen = u.firstHealthy(u.next, now)
+				if chosen >= 0 {
+					u.next = (chosen + 1) % len(u.servers)
+				}
+			case "mac_hash":
+				h := fnv.New32a()
+				h.Write(p.CHAddr())
+				chosen = u.firstHealthy(int(h.Sum32()%uint32(len(u.servers))), now)
+			}
+		}
+	}
+
+	var indexes []int
+	if chosen >= 0 {
+		indexes = []int{chosen}
+	} else {
+		for i := range u.servers {
+			indexes = append(indexes, i)
+		}
+	}
+
+	var ips []net.IP
+	for _, i := range indexes {
+		u.servers[i].sent++
+		ips = append(ips, u.servers[i].ip)
+	}
+
+	switch msgType {
+	case dhcp.Discover:
+		u.pending[transactionKey(p)] = upstreamPending{at: now, servers: indexes}
+	case dhcp.Request:
+		// only the server the client selected answers, or the one holding the lease for a renewal
+		answers := -1
+		if i := u.index(net.IP(options[dhcp.OptionServerIdentifier])); i >= 0 {
+			answers = i
+		} else if chosen >= 0 {
+			answers = chosen
+		} else if owned {
+			answers = owner.server
+		}
+		if answers >= 0 {
+			u.pending[transactionKey(p)] = upstreamPending{at: now, servers: []int{answers}}
+		}
+	case dhcp.Release:
+		delete(u.owner, mac)
+	}
+	return ips
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// replied(), called by Serve() for every reply from an upstream server
+//
+// a reply is what keeps a server healthy. the latency is taken from the request it answers, and the server becomes
+// the owner of the client -- until the lease in an ACK runs out, for proxy_transaction_ttl after an OFFER, or until it
+// NAKs it.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (u *upstreamPool) replied(addr net.Addr, p dhcp.Packet) {
+	if u == nil {
+		return
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	index := u.index(udpAddr.IP)
+	if index < 0 {
+		return
+	}
+	s := u.servers[index]
+	s.replies++
+	s.failing = 0
+	if !s.down.IsZero() {
+		logger.Info("proxy upstream: ", s.ip, " is answering again")
+		s.down = time.Time{}
+	}
+
+	key := transactionKey(p)
+	if pending, ok := u.pending[key]; ok {
+		for n, i := range pending.servers {
+			if i != index {
+				continue
+			}
+			if l := now.Sub(pending.at); s.latency == 0 {
+				s.latency = l
+			} else {
+				s.latency += (l - s.latency) / 8
+			}
+			pending.servers = append(pending.servers[:n:n], pending.servers[n+1:]...)
+			break
+		}
+		if len(pending.servers) == 0 {
+			delete(u.pending, key)
+		} else {
+			u.pending[key] = pending
+		}
+	}
+
+	mac := p.CHAddr().String()
+	options := p.ParseOptions()
+	if t := options[dhcp.OptionDHCPMessageType]; len(t) == 1 && dhcp.MessageType(t[0]) == dhcp.NAK {
+		delete(u.owner, mac)
+		return
+	}
+	owner := upstreamOwner{server: index, until: now.Add(u.ttl)}
+	if t := options[dhcp.OptionDHCPMessageType]; len(t) == 1 && dhcp.MessageType(t[0]) == dhcp.ACK {
+		if leaseTime := options[dhcp.OptionIPAddressLeaseTime]; len(leaseTime) == 4 {
+			if secs := binary.BigEndian.Uint32(leaseTime); secs == infiniteLease {
+				owner.until = time.Time{}
+			} else if until := now.Add(time.Duration(secs) * time.Second); until.After(owner.until) {
+				owner.until = until
+			}
+		}
+	}
+	u.owner[mac] = owner
+}
+
+// expire counts the servers that didn't reply within proxy_upstream_timeout as failed. called with the pool locked.
+func (u *upstreamPool) expire(now time.Time) {
+	for k, v := range u.pending {
+		if now.Sub(v.at) < u.timeout {
+			continue
+		}
+		for _, i := range v.servers {
+			s := u.servers[i]
+			s.failures++
+			s.failing++
+			if s.failing >= u.failAfter && (s.down.IsZero() || now.Sub(s.down) >= u.retry) {
+				if s.down.IsZero() {
+					logger.Warn("proxy upstream: ", s.ip, " is down after ", s.failing, " requests without a reply")
+				}
+				s.down = now
+			}
+		}
+		delete(u.pending, k)
+	}
+}
+
+// ownerOf is the server that last answered mac, nil without a pool or an owner
+func (u *upstreamPool) ownerOf(mac string) net.IP {
+	if u == nil {
+		return nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if o, ok := u.owner[mac]; ok {
+		return u.servers[o.server].ip
+	}
+	return nil
+}
+
+// expireOwners forgets the owners whose leases have run out. called with the pool locked.
+func (u *upstreamPool) expireOwners(now time.Time) {
+	for mac, o := range u.owner {
+		if !o.until.IsZero() && now.After(o.until) {
+			delete(u.owner, mac)
+		}
+	}
+}
+
+// monitor expires unanswered requests every proxy_upstream_timeout, forgets owners and logs the server stats every
+// minute, until stop signal is sent
+func (u *upstreamPool) monitor(ctl chan bool) {
+	tick := time.NewTicker(u.timeout)
+	defer tick.Stop()
+	stats := time.NewTicker(time.Minute)
+	defer stats.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			return
+		case now := <-tick.C:
+			u.mutex.Lock()
+			u.expire(now)
+			u.mutex.Unlock()
+		case now := <-stats.C:
+			u.mutex.Lock()
+			u.expireOwners(now)
+			for i, s := range u.servers {
+				logger.Debug("proxy upstream: ", s.ip, " sent ", s.sent, ", replies ", s.replies, ", failures ", s.failures,
+					", latency ", s.latency, ", healthy ", u.healthy(i, now))
+			}
+			u.mutex.Unlock()
+		}
+	}
+}
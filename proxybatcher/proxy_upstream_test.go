@@ -0,0 +1,119 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPolicies(t *testing.T) {
+	servers := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.20")}
+	from := func(i int) net.Addr { return &net.UDPAddr{IP: servers[i], Port: 67} }
+	target := func(u *upstreamPool, msgType dhcp.MessageType, xid uint32, mac string) []net.IP {
+		p, _ := dhcpTestPacket(msgType, xid, mac, nil)
+		return u.targets(p)
+	}
+	reply := func(u *upstreamPool, i int, msgType dhcp.MessageType, xid uint32, mac string) {
+		p, _ := dhcpTestPacket(msgType, xid, mac, servers[i])
+		u.replied(from(i), p)
+	}
+
+	// broadcast
+	u := newUpstreamPool(servers, "", time.Minute, time.Minute, time.Minute, 0)
+	if ips := target(u, dhcp.Discover, 1, "aa:bb:cc:dd:ee:f0"); len(ips) != 2 {
+		t.Errorf("expected broadcast to every server, got %v", ips)
+	}
+
+	// a REQUEST goes to every server, but only the one it names is waited on
+	p, _ := dhcpTestPacket(dhcp.Request, 1, "aa:bb:cc:dd:ee:f0", servers[1])
+	if ips := u.targets(p); len(ips) != 2 {
+		t.Errorf("expected the REQUEST broadcast to every server, got %v", ips)
+	}
+	u.mutex.Lock()
+	u.expire(time.Now().Add(time.Hour))
+	u.mutex.Unlock()
+	if u.servers[0].failures != 0 || u.servers[1].failures != 1 {
+		t.Errorf("expected only the selected server to fail the REQUEST, got %+v %+v", u.servers[0], u.servers[1])
+	}
+
+	// owners go with the lease, or the transaction after an OFFER
+	reply(u, 0, dhcp.Offer, 2, "aa:bb:cc:dd:ee:f1")
+	p, _ = dhcpTestPacket(dhcp.ACK, 3, "aa:bb:cc:dd:ee:f2", servers[1])
+	p.AddOption(dhcp.OptionIPAddressLeaseTime, []byte{0, 0, 0x0e, 0x10})
+	u.replied(from(1), p)
+	u.mutex.Lock()
+	u.expireOwners(time.Now().Add(2 * time.Minute))
+	_, offered := u.owner["aa:bb:cc:dd:ee:f1"]
+	_, acked := u.owner["aa:bb:cc:dd:ee:f2"]
+	u.expireOwners(time.Now().Add(2 * time.Hour))
+	remaining := len(u.owner)
+	u.mutex.Unlock()
+	if offered || !acked || remaining != 0 {
+		t.Errorf("expected the OFFER owner gone after the transaction ttl and the ACK owner after the lease, got %v %v %v", offered, acked, remaining)
+	}
+
+	// round robin, with the REQUEST going to the server that made the offer
+	u = newUpstreamPool(servers, "round_robin", time.Minute, time.Minute, time.Minute, 0)
+	first := target(u, dhcp.Discover, 1, "aa:bb:cc:dd:ee:f0")
+	second := target(u, dhcp.Discover, 2, "aa:bb:cc:dd:ee:f1")
+	if len(first) != 1 || len(second) != 1 || first[0].Equal(second[0]) {
+		t.Errorf("expected round robin over both servers, got %v %v", first, second)
+	}
+	reply(u, 1, dhcp.Offer, 2, "aa:bb:cc:dd:ee:f1")
+	if _, waiting := u.pending[txnKey{xid: 2, chaddr: "aa:bb:cc:dd:ee:f1"}]; waiting || len(u.pending) != 1 {
+		t.Errorf("expected the answered DISCOVER to stop waiting, got %+v", u.pending)
+	}
+	if ips := target(u, dhcp.Request, 2, "aa:bb:cc:dd:ee:f1"); len(ips) != 1 || !ips[0].Equal(servers[1]) {
+		t.Errorf("expected the REQUEST to go to the offering server, got %v", ips)
+	}
+	if u.servers[1].replies != 1 || u.servers[1].sent != 2 {
+		t.Errorf("expected the requests and the reply to be counted, got %+v", u.servers[1])
+	}
+
+	// mac hash is sticky
+	u = newUpstreamPool(servers, "mac_hash", time.Minute, time.Minute, time.Minute, 0)
+	a := target(u, dhcp.Discover, 1, "aa:bb:cc:dd:ee:f2")
+	b := target(u, dhcp.Discover, 2, "aa:bb:cc:dd:ee:f2")
+	if len(a) != 1 || !a[0].Equal(b[0]) {
+		t.Errorf("expected the same server for the same MAC, got %v %v", a, b)
+	}
+
+	// failover moves to the secondary once the primary stops answering, and back once it answers again
+	u = newUpstreamPool(servers, "failover", time.Minute, time.Millisecond, time.Hour, 2)
+	for xid := uint32(1); xid <= 2; xid++ {
+		if ips := target(u, dhcp.Discover, xid, "aa:bb:cc:dd:ee:f3"); len(ips) != 1 || !ips[0].Equal(servers[0]) {
+			t.Fatalf("expected the primary, got %v", ips)
+		}
+		u.mutex.Lock()
+		u.expire(time.Now().Add(time.Second))
+		u.mutex.Unlock()
+	}
+	if u.servers[0].failures != 2 || u.servers[0].down.IsZero() {
+		t.Errorf("expected the primary to be down after 2 failures, got %+v", u.servers[0])
+	}
+	if ips := target(u, dhcp.Discover, 3, "aa:bb:cc:dd:ee:f3"); len(ips) != 1 || !ips[0].Equal(servers[1]) {
+		t.Errorf("expected the secondary, got %v", ips)
+	}
+	reply(u, 0, dhcp.Offer, 9, "aa:bb:cc:dd:ee:f4")
+	if ips := target(u, dhcp.Discover, 4, "aa:bb:cc:dd:ee:f3"); len(ips) != 1 || !ips[0].Equal(servers[0]) {
+		t.Errorf("expected the primary back, got %v", ips)
+	}
+
+	// all down, everyone gets it
+	for _, s := range u.servers {
+		s.down = time.Now()
+	}
+	if ips := target(u, dhcp.Discover, 5, "aa:bb:cc:dd:ee:f3"); len(ips) != 2 {
+		t.Errorf("expected every server with all of them down, got %v", ips)
+	}
+
+	// no pool, the configured servers
+	var none *upstreamPool
+	saved := dhcpServers
+	defer func() { dhcpServers = saved }()
+	dhcpServers = servers
+	if ips := target(none, dhcp.Discover, 1, "aa:bb:cc:dd:ee:f0"); len(ips) != 2 {
+		t.Errorf("expected every configured server without a pool, got %v", ips)
+	}
+}
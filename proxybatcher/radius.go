@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// RADIUS accounting source ("radius" operation mode), for PPPoE / IPoE subscribers where the BNG reports sessions
+// over RADIUS accounting (RFC 2866) instead of DHCP. Start and Interim-Update become active assignments, Stop an
+// expiry, keyed on Calling-Station-Id (the subscriber MAC) and Framed-IP-Address.
+//
+// every NAS has its own shared secret in radius_clients, requests from unknown NAS's or with a bad authenticator are
+// dropped without an answer like any RADIUS server would. anything else gets an Accounting-Response, including
+// requests we ignore, or the NAS keeps retransmitting them.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+
+	radiusAttrUserName         = 1
+	radiusAttrFramedIPAddress  = 8
+	radiusAttrCallingStationID = 31
+	radiusAttrAcctStatusType   = 40
+	radiusAttrNasPortID        = 87
+
+	radiusAcctStart   = 1
+	radiusAcctStop    = 2
+	radiusAcctInterim = 3
+	radiusAcctOn      = 7
+	radiusAcctOff     = 8
+)
+
+type radiusPacket struct {
+	code          byte
+	identifier    byte
+	authenticator [16]byte
+	attributes    []byte
+	raw           []byte
+}
+
+// parseRadiusPacket checks the header and attribute lengths, trailing padding past the length field is dropped
+func parseRadiusPacket(b []byte) (*radiusPacket, error) {
+	if len(b) < 20 {
+		return nil, errors.New("packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 20 || length > 4096 || length > len(b) {
+		return nil, errors.New("bad packet length")
+	}
+
+	p := &radiusPacket{code: b[0], identifier: b[1], attributes: b[20:length], raw: b[:length]}
+	copy(p.authenticator[:], b[4:20])
+
+	for a := p.attributes; len(a) > 0; {
+		if len(a) < 2 || a[1] < 2 || int(a[1]) > len(a) {
+			return nil, errors.New("malformed attribute")
+		}
+		a = a[a[1]:]
+	}
+	return p, nil
+}
+
+// attribute returns the first value of the attribute type, nil when missing
+func (p *radiusPacket) attribute(t byte) []byte {
+	for a := p.attributes; len(a) >= 2; a = a[a[1]:] {
+		if a[0] == t {
+			return a[2:a[1]]
+		}
+	}
+	return nil
+}
+
+// verify checks the Accounting-Request authenticator, MD5(code + id + length + 16 zero octets + attributes + secret)
+func (p *radiusPacket) verify(secret string) bool {
+	h := md5.New()
+	h.Write(p.raw[:4])
+	h.Write(make([]byte, 16))
+	h.Write(p.attributes)
+	h.Write([]byte(secret))
+	return bytes.Equal(h.Sum(nil), p.authenticator[:])
+}
+
+// response builds the (attribute-less) Accounting-Response to p
+func (p *radiusPacket) response(secret string) []byte {
+	r := make([]byte, 20)
+	r[0] = radiusAccountingResponse
+	r[1] = p.identifier
+	binary.BigEndian.PutUint16(r[2:4], 20)
+
+	h := md5.New()
+	h.Write(r[:4])
+	h.Write(p.authenticator[:])
+	h.Write([]byte(secret))
+	copy(r[4:20], h.Sum(nil))
+	return r
+}
+
+// findRadiusClient looks up a NAS from radius_clients by address
+func findRadiusClient(ip net.IP) (radiusClientAuth, bool) {
+	for _, v := range options.Radius.Clients {
+		if n := net.ParseIP(v.NasIP); n != nil && n.Equal(ip) {
+			return v, true
+		}
+	}
+	return radiusClientAuth{}, false
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseCallingStationID(), called by handleRadiusPacket()
+//
+// vendors can't agree on a MAC format, "aa-bb-cc-dd-ee-ff", "AABB.CCDD.EEFF", "aabbccddeeff" and
+// "aa:bb:cc:dd:ee:ff" are all in the wild. separators are dropped and whatever is left must be 12 hex digits.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseCallingStationID(v string) (net.HardwareAddr, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '-', '.', ' ':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(v))
+
+	if len(digits) != 12 {
+		return nil, errors.New("Calling-Station-Id " + v + " is not a MAC address")
+	}
+	mac, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, errors.New("Calling-Station-Id " + v + " is not a MAC address")
+	}
+	return net.HardwareAddr(mac), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// handleRadiusPacket(), called by serveRadius()
+//
+// returns the Accounting-Response to send, or nil when the request is dropped.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func handleRadiusPacket(src net.IP, b []byte) []byte {
+	nas, ok := findRadiusClient(src)
+	if !ok {
+		logger.Warn("radius: request from unknown NAS ", src.String(), " dropped")
+		return nil
+	}
+
+	p, err := parseRadiusPacket(b)
+	if err != nil {
+		logger.Warn("radius: malformed packet from ", src.String(), " dropped")
+		logger.Warn("radius: ", err.Error())
+		return nil
+	}
+	if p.code != radiusAccountingRequest {
+		logger.Debug("radius: ignoring packet code ", p.code, " from ", src.String())
+		return nil
+	}
+	if !p.verify(nas.Secret) {
+		logger.Warn("radius: bad authenticator from ", src.String(), ", check the shared secret")
+		return nil
+	}
+
+	statusType := p.attribute(radiusAttrAcctStatusType)
+	if len(statusType) != 4 {
+		logger.Warn("radius: request from ", src.String(), " without Acct-Status-Type")
+		return p.response(nas.Secret)
+	}
+
+	var expired string
+	switch binary.BigEndian.Uint32(statusType) {
+	case radiusAcctStart, radiusAcctInterim:
+		expired = "0"
+	case radiusAcctStop:
+		expired = "1"
+	case radiusAcctOn, radiusAcctOff:
+		// sessions on the NAS are gone, but accounting doesn't say which ones -- they'll get a Stop or time out in Sonar
+		logger.Info("radius: accounting on/off from NAS ", src.String())
+		return p.response(nas.Secret)
+	default:
+		return p.response(nas.Secret)
+	}
+
+	framedIP := p.attribute(radiusAttrFramedIPAddress)
+	callingStationID := p.attribute(radiusAttrCallingStationID)
+	if len(framedIP) != 4 || callingStationID == nil {
+		logger.Debug("radius: request from ", src.String(), " without Framed-IP-Address / Calling-Station-Id ignored")
+		return p.response(nas.Secret)
+	}
+
+	mac, err := parseCallingStationID(string(callingStationID))
+	if err != nil {
+		logger.Warn("radius: ", err.Error(), ", request from ", src.String(), " ignored")
+		return p.response(nas.Secret)
+	}
+
+	var remoteID string
+	switch strings.ToLower(nas.RemoteID) {
+	case "user_name":
+		remoteID = string(p.attribute(radiusAttrUserName))
+	case "nas_port_id":
+		remoteID = string(p.attribute(radiusAttrNasPortID))
+	}
+	if len(remoteID) > 246 {
+		remoteID = remoteID[:246]
+	}
+
+	batchTable.UpdateBatchTable(expired, src, mac, net.IP(framedIP), remoteID)
+	return p.response(nas.Secret)
+}
+
+func serveRadius(conn net.PacketConn) error {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		if res := handleRadiusPacket(udpAddr.IP, packet); res != nil {
+			if _, err := conn.WriteTo(res, addr); err != nil {
+				logger.Warn("radius: unable to send Accounting-Response to ", addr.String())
+				logger.Warn("radius: ", err.Error())
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startRadiusSource, called by main()
+//
+// starts the accounting listener on radius_address, runs until stop signal is sent. returns an error when the
+// listener won't bind.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startRadiusSource(ctl chan bool) error {
+	address := options.Radius.Address
+	if address == "" {
+		address = ":1813"
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		logger.Error("radius: unable to listen on ", address)
+		logger.Error("radius: ", err.Error())
+		return err
+	}
+
+	go func() {
+		logger.Info("radius: accounting listener on ", address)
+		if err := serveRadius(conn); err != nil {
+			logger.Debug("radius: accounting listener closed")
+			logger.Debug("radius: ", err.Error())
+		}
+	}()
+
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
+
+	conn.Close()
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("radius: exit..")
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// accountingRequest builds a signed Accounting-Request, attrs are type / value pairs
+func accountingRequest(secret string, id byte, attrs ...[]byte) []byte {
+	var a []byte
+	for i := 0; i+1 < len(attrs); i += 2 {
+		a = append(a, attrs[i][0], byte(len(attrs[i+1])+2))
+		a = append(a, attrs[i+1]...)
+	}
+
+	p := make([]byte, 20, 20+len(a))
+	p[0] = radiusAccountingRequest
+	p[1] = id
+	binary.BigEndian.PutUint16(p[2:4], uint16(20+len(a)))
+	p = append(p, a...)
+
+	h := md5.New()
+	h.Write(p)
+	h.Write([]byte(secret))
+	copy(p[4:20], h.Sum(nil))
+	return p
+}
+
+func statusType(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func TestParseCallingStationID(t *testing.T) {
+	for _, v := range []string{"aa-bb-cc-dd-ee-f0", "AABB.CCDD.EEF0", "aabbccddeef0", "AA:BB:CC:DD:EE:F0"} {
+		mac, err := parseCallingStationID(v)
+		if err != nil || mac.String() != "aa:bb:cc:dd:ee:f0" {
+			t.Errorf("%v - got %v, %v", v, mac, err)
+		}
+	}
+	for _, v := range []string{"", "0123456789", "aa:bb:cc:dd:ee:zz", "aa:bb:cc:dd:ee:f0:01"} {
+		if _, err := parseCallingStationID(v); err == nil {
+			t.Errorf("%v - expected an error", v)
+		}
+	}
+}
+
+func TestHandleRadiusPacket(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.Radius.Clients = []radiusClientAuth{{NasIP: "192.0.2.1", Secret: "testing123", RemoteID: "user_name"}}
+	nas := net.ParseIP("192.0.2.1")
+	ip := []byte{192, 168, 1, 10}
+
+	tests := []struct {
+		name    string
+		src     net.IP
+		packet  []byte
+		respond bool
+		expired string
+	}{
+		{"start", nas, accountingRequest("testing123", 1,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStart),
+			[]byte{radiusAttrFramedIPAddress}, ip,
+			[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0"),
+			[]byte{radiusAttrUserName}, []byte("subscriber1")), true, "0"},
+		{"stop", nas, accountingRequest("testing123", 2,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStop),
+			[]byte{radiusAttrFramedIPAddress}, ip,
+			[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0"),
+			[]byte{radiusAttrUserName}, []byte("subscriber1")), true, "1"},
+		{"interim", nas, accountingRequest("testing123", 3,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctInterim),
+			[]byte{radiusAttrFramedIPAddress}, ip,
+			[]byte{radiusAttrCallingStationID}, []byte("aabb.ccdd.eef0"),
+			[]byte{radiusAttrUserName}, []byte("subscriber1")), true, "0"},
+		{"bad secret", nas, accountingRequest("wrongsecret", 4,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStop),
+			[]byte{radiusAttrFramedIPAddress}, ip,
+			[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0")), false, ""},
+		{"unknown nas", net.ParseIP("192.0.2.99"), accountingRequest("testing123", 5,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStop),
+			[]byte{radiusAttrFramedIPAddress}, ip,
+			[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0")), false, ""},
+		{"accounting on", nas, accountingRequest("testing123", 6,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctOn)), true, ""},
+		{"no framed ip", nas, accountingRequest("testing123", 7,
+			[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStop),
+			[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0")), true, ""},
+	}
+
+	for _, v := range tests {
+		batchTable.initTable()
+		res := handleRadiusPacket(v.src, v.packet)
+
+		if (res != nil) != v.respond {
+			t.Errorf("%v - expected response %v, got %v", v.name, v.respond, res)
+			continue
+		}
+		if res != nil {
+			// response authenticator, MD5(code + id + length + request authenticator + attributes + secret)
+			h := md5.New()
+			h.Write(res[:4])
+			h.Write(v.packet[4:20])
+			h.Write([]byte("testing123"))
+			if res[0] != radiusAccountingResponse || res[1] != v.packet[1] || !bytes.Equal(res[4:20], h.Sum(nil)) {
+				t.Errorf("%v - bad Accounting-Response %x", v.name, res)
+			}
+		}
+
+		a, ok := batchTable.entry["aa:bb:cc:dd:ee:f0"]
+		if v.expired == "" {
+			if ok {
+				t.Errorf("%v - expected no batch entry, got %+v", v.name, a)
+			}
+			continue
+		}
+		if !ok || a.Expired != v.expired || a.IpAddress != "192.168.1.10" || a.RemoteID != "subscriber1" {
+			t.Errorf("%v - got %+v", v.name, a)
+		}
+	}
+}
+
+func TestServeRadius(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.Radius.Clients = []radiusClientAuth{{NasIP: "127.0.0.1", Secret: "testing123"}}
+	batchTable.initTable()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	go serveRadius(conn)
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer c.Close()
+
+	c.Write(accountingRequest("testing123", 42,
+		[]byte{radiusAttrAcctStatusType}, statusType(radiusAcctStart),
+		[]byte{radiusAttrFramedIPAddress}, []byte{192, 168, 1, 10},
+		[]byte{radiusAttrCallingStationID}, []byte("AA-BB-CC-DD-EE-F0")))
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	res := make([]byte, 4096)
+	n, err := c.Read(res)
+	if err != nil {
+		t.Fatalf("no Accounting-Response: %v", err)
+	}
+	if n != 20 || res[0] != radiusAccountingResponse || res[1] != 42 {
+		t.Errorf("unexpected response %x", res[:n])
+	}
+
+	batchTable.rwTableMutex.Lock()
+	defer batchTable.rwTableMutex.Unlock()
+	if a, ok := batchTable.entry["aa:bb:cc:dd:ee:f0"]; !ok || a.Expired != "0" {
+		t.Errorf("expected an active assignment, got %+v", a)
+	}
+}
+
+func TestStartRadiusSourceBindFailure(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	saved := options.Radius
+	defer func() { options.Radius = saved }()
+	options.Radius.Address = conn.LocalAddr().String()
+
+	// a mode that can't start returns instead of waiting for a shutdown that never comes
+	done := make(chan error, 1)
+	go func() { done <- startRadiusSource(make(chan bool, 1)) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error for an address in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("startRadiusSource didn't return")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// relay agent information (option 82) sub-options. the option is a sequence of code/length/value TLVs in any order,
+// any of which may be missing:
+//
+// 1   agent circuit id                  RFC 3046
+// 2   agent remote id                   RFC 3046
+// 5   link selection                    RFC 3527
+// 6   subscriber id                     RFC 3993
+// 9   vendor-specific information       RFC 4243
+// 11  server identifier override        RFC 5107
+//
+// sub-options we don't know are kept by code. a sub-option that shows up more than once keeps its first value.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	agentLinkSelection  = 5
+	agentSubscriberID   = 6
+	agentVendorSpecific = 9
+	agentServerOverride = 11
+)
+
+type relayAgentInfo struct {
+	raw            []byte
+	circuitID      []byte
+	remoteID       []byte
+	linkSelection  net.IP
+	subscriberID   string
+	vendor         map[uint32][]byte // by IANA enterprise number
+	serverOverride net.IP
+	other          map[byte][]byte
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// parseRelayAgentInfo(), called by addLease(), keaRemoteID() and the batch endpoint
+//
+// walks the sub-option TLVs of an option 82 value. a truncated TLV, or a link selection or server override that isn't
+// an IPv4 address, fails the whole option -- the sub-options before it can't be trusted either.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func parseRelayAgentInfo(data []byte) (relayAgentInfo, error) {
+	// the sub-options slice into data, which can be a receive buffer the next packet overwrites
+	data = append([]byte(nil), data...)
+	info := relayAgentInfo{raw: data}
+	seen := make(map[byte]bool)
+
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return relayAgentInfo{}, errors.New("option 82: truncated sub-option header")
+		}
+		code, l := data[0], int(data[1])
+		if len(data) < 2+l {
+			return relayAgentInfo{}, errors.New("option 82: sub-option " + strconv.Itoa(int(code)) + " length " + strconv.Itoa(l) + " runs past the option")
+		}
+		v := data[2 : 2+l]
+		data = data[2+l:]
+
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+
+		switch code {
+		case agentCircuitID:
+			info.circuitID = v
+		case agentRemoteID:
+			info.remoteID = v
+		case agentLinkSelection, agentServerOverride:
+			if l != 4 {
+				return relayAgentInfo{}, errors.New("option 82: sub-option " + strconv.Itoa(int(code)) + " must be an IPv4 address")
+			}
+			if code == agentLinkSelection {
+				info.linkSelection = net.IP(v).To4()
+			} else {
+				info.serverOverride = net.IP(v).To4()
+			}
+		case agentSubscriberID:
+			info.subscriberID = string(v)
+		case agentVendorSpecific:
+			vendor, err := parseVendorSubOption(v)
+			if err != nil {
+				return relayAgentInfo{}, err
+			}
+			info.vendor = vendor
+		default:
+			if info.other == nil {
+				info.other = make(map[byte][]byte)
+			}
+			info.other[code] = v
+		}
+	}
+	return info, nil
+}
+
+// parseVendorSubOption splits sub-option 9 into its enterprise number / length / data records
+func parseVendorSubOption(data []byte) (map[uint32][]byte, error) {
+	vendor := make(map[uint32][]byte)
+	for len(data) > 0 {
+		if len(data) < 5 || len(data) < 5+int(data[4]) {
+			return nil, errors.New("option 82: truncated vendor-specific sub-option")
+		}
+		l := int(data[4])
+		vendor[binary.BigEndian.Uint32(data[:4])] = data[5 : 5+l]
+		data = data[5+l:]
+	}
+	return vendor, nil
+}
+
+// parseRelayAgentInfoHex takes option 82 as the hex the routers and Kea log it as, with or without a 0x prefix
+func parseRelayAgentInfoHex(v string) (relayAgentInfo, error) {
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "0x"), "0X")
+	b, err := hex.DecodeString(strings.Replace(v, ":", "", -1))
+	if err != nil {
+		return relayAgentInfo{}, errors.New("option 82: " + err.Error())
+	}
+	return parseRelayAgentInfo(b)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"testing"
+)
+
+func TestParseRelayAgentInfo(t *testing.T) {
+	// remote id first, link selection, subscriber id, vendor data, server override, an unknown sub-option
+	data := []byte{
+		agentRemoteID, 3, 'r', 'i', 'd',
+		agentLinkSelection, 4, 10, 0, 1, 0,
+		agentCircuitID, 4, 'e', 't', 'h', '0',
+		agentSubscriberID, 3, 's', 'u', 'b',
+		agentVendorSpecific, 7, 0, 0, 0x0d, 0xe9, 2, 'v', '1',
+		agentServerOverride, 4, 192, 0, 2, 1,
+		151, 1, 'x',
+		agentCircuitID, 1, 'z',
+	}
+
+	info, err := parseRelayAgentInfo(data)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(info.circuitID) != "eth0" || string(info.remoteID) != "rid" {
+		t.Errorf("expected circuit id eth0 and remote id rid, got %q %q", info.circuitID, info.remoteID)
+	}
+	if !info.linkSelection.Equal(net.ParseIP("10.0.1.0")) || !info.serverOverride.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected link selection 10.0.1.0 and server override 192.0.2.1, got %v %v", info.linkSelection, info.serverOverride)
+	}
+	if info.subscriberID != "sub" || string(info.vendor[3561]) != "v1" || string(info.other[151]) != "x" {
+		t.Errorf("unexpected subscriber, vendor or other sub-options %+v", info)
+	}
+
+	// no sub-options at all, or just a remote id
+	if info, err := parseRelayAgentInfo([]byte{agentRemoteID, 2, 'a', 'b'}); err != nil || info.circuitID != nil || string(info.remoteID) != "ab" {
+		t.Errorf("expected just a remote id, got %+v %v", info, err)
+	}
+
+	for name, bad := range map[string][]byte{
+		"truncated header": {agentCircuitID, 1, 'a', agentRemoteID},
+		"truncated value":  {agentCircuitID, 5, 'a'},
+		"link selection":   {agentLinkSelection, 3, 10, 0, 1},
+		"vendor":           {agentVendorSpecific, 6, 0, 0, 0x0d, 0xe9, 2, 'v'},
+	} {
+		if _, err := parseRelayAgentInfo(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if info, err := parseRelayAgentInfoHex("0x0203726964"); err != nil || string(info.remoteID) != "rid" {
+		t.Errorf("expected remote id rid from hex, got %+v %v", info, err)
+	}
+}
+
+func TestAddLeaseRelayAgentInfo(t *testing.T) {
+	leaseTable.init()
+
+	// remote id ahead of the circuit id used to misparse
+	options := dhcp.Options{dhcp.OptionRelayAgentInformation: {agentRemoteID, 3, 'r', 'i', 'd', agentCircuitID, 2, 'c', '1'}}
+	leaseTable.addLease("aa:bb:cc:dd:ee:f0", "192.168.1.10", 3600, options)
+	if l := leaseTable.entry["aa:bb:cc:dd:ee:f0"]; l.cid != "c1" || l.rid != "rid" {
+		t.Errorf("expected circuit id c1 and remote id rid, got %q %q", l.cid, l.rid)
+	}
+
+	// a broken option 82 doesn't take the lease down with it
+	options = dhcp.Options{dhcp.OptionRelayAgentInformation: {agentCircuitID, 9, 'c'}}
+	leaseTable.addLease("aa:bb:cc:dd:ee:f1", "192.168.1.11", 3600, options)
+	if l, ok := leaseTable.entry["aa:bb:cc:dd:ee:f1"]; !ok || l.cid != "" || l.rid != "" {
+		t.Errorf("expected the lease without circuit or remote id, got %+v", l)
+	}
+}
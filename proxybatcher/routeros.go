@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// RouterOS API source ("routeros" operation mode), polls /ip/dhcp-server/lease on the MikroTik routers in
+// batch_routers that have api_username set, rather than waiting for each router's lease script to call
+// /api/dhcp_assignments. every poll is diffed against the previous one like the lease files are.
+//
+// the API is a stream of sentences, a sentence is a list of length prefixed words ended by an empty word:
+//
+// /ip/dhcp-server/lease/print  =.proplist=address,mac-address,status  ""
+// !re  =address=192.168.88.254  =mac-address=AA:BB:CC:DD:EE:F0  =status=bound  ""
+// !done  ""
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type routerOSConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// encodeRouterOSLength is the API's variable length encoding, 1 to 5 bytes
+func encodeRouterOSLength(l int) []byte {
+	switch {
+	case l < 0x80:
+		return []byte{byte(l)}
+	case l < 0x4000:
+		return []byte{byte(l>>8) | 0x80, byte(l)}
+	case l < 0x200000:
+		return []byte{byte(l>>16) | 0xC0, byte(l >> 8), byte(l)}
+	case l < 0x10000000:
+		return []byte{byte(l>>24) | 0xE0, byte(l >> 16), byte(l >> 8), byte(l)}
+	default:
+		return []byte{0xF0, byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)}
+	}
+}
+
+func readRouterOSLength(r *bufio.Reader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	var extra int
+	l := int(b)
+	switch {
+	case b&0x80 == 0x00:
+		return l, nil
+	case b&0xC0 == 0x80:
+		l, extra = l&^0xC0, 1
+	case b&0xE0 == 0xC0:
+		l, extra = l&^0xE0, 2
+	case b&0xF0 == 0xE0:
+		l, extra = l&^0xF0, 3
+	case b == 0xF0:
+		l, extra = 0, 4
+	default:
+		return 0, errors.New("routeros: bad word length")
+	}
+
+	for i := 0; i < extra; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		l = l<<8 | int(b)
+	}
+	return l, nil
+}
+
+func (c *routerOSConn) writeSentence(words ...string) error {
+	var buf []byte
+	for _, w := range words {
+		buf = append(buf, encodeRouterOSLength(len(w))...)
+		buf = append(buf, w...)
+	}
+	buf = append(buf, 0)
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *routerOSConn) readSentence() ([]string, error) {
+	var words []string
+	for {
+		l, err := readRouterOSLength(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if l == 0 {
+			return words, nil
+		}
+		if l > 1024*1024 {
+			return nil, errors.New("routeros: word too long")
+		}
+		w := make([]byte, l)
+		if _, err := io.ReadFull(c.r, w); err != nil {
+			return nil, err
+		}
+		words = append(words, string(w))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// run(), called by login() and fetchRouterOSLeases()
+//
+// sends a command and collects the attributes of every !re reply until !done, which is returned last. a !trap or
+// !fatal is returned as an error with the router's message.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (c *routerOSConn) run(words ...string) ([]map[string]string, error) {
+	if err := c.writeSentence(words...); err != nil {
+		return nil, err
+	}
+
+	var replies []map[string]string
+	var trap error
+	for {
+		sentence, err := c.readSentence()
+		if err != nil {
+			return nil, err
+		}
+		if len(sentence) == 0 {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for _, w := range sentence[1:] {
+			if !strings.HasPrefix(w, "=") {
+				continue
+			}
+			if i := strings.Index(w[1:], "="); i >= 0 {
+				attrs[w[1:i+1]] = w[i+2:]
+			}
+		}
+
+		switch sentence[0] {
+		case "!re":
+			replies = append(replies, attrs)
+		case "!trap":
+			trap = errors.New("routeros: " + attrs["message"])
+		case "!fatal":
+			if len(sentence) > 1 {
+				return nil, errors.New("routeros: " + sentence[1])
+			}
+			return nil, errors.New("routeros: fatal error")
+		case "!done":
+			if trap != nil {
+				return nil, trap
+			}
+			return append(replies, attrs), nil
+		}
+	}
+}
+
+// login tries the post 6.43 plain login, falling back to the MD5 challenge for older releases
+func (c *routerOSConn) login(username string, password string) error {
+	res, err := c.run("/login", "=name="+username, "=password="+password)
+	if err != nil {
+		return err
+	}
+
+	challenge, ok := res[len(res)-1]["ret"]
+	if !ok {
+		return nil
+	}
+	b, err := hex.DecodeString(challenge)
+	if err != nil {
+		return errors.New("routeros: bad login challenge")
+	}
+
+	h := md5.New()
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	h.Write(b)
+	_, err = c.run("/login", "=name="+username, "=response=00"+hex.EncodeToString(h.Sum(nil)))
+	return err
+}
+
+func dialRouterOS(router batchRouterAuth) (*routerOSConn, error) {
+	port := router.ApiPort
+	if port == "" {
+		port = "8728"
+		if router.ApiUseTLS {
+			port = "8729"
+		}
+	}
+	address := net.JoinHostPort(router.RouterIP, port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if router.ApiUseTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			ServerName:         router.RouterIP,
+			InsecureSkipVerify: router.ApiTLSSkipVerify,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	return &routerOSConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// fetchRouterOSLeases(), called by pollRouterOS()
+//
+// a fresh connection per poll, polls are far enough apart that keeping the session alive isn't worth the reconnect
+// handling. only "bound" leases are active, waiting static leases and disabled leases are treated as expired.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func fetchRouterOSLeases(router batchRouterAuth) ([]leaseFileEntry, error) {
+	c, err := dialRouterOS(router)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+
+	if err := c.login(router.ApiUsername, router.ApiPassword); err != nil {
+		return nil, err
+	}
+
+	res, err := c.run("/ip/dhcp-server/lease/print", "=.proplist=address,mac-address,status,disabled,agent-remote-id")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []leaseFileEntry
+	for _, l := range res[:len(res)-1] {
+		ip := net.ParseIP(l["address"])
+		mac, err := net.ParseMAC(l["mac-address"])
+		if ip == nil || err != nil {
+			continue
+		}
+
+		remoteID := l["agent-remote-id"]
+		if len(remoteID) > 246 {
+			remoteID = remoteID[:246]
+		}
+
+		entries = append(entries, leaseFileEntry{
+			mac:      mac.String(),
+			ip:       ip.String(),
+			remoteID: remoteID,
+			active:   l["status"] == "bound" && l["disabled"] != "true",
+		})
+	}
+	return entries, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// pollRouterOS(), called by startRouterOSSource()
+//
+// polls a router and diffs a snapshot against the previous poll. a failed poll keeps the previous snapshot, an
+// unreachable router shouldn't expire its leases. runs until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func pollRouterOS(router batchRouterAuth, ctl chan bool) {
+	routerIP := net.ParseIP(router.RouterIP)
+	prev := make(leaseSnapshot)
+
+	interval := time.Duration(router.PollInterval) * time.Second
+	if interval == 0 {
+		interval = 60 * time.Second
+	}
+
+	poll := func() {
+		entries, err := fetchRouterOSLeases(router)
+		if err != nil {
+			logger.Warn("routeros: unable to fetch leases from ", router.RouterIP)
+			logger.Warn("routeros: ", err.Error())
+			return
+		}
+
+		cur := snapshotAt(entries, time.Now())
+		changes := diffSnapshots(prev, cur)
+		prev = cur
+
+		if len(changes) > 0 {
+			logger.Info("routeros: ", router.RouterIP, " ", len(changes), " lease change(s)")
+			applySnapshotChanges(changes, routerIP)
+		}
+	}
+
+	logger.Info("routeros: polling ", router.RouterIP, " every ", interval.String())
+	poll()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			logger.Debug("routeros: ", router.RouterIP, " exit..")
+			return
+		case <-t.C:
+			poll()
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startRouterOSSource, called by main()
+//
+// starts a poller per router with API credentials, routines are concurrent and will run until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startRouterOSSource(ctl chan bool) error {
+	var stops []chan bool
+	for _, router := range options.Batch.Routers {
+		if router.ApiUsername == "" {
+			continue
+		}
+		stop := make(chan bool)
+		stops = append(stops, stop)
+		go pollRouterOS(router, stop)
+	}
+
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
+
+	for _, s := range stops {
+		s <- true
+	}
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("routeros: exit..")
+	return nil
+}
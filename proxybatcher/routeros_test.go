@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeRouterOS serves logins and /ip/dhcp-server/lease/print, legacy switches to the pre 6.43 challenge login
+func fakeRouterOS(ln net.Listener, legacy bool, leases [][]string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			c := &routerOSConn{conn: conn, r: bufio.NewReader(conn)}
+			challenge := []byte("0123456789abcdef")
+
+			for {
+				sentence, err := c.readSentence()
+				if err != nil || len(sentence) == 0 {
+					return
+				}
+
+				switch sentence[0] {
+				case "/login":
+					attrs := make(map[string]string)
+					for _, w := range sentence[1:] {
+						for i := 1; i < len(w); i++ {
+							if w[i] == '=' {
+								attrs[w[1:i]] = w[i+1:]
+								break
+							}
+						}
+					}
+					switch {
+					case !legacy && attrs["name"] == "api" && attrs["password"] == "apipassword":
+						c.writeSentence("!done")
+					case legacy && attrs["password"] != "":
+						c.writeSentence("!done", "=ret="+hex.EncodeToString(challenge))
+					case legacy && attrs["response"] != "":
+						h := md5.New()
+						h.Write([]byte{0})
+						h.Write([]byte("apipassword"))
+						h.Write(challenge)
+						if attrs["response"] == "00"+hex.EncodeToString(h.Sum(nil)) {
+							c.writeSentence("!done")
+						} else {
+							c.writeSentence("!trap", "=message=invalid user name or password (6)")
+							c.writeSentence("!done")
+						}
+					default:
+						c.writeSentence("!trap", "=message=invalid user name or password (6)")
+						c.writeSentence("!done")
+					}
+				case "/ip/dhcp-server/lease/print":
+					for _, l := range leases {
+						c.writeSentence(append([]string{"!re"}, l...)...)
+					}
+					c.writeSentence("!done")
+				default:
+					c.writeSentence("!trap", "=message=no such command")
+					c.writeSentence("!done")
+				}
+			}
+		}(conn)
+	}
+}
+
+var routerOSLeases = [][]string{
+	{"=.id=*1", "=address=192.168.88.10", "=mac-address=AA:BB:CC:DD:EE:F0", "=status=bound", "=disabled=false", "=agent-remote-id=router1"},
+	{"=.id=*2", "=address=192.168.88.11", "=mac-address=AA:BB:CC:DD:EE:F1", "=status=waiting", "=disabled=false"},
+	{"=.id=*3", "=address=192.168.88.12", "=mac-address=AA:BB:CC:DD:EE:F2", "=status=bound", "=disabled=true"},
+}
+
+func TestRouterOSLength(t *testing.T) {
+	for _, l := range []int{0, 0x7F, 0x80, 0x3FFF, 0x4000, 0x1FFFFF, 0x200000, 0xFFFFFFF, 0x10000000} {
+		b := encodeRouterOSLength(l)
+		got, err := readRouterOSLength(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || got != l {
+			t.Errorf("%x - encoded as %x, decoded %x, %v", l, b, got, err)
+		}
+	}
+}
+
+func TestFetchRouterOSLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher-routeros")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "api.crt")
+	keyFile := filepath.Join(dir, "api.key")
+	writeTestKeyPair(t, certFile, keyFile, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		legacy   bool
+		useTLS   bool
+		password string
+		fail     bool
+	}{
+		{"plain", false, false, "apipassword", false},
+		{"legacy login", true, false, "apipassword", false},
+		{"tls", false, true, "apipassword", false},
+		{"bad password", false, false, "wrong", true},
+		{"legacy bad password", true, false, "wrong", true},
+	}
+
+	for _, v := range tests {
+		var ln net.Listener
+		if v.useTLS {
+			ln, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		} else {
+			ln, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatalf("%v - listen: %v", v.name, err)
+		}
+		go fakeRouterOS(ln, v.legacy, routerOSLeases)
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		router := batchRouterAuth{
+			RouterIP:         "127.0.0.1",
+			ApiUsername:      "api",
+			ApiPassword:      v.password,
+			ApiPort:          port,
+			ApiUseTLS:        v.useTLS,
+			ApiTLSSkipVerify: true,
+		}
+
+		entries, err := fetchRouterOSLeases(router)
+		ln.Close()
+
+		if v.fail {
+			if err == nil {
+				t.Errorf("%v - expected an error", v.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v - %v", v.name, err)
+			continue
+		}
+
+		s := snapshotAt(entries, time.Now())
+		if len(s) != 3 {
+			t.Errorf("%v - expected 3 leases, got %v", v.name, len(s))
+		}
+		if a := s["aa:bb:cc:dd:ee:f0"]; a.Expired != "0" || a.IpAddress != "192.168.88.10" || a.RemoteID != "router1" {
+			t.Errorf("%v - unexpected bound lease %+v", v.name, a)
+		}
+		if s["aa:bb:cc:dd:ee:f1"].Expired != "1" || s["aa:bb:cc:dd:ee:f2"].Expired != "1" {
+			t.Errorf("%v - expected waiting and disabled leases to be expired, got %+v", v.name, s)
+		}
+	}
+}
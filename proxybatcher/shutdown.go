@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// shutdown, every mode waits in waitForShutdown() for SIGINT (ctrl+c) or SIGTERM (systemd, docker), stops taking in
+// new assignments, stops the scheduler and returns to main(), which dispatches whatever is left in the batch table
+// with batch_shutdown_timeout to do it in.
+//
+// exit codes:
+//
+// 0  clean exit, everything received was dispatched
+// 1  configuration or startup error
+// 3  shut down with assignments Sonar didn't accept (kept for the next start when persistence is enabled)
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	exitOK          = 0
+	exitConfig      = 1
+	exitUndelivered = 3
+)
+
+// waitForShutdown blocks until SIGINT or SIGTERM. a second signal gets the default behaviour, killing the process
+// if the drain hangs.
+func waitForShutdown() os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-stop
+	signal.Stop(stop)
+
+	logger.Println()
+	logger.Info("received ", sig.String(), ", shutting down")
+	return sig
+}
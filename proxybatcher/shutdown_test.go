@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSonar points sendBatch at a test server, handler decides the response
+func fakeSonar(handler http.HandlerFunc) func() {
+	server := httptest.NewTLSServer(handler)
+
+	savedClient, savedSonar := sonarClient, options.Sonar
+	sonarClient = server.Client()
+	options.Sonar.Version = 1
+	options.Sonar.InstanceName = strings.TrimPrefix(server.URL, "https://")
+
+	return func() {
+		server.Close()
+		sonarClient, options.Sonar = savedClient, savedSonar
+	}
+}
+
+func TestDrain(t *testing.T) {
+	router := net.ParseIP("192.0.2.1")
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:F0")
+	ip := net.ParseIP("192.168.1.10")
+
+	// Sonar takes the last batch
+	var received []Assignment
+	cleanup := fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string][]Assignment
+		json.NewDecoder(r.Body).Decode(&body)
+		received = append(received, body["data"]...)
+	})
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac, ip, "drain")
+
+	if code := batchTable.drain(5 * time.Second); code != exitOK {
+		t.Errorf("expected exit code %v, got %v", exitOK, code)
+	}
+	if len(received) != 1 || received[0].RemoteID != "drain" {
+		t.Errorf("expected the remaining assignment to be sent, got %+v", received)
+	}
+	if len(batchTable.entry) != 0 {
+		t.Errorf("expected an empty batch table, got %+v", batchTable.entry)
+	}
+
+	// nothing to send is a clean exit
+	if code := batchTable.drain(5 * time.Second); code != exitOK {
+		t.Errorf("empty table, expected exit code %v, got %v", exitOK, code)
+	}
+	cleanup()
+
+	// Sonar refuses the batch, it stays in the persistence log
+	cleanup = fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	dir, err := ioutil.TempDir("", "batcher-drain")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	persist, err = openWalStore(dir, "always", 0)
+	if err != nil {
+		t.Fatalf("openWalStore: %v", err)
+	}
+	defer func() {
+		persist.close()
+		persist = nil
+	}()
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac, ip, "refused")
+
+	if code := batchTable.drain(5 * time.Second); code != exitUndelivered {
+		t.Errorf("refused batch, expected exit code %v, got %v", exitUndelivered, code)
+	}
+	if unsent := persist.state.unsent(); unsent["aa:bb:cc:dd:ee:f0"].RemoteID != "refused" {
+		t.Errorf("expected the refused assignment to be kept, got %+v", unsent)
+	}
+	cleanup()
+
+	// an earlier dispatch was refused, it's put back and goes out with the last batch
+	calls := 0
+	received = nil
+	cleanup = fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body map[string][]Assignment
+		json.NewDecoder(r.Body).Decode(&body)
+		received = append(received, body["data"]...)
+	})
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac, ip, "refused")
+	batchTable.flushEntries("size")
+	other, _ := net.ParseMAC("AA:BB:CC:DD:EE:F1")
+	batchTable.UpdateBatchTable("0", router, other, net.ParseIP("192.168.1.11"), "accepted")
+
+	if code := batchTable.drain(5 * time.Second); code != exitOK {
+		t.Errorf("refused dispatch put back, expected exit code %v, got %v", exitOK, code)
+	}
+	if calls != 2 || len(received) != 2 {
+		t.Errorf("expected the refused assignment in the last batch, got %v request(s) %+v", calls, received)
+	}
+
+	// the lease table dispatch isn't put back, a lease that's gone by the drain never made it
+	savedMode := options.OperationMode
+	options.OperationMode = "proxy"
+	calls = 0
+	batchTable.initTable()
+	leaseTable.init()
+	batchTable.dispatch(0, []Assignment{{Expired: "1", IpAddress: ip.String(), MacAddress: mac.String()}})
+
+	if code := batchTable.drain(5 * time.Second); code != exitUndelivered {
+		t.Errorf("refused lease table dispatch, expected exit code %v, got %v", exitUndelivered, code)
+	}
+	options.OperationMode = savedMode
+	cleanup()
+
+	// Sonar doesn't answer within the deadline
+	release := make(chan bool)
+	cleanup = fakeSonar(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer cleanup()
+	defer close(release)
+
+	batchTable.initTable()
+	batchTable.UpdateBatchTable("0", router, mac, ip, "slow")
+
+	start := time.Now()
+	if code := batchTable.drain(200 * time.Millisecond); code != exitUndelivered {
+		t.Errorf("slow Sonar, expected exit code %v, got %v", exitUndelivered, code)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("drain ignored its deadline, took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	dhcp "github.com/krolaw/dhcp4"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// passive DHCP snooping ("snoop" operation mode), for deployments that want the lease table without a relay in the
+// packet path. DHCP is captured off a mirror / SPAN port (snoop_if, a linux packet socket in snoop_linux.go) and the
+// DORA transactions rebuilt with the proxy's transaction table: an ACK is only taken when it answers a REQUEST that
+// was seen, from the server the client selected. ACKs, NAKs, RELEASEs and DECLINEs then go through leaseTable.track()
+// like they do in proxy mode. nothing is ever sent.
+//
+// a mirror port often shows the same message twice, once from the client and once relayed. a REQUEST seen twice just
+// reopens the transaction, the second copy of an ACK finds it acked and is ignored.
+//
+// snoop_pcap reads a capture file (classic pcap, Ethernet or raw IPv4) before capturing live, for testing. the leases
+// are timed from when they are read, not from the capture timestamps.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	ipProtocolUDP  = 17
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101
+	pcapMaxRecord    = 262144
+)
+
+// frameCapture is a capture on the mirror interface, openCapture() in snoop_linux.go
+type frameCapture interface {
+	readFrame(b []byte) (int, error)
+	Close() error
+}
+
+type snooper struct {
+	transactions *transactionTable
+}
+
+func newSnooper() *snooper {
+	return &snooper{transactions: newTransactionTable(time.Duration(options.Proxy.TransactionTTL)*time.Second, options.Proxy.TransactionMax)}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// observe(), called by capture() and replayPcap() for every DHCP packet seen
+//
+// client messages open or move on their transaction, server replies have to fit it -- the same checks ServeDHCPIf()
+// makes before it relays a reply. a message on the wrong side (a BOOTREPLY carrying a REQUEST) is ignored.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (s *snooper) observe(p dhcp.Packet) {
+	options := p.ParseOptions()
+	t := options[dhcp.OptionDHCPMessageType]
+	if len(t) != 1 {
+		return
+	}
+	msgType := dhcp.MessageType(t[0])
+
+	switch msgType {
+	case dhcp.Discover, dhcp.Request:
+		if p.OpCode() != dhcp.BootRequest {
+			return
+		}
+		s.transactions.request(p, msgType, options)
+		return
+
+	case dhcp.Offer, dhcp.ACK, dhcp.NAK:
+		if p.OpCode() != dhcp.BootReply {
+			return
+		}
+		if ok, reason := s.transactions.reply(p, msgType, options); !ok {
+			logger.Debug("snoop: ignored ", dhcpMessageName(msgType), " for ", p.CHAddr(), ", ", reason)
+			return
+		}
+		if msgType == dhcp.ACK {
+			logger.Info("snoop: ACK ", p.YIAddr(), " to ", p.CHAddr())
+		}
+
+	case dhcp.Release, dhcp.Decline:
+		if p.OpCode() != dhcp.BootRequest {
+			return
+		}
+
+	default:
+		return
+	}
+	leaseTable.track(s.transactions, p, msgType, options)
+}
+
+// capture feeds the DHCP packets in frames off the mirror interface to observe() until the capture is closed
+func (s *snooper) capture(c frameCapture) {
+	b := make([]byte, 65536)
+	for {
+		n, err := c.readFrame(b)
+		if err != nil {
+			logger.Debug("snoop: capture closed")
+			logger.Debug("snoop: ", err.Error())
+			return
+		}
+		if p := dhcpFromFrame(b[:n]); p != nil {
+			s.observe(p)
+		}
+	}
+}
+
+// replayPcap feeds the DHCP packets in a pcap file to observe(), returns how many there were
+func (s *snooper) replayPcap(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int
+	err = readPcap(bufio.NewReader(f), func(linkType uint32, data []byte) {
+		p := dhcpFromFrame(data)
+		if linkType == pcapLinkRaw {
+			p = dhcpFromIPv4(data)
+		}
+		if p != nil {
+			n++
+			s.observe(p)
+		}
+	})
+	return n, err
+}
+
+// dhcpFromFrame is the DHCP payload of an Ethernet frame, nil when the frame isn't DHCP. VLAN tags, single or
+// stacked, are skipped.
+func dhcpFromFrame(frame []byte) dhcp.Packet {
+	if len(frame) < 14 {
+		return nil
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	off := 14
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(frame) < off+4 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[off+2 : off+4])
+		off += 4
+	}
+	if etherType != etherTypeIPv4 {
+		return nil
+	}
+	return dhcpFromIPv4(frame[off:])
+}
+
+// dhcpFromIPv4 is the DHCP payload of an IPv4 packet, nil when it isn't UDP between ports 67 and 68 or is a fragment
+func dhcpFromIPv4(b []byte) dhcp.Packet {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return nil
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl || b[9] != ipProtocolUDP {
+		return nil
+	}
+	// more fragments, or a fragment offset
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return nil
+	}
+	if total := int(binary.BigEndian.Uint16(b[2:4])); total >= ihl && total < len(b) {
+		b = b[:total] // ethernet padding
+	}
+
+	udp := b[ihl:]
+	if len(udp) < 8 {
+		return nil
+	}
+	src, dst := binary.BigEndian.Uint16(udp[0:2]), binary.BigEndian.Uint16(udp[2:4])
+	if (src != dhcpServerPort && src != dhcpClientPort) || (dst != dhcpServerPort && dst != dhcpClientPort) {
+		return nil
+	}
+	payload := udp[8:]
+	if l := int(binary.BigEndian.Uint16(udp[4:6])); l >= 8 && l < len(udp) {
+		payload = udp[8:l]
+	}
+
+	// the fixed BOOTP header and the magic cookie
+	if len(payload) < optionsStart || binary.BigEndian.Uint32(payload[fileEnd:optionsStart]) != 0x63825363 {
+		return nil
+	}
+	return dhcp.Packet(payload)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// readPcap(), called by replayPcap()
+//
+// reads a classic pcap file, either byte order, microsecond or nanosecond timestamps, and hands every record to frame
+// with the file's link type. pcapng isn't supported, tcpdump -w and wireshark's "pcap" format both write classic pcap.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func readPcap(r io.Reader, frame func(linkType uint32, data []byte)) error {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return errors.New("pcap: truncated file header")
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return errors.New("pcap: not a pcap file (pcapng isn't supported)")
+	}
+
+	linkType := order.Uint32(header[20:24]) & 0xffff
+	if linkType != pcapLinkEthernet && linkType != pcapLinkRaw {
+		return errors.New("pcap: unsupported link type " + strconv.Itoa(int(linkType)) + ", use Ethernet or raw IPv4")
+	}
+
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("pcap: truncated record header")
+		}
+		length := order.Uint32(record[8:12])
+		if length > pcapMaxRecord {
+			return errors.New("pcap: record of " + strconv.Itoa(int(length)) + " bytes")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.New("pcap: truncated record")
+		}
+		frame(linkType, data)
+	}
+}
+
+func startSnoopSource(ctl chan bool) error {
+	// open the capture before anything else, snooping that can't capture doesn't start. a pcap replay on its own is
+	// fine, that's a test run.
+	var c frameCapture
+	if ifName := options.Snoop.Interface; ifName != "" {
+		var err error
+		if c, err = openCapture(ifName); err != nil {
+			logger.Error("snoop: unable to capture on ", ifName)
+			logger.Error("snoop: ", err.Error())
+			return err
+		}
+	}
+
+	leaseTable.init()
+	persist.restoreLeaseTable(&leaseTable)
+
+	timersStop := make(chan bool)
+	go leaseTable.runTimers(timersStop)
+
+	s := newSnooper()
+	sweepStop := make(chan bool)
+	go s.transactions.sweep(sweepStop)
+
+	if path := options.Snoop.PcapFile; path != "" {
+		n, err := s.replayPcap(path)
+		if err != nil {
+			logger.Error("snoop: unable to read ", path)
+			logger.Error("snoop: ", err.Error())
+		}
+		logger.Info("snoop: replayed ", n, " DHCP packets from ", path)
+	}
+
+	if c != nil {
+		logger.Info("snoop: capturing DHCP on ", options.Snoop.Interface)
+		go s.capture(c)
+	}
+
+	// stop taking in leases before the scheduler, main() dispatches the lease table one last time
+	waitForShutdown()
+
+	if c != nil {
+		c.Close()
+	}
+	timersStop <- true
+	sweepStop <- true
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("snoop: exit..")
+	return nil
+}
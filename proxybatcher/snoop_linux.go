@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// packetSocket is an AF_PACKET socket bound to the mirror interface. it's non-blocking under an os.File, so Close()
+// wakes a capture() blocked in readFrame().
+type packetSocket struct {
+	file *os.File
+}
+
+// packetMreq is struct packet_mreq
+type packetMreq struct {
+	ifindex int32
+	mrType  uint16
+	alen    uint16
+	address [8]byte
+}
+
+func openCapture(ifName string) (frameCapture, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// a mirror port delivers frames addressed to other hosts, the interface has to take them in
+	mreq := packetMreq{ifindex: int32(iface.Index), mrType: syscall.PACKET_MR_PROMISC}
+	b := (*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))[:]
+	if err := syscall.SetsockoptString(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(b)); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	return &packetSocket{file: os.NewFile(uintptr(fd), "packet:"+ifName)}, nil
+}
+
+func (c *packetSocket) readFrame(b []byte) (int, error) {
+	return c.file.Read(b)
+}
+
+func (c *packetSocket) Close() error {
+	return c.file.Close()
+}
+
+// htons is v in network byte order, the way the packet socket calls take a protocol
+func htons(v uint16) uint16 {
+	b := [2]byte{byte(v >> 8), byte(v)}
+	return *(*uint16)(unsafe.Pointer(&b))
+}
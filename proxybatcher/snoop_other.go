@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openCapture(ifName string) (frameCapture, error) {
+	return nil, errors.New("capturing on " + ifName + " needs a linux packet socket, use snoop_pcap on this platform")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	dhcp "github.com/krolaw/dhcp4"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// snoopTestFrame wraps a DHCP packet in UDP, IPv4 and Ethernet, with an 802.1Q tag when vlan isn't 0
+func snoopTestFrame(p dhcp.Packet, srcPort, dstPort uint16, vlan uint16) []byte {
+	udp := make([]byte, 8, 8+len(p))
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(p)))
+	udp = append(udp, p...)
+
+	ip := make([]byte, 20, 20+len(udp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+	ip[8] = 64
+	ip[9] = ipProtocolUDP
+	ip = append(ip, udp...)
+
+	var frame bytes.Buffer
+	frame.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1})
+	if vlan != 0 {
+		binary.Write(&frame, binary.BigEndian, uint16(etherTypeVLAN))
+		binary.Write(&frame, binary.BigEndian, vlan)
+	}
+	binary.Write(&frame, binary.BigEndian, uint16(etherTypeIPv4))
+	frame.Write(ip)
+	return frame.Bytes()
+}
+
+// snoopTestPcap writes frames to a little endian, microsecond, Ethernet pcap file
+func snoopTestPcap(t *testing.T, frames [][]byte) string {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, pcapLinkEthernet})
+	for i, f := range frames {
+		binary.Write(&b, binary.LittleEndian, []uint32{1700000000 + uint32(i), 0, uint32(len(f)), uint32(len(f))})
+		b.Write(f)
+	}
+	path := filepath.Join(t.TempDir(), "dhcp.pcap")
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", path, err)
+	}
+	return path
+}
+
+func TestSnoopPcap(t *testing.T) {
+	server := net.ParseIP("192.0.2.10")
+	leaseTable.init()
+	s := &snooper{transactions: newTransactionTable(time.Minute, 0)}
+
+	var frames [][]byte
+	client := func(p dhcp.Packet) { frames = append(frames, snoopTestFrame(p, dhcpClientPort, dhcpServerPort, 0)) }
+	reply := func(p dhcp.Packet, vlan uint16) {
+		frames = append(frames, snoopTestFrame(p, dhcpServerPort, dhcpClientPort, vlan))
+	}
+	dora := func(xid uint32, mac string, ip string) {
+		p, _ := dhcpTestPacket(dhcp.Discover, xid, mac, nil)
+		client(p)
+		p, _ = dhcpTestPacket(dhcp.Offer, xid, mac, server)
+		p.SetYIAddr(net.ParseIP(ip))
+		reply(p, 0)
+		p, _ = dhcpTestPacket(dhcp.Request, xid, mac, server)
+		p.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP(ip).To4())
+		client(p)
+		p, _ = dhcpTestPacket(dhcp.ACK, xid, mac, server)
+		p.SetYIAddr(net.ParseIP(ip))
+		p.AddOption(dhcp.OptionIPAddressLeaseTime, []byte{0, 0, 0x0e, 0x10})
+		p.AddOption(dhcp.OptionRouter, net.ParseIP("10.0.0.254").To4())
+		reply(p, 0)
+		// the same ACK again, relayed on a tagged segment
+		reply(p, 100)
+	}
+
+	dora(1, "aa:bb:cc:dd:ee:01", "10.0.0.1")
+	dora(2, "aa:bb:cc:dd:ee:02", "10.0.0.2")
+
+	// released
+	p, _ := dhcpTestPacket(dhcp.Release, 3, "aa:bb:cc:dd:ee:02", server)
+	p.SetCIAddr(net.ParseIP("10.0.0.2"))
+	client(p)
+
+	// an ACK without a REQUEST seen
+	p, _ = dhcpTestPacket(dhcp.ACK, 4, "aa:bb:cc:dd:ee:03", server)
+	p.SetYIAddr(net.ParseIP("10.0.0.3"))
+	p.AddOption(dhcp.OptionIPAddressLeaseTime, []byte{0, 0, 0x0e, 0x10})
+	reply(p, 0)
+
+	// not DHCP
+	frames = append(frames, snoopTestFrame(dhcp.Packet(make([]byte, 300)), 53, 53, 0))
+
+	n, err := s.replayPcap(snoopTestPcap(t, frames))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != len(frames)-1 {
+		t.Errorf("expected %d DHCP packets, got %d", len(frames)-1, n)
+	}
+
+	leaseTable.mutex.RLock()
+	defer leaseTable.mutex.RUnlock()
+	if a, ok := leaseTable.entry["aa:bb:cc:dd:ee:01"]; !ok || a.ip != "10.0.0.1" || a.state != leaseActive || a.router.String() != "10.0.0.254" {
+		t.Errorf("expected an active lease for 10.0.0.1 via 10.0.0.254, got %+v", a)
+	}
+	if a, ok := leaseTable.entry["aa:bb:cc:dd:ee:02"]; !ok || a.state != leaseReleased {
+		t.Errorf("expected the released lease for 10.0.0.2, got %+v", a)
+	}
+	if _, ok := leaseTable.entry["aa:bb:cc:dd:ee:03"]; ok {
+		t.Errorf("expected an ACK outside a transaction to be ignored")
+	}
+}
+
+func TestSnoopFrames(t *testing.T) {
+	p, _ := dhcpTestPacket(dhcp.Discover, 1, "aa:bb:cc:dd:ee:01", nil)
+
+	if dhcpFromFrame(snoopTestFrame(p, dhcpClientPort, dhcpServerPort, 0)) == nil {
+		t.Errorf("expected the DHCP payload of an untagged frame")
+	}
+	if dhcpFromFrame(snoopTestFrame(p, dhcpClientPort, dhcpServerPort, 42)) == nil {
+		t.Errorf("expected the DHCP payload of a tagged frame")
+	}
+
+	// a first fragment
+	frame := snoopTestFrame(p, dhcpClientPort, dhcpServerPort, 0)
+	frame[14+6] |= 0x20
+	if dhcpFromFrame(frame) != nil {
+		t.Errorf("expected fragments to be skipped")
+	}
+
+	// truncated past the BOOTP header
+	frame = snoopTestFrame(p, dhcpClientPort, dhcpServerPort, 0)
+	if dhcpFromFrame(frame[:14+20+8+100]) != nil {
+		t.Errorf("expected a truncated packet to be skipped")
+	}
+
+	if err := readPcap(bytes.NewReader([]byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0}), func(uint32, []byte) {}); err == nil {
+		t.Errorf("expected an error for a pcapng file")
+	}
+}
+
+func TestStartSnoopSourceCaptureFailure(t *testing.T) {
+	saved := options.Snoop
+	defer func() { options.Snoop = saved }()
+	options.Snoop = snoopConfig{Interface: "missing0"}
+
+	done := make(chan error, 1)
+	go func() { done <- startSnoopSource(make(chan bool, 1)) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error for an interface that isn't there")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("startSnoopSource didn't return")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//
+// syslog source ("syslog" operation mode), for edge DHCP servers that can't run a lease script but can ship syslog.
+// DHCP server log lines are matched against regex templates, every match becomes an assignment or expiry in the batch
+// table. the sending host is treated like a router from batch_routers, messages from anyone else are dropped.
+//
+// templates need named groups "ip" and "mac", "remote_id" is optional. built-in templates cover ISC dhcpd, dnsmasq,
+// MikroTik and Kea, custom ones from syslog_templates are tried first.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type compiledSyslogTemplate struct {
+	name    string
+	pattern *regexp.Regexp
+	expired string
+}
+
+const syslogMAC = `(?P<mac>[0-9A-Fa-f]{2}(?:[:-][0-9A-Fa-f]{2}){5})`
+
+var builtinSyslogTemplates = map[string][]syslogTemplate{
+	"isc": {
+		{Name: "isc-ack", Pattern: `DHCPACK on (?P<ip>[0-9.]+) to ` + syslogMAC, Expired: "0"},
+		{Name: "isc-release", Pattern: `DHCPRELEASE of (?P<ip>[0-9.]+) from ` + syslogMAC, Expired: "1"},
+		{Name: "isc-expire", Pattern: `DHCPEXPIRE (?:on|of) (?P<ip>[0-9.]+) (?:to|from) ` + syslogMAC, Expired: "1"},
+	},
+	"dnsmasq": {
+		{Name: "dnsmasq-ack", Pattern: `DHCPACK\([^)]*\) (?P<ip>[0-9.]+) ` + syslogMAC, Expired: "0"},
+		{Name: "dnsmasq-release", Pattern: `DHCPRELEASE\([^)]*\) (?P<ip>[0-9.]+) ` + syslogMAC, Expired: "1"},
+	},
+	"mikrotik": {
+		{Name: "mikrotik-deassigned", Pattern: `deassigned (?P<ip>[0-9.]+) (?:for|from) ` + syslogMAC, Expired: "1"},
+		{Name: "mikrotik-assigned", Pattern: `assigned (?P<ip>[0-9.]+) (?:for|to) ` + syslogMAC, Expired: "0"},
+	},
+	"kea": {
+		{Name: "kea-alloc", Pattern: `DHCP4_LEASE_ALLOC \[hwtype=\d+ ` + syslogMAC + `\].*?lease (?P<ip>[0-9.]+) has been allocated`, Expired: "0"},
+		{Name: "kea-release", Pattern: `DHCP4_RELEASE \[hwtype=\d+ ` + syslogMAC + `\].*?address (?P<ip>[0-9.]+) was released`, Expired: "1"},
+		{Name: "kea-reclaim", Pattern: `LEASE_RECLAIM .*?\[hwtype=\d+ ` + syslogMAC + `\].*?expired lease for address (?P<ip>[0-9.]+)`, Expired: "1"},
+	},
+}
+
+// syslogFormats in the order they're tried when syslog_formats isn't set
+var syslogFormats = []string{"isc", "dnsmasq", "mikrotik", "kea"}
+
+type syslogReceiver struct {
+	templates []compiledSyslogTemplate
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newSyslogReceiver(), called by startSyslogSource() and checkConfig()
+//
+// compiles the custom templates followed by the enabled built-in ones. errors name the offending yaml key.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func newSyslogReceiver() (*syslogReceiver, error) {
+	s := &syslogReceiver{}
+
+	var templates []syslogTemplate
+	templates = append(templates, options.Syslog.Templates...)
+
+	formats := options.Syslog.Formats
+	if len(formats) == 0 {
+		formats = syslogFormats
+	}
+	for _, f := range formats {
+		t, ok := builtinSyslogTemplates[strings.ToLower(f)]
+		if !ok {
+			return nil, errors.New("(syslog_formats) unknown syslog format " + f + ", use [ isc | dnsmasq | mikrotik | kea ]")
+		}
+		templates = append(templates, t...)
+	}
+
+	for _, t := range templates {
+		re, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return nil, errors.New("(syslog_templates) template " + t.Name + " doesn't compile: " + err.Error())
+		}
+
+		hasIP, hasMAC := false, false
+		for _, n := range re.SubexpNames() {
+			hasIP = hasIP || n == "ip"
+			hasMAC = hasMAC || n == "mac"
+		}
+		if !hasIP || !hasMAC {
+			return nil, errors.New("(syslog_templates) template " + t.Name + " needs named groups (?P<ip>...) and (?P<mac>...)")
+		}
+
+		if t.Expired != "0" && t.Expired != "1" {
+			return nil, errors.New("(syslog_templates) template " + t.Name + " 'expired' must be 0 or 1")
+		}
+
+		s.templates = append(s.templates, compiledSyslogTemplate{name: t.Name, pattern: re, expired: t.Expired})
+	}
+
+	return s, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// handleMessage(), called by serveUDP() and serveTCP()
+//
+// the message is matched as a whole, no attempt is made to parse the syslog header -- the templates are specific
+// enough, and the header formats (RFC 3164, RFC 5424, whatever the router firmware thinks syslog is) are not.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (s *syslogReceiver) handleMessage(src net.IP, msg string) bool {
+	if _, ok := findBatchRouter(src); !ok {
+		logger.Warn("syslog: message from unauthorized router ", src.String(), " dropped")
+		return false
+	}
+
+	for _, t := range s.templates {
+		m := t.pattern.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+
+		var ipText, macText, remoteID string
+		for i, n := range t.pattern.SubexpNames() {
+			switch n {
+			case "ip":
+				ipText = m[i]
+			case "mac":
+				macText = m[i]
+			case "remote_id":
+				remoteID = m[i]
+			}
+		}
+
+		mac, err := net.ParseMAC(macText)
+		if err != nil {
+			logger.Warn("syslog: ", t.name, " matched with unparsable MAC ", macText, " from ", src.String())
+			return false
+		}
+		ip := net.ParseIP(ipText)
+		if ip == nil {
+			logger.Warn("syslog: ", t.name, " matched with unparsable IP ", ipText, " from ", src.String())
+			return false
+		}
+		if len(remoteID) > 246 {
+			remoteID = remoteID[:246]
+		}
+
+		logger.Debug("syslog: ", t.name, " matched from ", src.String())
+		batchTable.UpdateBatchTable(t.expired, src, mac, ip, remoteID)
+		return true
+	}
+
+	return false
+}
+
+// findBatchRouter looks up a router from batch_routers by address
+func findBatchRouter(ip net.IP) (batchRouterAuth, bool) {
+	for _, v := range options.Batch.Routers {
+		if r := net.ParseIP(v.RouterIP); r != nil && r.Equal(ip) {
+			return v, true
+		}
+	}
+	return batchRouterAuth{}, false
+}
+
+func (s *syslogReceiver) serveUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 8192)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			s.handleMessage(udpAddr.IP, string(buffer[:n]))
+		}
+	}
+}
+
+func (s *syslogReceiver) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// serveTCPConn(), called by serveTCP()
+//
+// RFC 6587 framing, either octet counting ("<length> <message>") or newline delimited. the framing is worked out per
+// message from the first character, senders don't mix but it costs nothing to not care.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (s *syslogReceiver) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	var src net.IP
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		src = tcpAddr.IP
+	}
+	if _, ok := findBatchRouter(src); !ok {
+		logger.Warn("syslog: connection from unauthorized router ", conn.RemoteAddr().String(), " closed")
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var msg string
+		if first[0] >= '0' && first[0] <= '9' {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil || n <= 0 || n > 65536 {
+				logger.Warn("syslog: bad octet count from ", src.String(), ", closing connection")
+				return
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			msg = string(b)
+		} else {
+			line, err := r.ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			msg = strings.TrimRight(line, "\r\n")
+		}
+
+		s.handleMessage(src, msg)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// startSyslogSource, called by main()
+//
+// starts the udp and/or tcp syslog listeners on syslog_address, routines are concurrent and will run until stop
+// signal is sent. returns an error when the templates don't compile or a listener won't bind.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func startSyslogSource(ctl chan bool) error {
+	receiver, err := newSyslogReceiver()
+	if err != nil {
+		logger.Error("syslog: ", err.Error())
+		return err
+	}
+
+	address := options.Syslog.Address
+	if address == "" {
+		address = ":514"
+	}
+
+	protocols := options.Syslog.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{"udp", "tcp"}
+	}
+
+	var closers []io.Closer
+	for _, p := range protocols {
+		switch strings.ToLower(p) {
+		case "udp":
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				logger.Error("syslog: unable to listen on udp ", address)
+				logger.Error("syslog: ", err.Error())
+				for _, c := range closers {
+					c.Close()
+				}
+				return err
+			}
+			closers = append(closers, conn)
+			logger.Info("syslog: listening on udp ", address)
+			go func() {
+				if err := receiver.serveUDP(conn); err != nil {
+					logger.Debug("syslog: udp listener closed")
+					logger.Debug("syslog: ", err.Error())
+				}
+			}()
+		case "tcp":
+			ln, err := net.Listen("tcp", address)
+			if err != nil {
+				logger.Error("syslog: unable to listen on tcp ", address)
+				logger.Error("syslog: ", err.Error())
+				for _, c := range closers {
+					c.Close()
+				}
+				return err
+			}
+			closers = append(closers, ln)
+			logger.Info("syslog: listening on tcp ", address)
+			go func() {
+				if err := receiver.serveTCP(ln); err != nil {
+					logger.Debug("syslog: tcp listener closed")
+					logger.Debug("syslog: ", err.Error())
+				}
+			}()
+		}
+	}
+
+	// stop taking in assignments before the scheduler, main() dispatches whatever is left
+	waitForShutdown()
+
+	for _, c := range closers {
+		c.Close()
+	}
+
+	// true, exit batchScheduler
+	ctl <- true
+
+	logger.Println()
+	logger.Info("syslog: exit..")
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSyslogTemplates(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.Batch.Routers = []batchRouterAuth{{RouterIP: "192.0.2.1"}}
+	options.Syslog.Templates = []syslogTemplate{
+		{Name: "custom", Pattern: `lease (?P<ip>\S+) bound to (?P<mac>\S+) circuit (?P<remote_id>\S+)`, Expired: "0"},
+	}
+
+	receiver, err := newSyslogReceiver()
+	if err != nil {
+		t.Fatalf("newSyslogReceiver: %v", err)
+	}
+
+	tests := []struct {
+		msg      string
+		mac      string
+		ip       string
+		expired  string
+		remoteID string
+	}{
+		{"<30>May 14 14:31:31 dhcp dhcpd[123]: DHCPACK on 192.168.1.10 to aa:bb:cc:dd:ee:f0 (host1) via eth0", "aa:bb:cc:dd:ee:f0", "192.168.1.10", "0", ""},
+		{"<30>May 14 14:31:31 dhcp dhcpd[123]: DHCPRELEASE of 192.168.1.10 from aa:bb:cc:dd:ee:f0 (host1) via eth0 (found)", "aa:bb:cc:dd:ee:f0", "192.168.1.10", "1", ""},
+		{"<30>May 14 14:31:31 dhcp dnsmasq-dhcp[99]: DHCPACK(br0) 192.168.1.11 aa:bb:cc:dd:ee:f1 host2", "aa:bb:cc:dd:ee:f1", "192.168.1.11", "0", ""},
+		{"<30>May 14 14:31:31 dhcp dnsmasq-dhcp[99]: DHCPRELEASE(br0) 192.168.1.11 aa:bb:cc:dd:ee:f1", "aa:bb:cc:dd:ee:f1", "192.168.1.11", "1", ""},
+		{"<30>dhcp,info defconf assigned 192.168.88.254 for AA:BB:CC:DD:EE:F2 host3", "aa:bb:cc:dd:ee:f2", "192.168.88.254", "0", ""},
+		{"<30>dhcp,info defconf deassigned 192.168.88.254 for AA:BB:CC:DD:EE:F2 host3", "aa:bb:cc:dd:ee:f2", "192.168.88.254", "1", ""},
+		{"<30>kea-dhcp4: INFO  [kea-dhcp4.leases/1234] DHCP4_LEASE_ALLOC [hwtype=1 aa:bb:cc:dd:ee:f3], cid=[no info], tid=0x1: lease 192.168.1.13 has been allocated for 3600 seconds", "aa:bb:cc:dd:ee:f3", "192.168.1.13", "0", ""},
+		{"<30>kea-dhcp4: INFO  [kea-dhcp4.alloc-engine/1234] ALLOC_ENGINE_V4_LEASE_RECLAIM [hwtype=1 aa:bb:cc:dd:ee:f3], cid=[no info], tid=0x1: reclaiming expired lease for address 192.168.1.13", "aa:bb:cc:dd:ee:f3", "192.168.1.13", "1", ""},
+		{"<30>router: lease 192.168.1.14 bound to aa-bb-cc-dd-ee-f4 circuit port7", "aa:bb:cc:dd:ee:f4", "192.168.1.14", "0", "port7"},
+	}
+
+	router := net.ParseIP("192.0.2.1")
+	for _, v := range tests {
+		batchTable.initTable()
+		if !receiver.handleMessage(router, v.msg) {
+			t.Errorf("%q - no template matched", v.msg)
+			continue
+		}
+
+		a, ok := batchTable.entry[v.mac]
+		if !ok {
+			t.Errorf("%q - no entry for %v", v.msg, v.mac)
+			continue
+		}
+		if a.IpAddress != v.ip || a.Expired != v.expired || a.RemoteID != v.remoteID {
+			t.Errorf("%q - got ip:%v expired:%v remote_id:%v", v.msg, a.IpAddress, a.Expired, a.RemoteID)
+		}
+	}
+
+	// unrelated lines and unknown routers are dropped
+	batchTable.initTable()
+	if receiver.handleMessage(router, "<30>dhcpd[123]: DHCPDISCOVER from aa:bb:cc:dd:ee:f0 via eth0") {
+		t.Errorf("expected DHCPDISCOVER to be ignored")
+	}
+	if receiver.handleMessage(net.ParseIP("192.0.2.99"), tests[0].msg) {
+		t.Errorf("expected a message from an unknown router to be dropped")
+	}
+	if len(batchTable.entry) != 0 {
+		t.Errorf("expected an empty batch table, got %v entries", len(batchTable.entry))
+	}
+
+	// templates without the required groups are rejected
+	options.Syslog.Templates = []syslogTemplate{{Name: "broken", Pattern: `lease (?P<ip>\S+)`, Expired: "0"}}
+	if _, err := newSyslogReceiver(); err == nil {
+		t.Errorf("expected a template without a mac group to be rejected")
+	}
+}
+
+func TestSyslogListeners(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.Batch.Routers = []batchRouterAuth{{RouterIP: "127.0.0.1"}}
+	options.Syslog = syslogConfig{Formats: []string{"isc"}}
+
+	receiver, err := newSyslogReceiver()
+	if err != nil {
+		t.Fatalf("newSyslogReceiver: %v", err)
+	}
+
+	batchTable.initTable()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer udp.Close()
+	go receiver.serveUDP(udp)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	defer tcp.Close()
+	go receiver.serveTCP(tcp)
+
+	c, err := net.Dial("udp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	c.Write([]byte("<30>dhcpd: DHCPACK on 192.168.1.10 to aa:bb:cc:dd:ee:f0 via eth0"))
+	c.Close()
+
+	// one octet counted and one newline delimited message on the same connection
+	c, err = net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	msg := "<30>dhcpd: DHCPACK on 192.168.1.11 to aa:bb:cc:dd:ee:f1 via eth0"
+	c.Write([]byte(strconv.Itoa(len(msg)) + " " + msg))
+	c.Write([]byte("<30>dhcpd: DHCPACK on 192.168.1.12 to aa:bb:cc:dd:ee:f2 via eth0\n"))
+	c.Close()
+
+	want := []string{"aa:bb:cc:dd:ee:f0", "aa:bb:cc:dd:ee:f1", "aa:bb:cc:dd:ee:f2"}
+	for i := 0; i < 100; i++ {
+		batchTable.rwTableMutex.Lock()
+		n := len(batchTable.entry)
+		batchTable.rwTableMutex.Unlock()
+		if n == len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	batchTable.rwTableMutex.Lock()
+	defer batchTable.rwTableMutex.Unlock()
+	for _, mac := range want {
+		if _, ok := batchTable.entry[mac]; !ok {
+			t.Errorf("expected an entry for %v", mac)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// TLS profiles, used by configBatchModeTLS()
+//
+// named TLS settings for the batch endpoint. "intermediate" is the default and matches what the batcher always shipped
+// with (TLS 1.2+, ECDHE AEAD suites only). "legacy" re-enables CBC and RSA key exchange suites plus TLS 1.0/1.1 for old
+// MikroTik and Ubiquiti firmware that can't negotiate anything better -- put it on its own port (batch_tls_legacy_port)
+// so only the routers that need it are exposed to it. "modern" is TLS 1.3 only.
+//
+// per-listener selection is done by port rather than SNI, routers call the batcher by IP address and clients don't send
+// SNI for IP addresses, so there's nothing to select on.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type tlsProfile struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	"modern": {
+		minVersion: tls.VersionTLS13,
+		curves: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+			tls.CurveP384,
+		},
+	},
+	"intermediate": {
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		curves: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519,
+		},
+	},
+	"legacy": {
+		minVersion: tls.VersionTLS10,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+
+			// no forward secrecy, but it's all some older firmwares speak
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		},
+		curves: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519,
+			tls.CurveP384,
+			tls.CurveP521,
+		},
+	},
+}
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersionNames[strings.TrimSpace(v)]; ok {
+		return version, nil
+	}
+	return 0, errors.New("unknown TLS version " + v + ", use [ 1.0 | 1.1 | 1.2 | 1.3 ]")
+}
+
+// parseTLSCipherSuite accepts the Go / IANA suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func parseTLSCipherSuite(name string) (uint16, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, nil
+		}
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		if s.Name == name {
+			return s.ID, nil
+		}
+	}
+	return 0, errors.New("unknown TLS cipher suite " + name)
+}
+
+func parseTLSCurve(name string) (tls.CurveID, error) {
+	if curve, ok := tlsCurveNames[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return curve, nil
+	}
+	return 0, errors.New("unknown TLS curve " + name + ", use [ X25519 | P256 | P384 | P521 ]")
+}
+
+// tlsProfileByName returns a copy of the named profile, an empty name is the default (intermediate) profile
+func tlsProfileByName(name string) (tlsProfile, bool) {
+	if name == "" {
+		name = "intermediate"
+	}
+
+	base, ok := tlsProfiles[strings.ToLower(name)]
+	if !ok {
+		return tlsProfile{}, false
+	}
+
+	// copy the slices, the profile table is shared
+	return tlsProfile{
+		minVersion:   base.minVersion,
+		maxVersion:   base.maxVersion,
+		cipherSuites: append([]uint16(nil), base.cipherSuites...),
+		curves:       append([]tls.CurveID(nil), base.curves...),
+	}, true
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// resolveTLSProfile(), called by configBatchModeTLS() and checkConfig()
+//
+// looks up the named profile and, when applyOverrides is set, replaces individual fields with the batch_tls_min_version,
+// batch_tls_max_version, batch_tls_ciphers and batch_tls_curves settings. errors name the offending yaml key.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func resolveTLSProfile(name string, applyOverrides bool) (tlsProfile, error) {
+	p, ok := tlsProfileByName(name)
+	if !ok {
+		return tlsProfile{}, errors.New("(batch_tls_profile) unknown TLS profile " + name + ", use [ modern | intermediate | legacy ]")
+	}
+
+	if !applyOverrides {
+		return p, nil
+	}
+
+	if options.Batch.TlsMinVersion != "" {
+		v, err := parseTLSVersion(options.Batch.TlsMinVersion)
+		if err != nil {
+			return tlsProfile{}, errors.New("(batch_tls_min_version) " + err.Error())
+		}
+		p.minVersion = v
+	}
+
+	if options.Batch.TlsMaxVersion != "" {
+		v, err := parseTLSVersion(options.Batch.TlsMaxVersion)
+		if err != nil {
+			return tlsProfile{}, errors.New("(batch_tls_max_version) " + err.Error())
+		}
+		p.maxVersion = v
+	}
+
+	if p.maxVersion != 0 && p.maxVersion < p.minVersion {
+		return tlsProfile{}, errors.New("(batch_tls_max_version) TLS max version is lower than the min version")
+	}
+
+	if len(options.Batch.TlsCipherSuites) > 0 {
+		p.cipherSuites = nil
+		for _, name := range options.Batch.TlsCipherSuites {
+			id, err := parseTLSCipherSuite(name)
+			if err != nil {
+				return tlsProfile{}, errors.New("(batch_tls_ciphers) " + err.Error())
+			}
+			p.cipherSuites = append(p.cipherSuites, id)
+		}
+	}
+
+	if len(options.Batch.TlsCurves) > 0 {
+		p.curves = nil
+		for _, name := range options.Batch.TlsCurves {
+			curve, err := parseTLSCurve(name)
+			if err != nil {
+				return tlsProfile{}, errors.New("(batch_tls_curves) " + err.Error())
+			}
+			p.curves = append(p.curves, curve)
+		}
+	}
+
+	return p, nil
+}
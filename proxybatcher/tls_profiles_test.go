@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestResolveTLSProfile(t *testing.T) {
+	saved := options.Batch
+	defer func() { options.Batch = saved }()
+
+	// default profile matches the settings the batcher always shipped with
+	p, err := resolveTLSProfile("", true)
+	if err != nil {
+		t.Fatalf("default profile: %v", err)
+	}
+	if p.minVersion != tls.VersionTLS12 || len(p.cipherSuites) != 6 {
+		t.Errorf("default profile, expected TLS 1.2 with 6 suites, got %x with %v suites", p.minVersion, len(p.cipherSuites))
+	}
+
+	if _, err := resolveTLSProfile("bogus", true); err == nil {
+		t.Errorf("expected unknown profile to fail")
+	}
+
+	options.Batch.TlsMinVersion = "1.1"
+	options.Batch.TlsCipherSuites = []string{"TLS_RSA_WITH_AES_128_CBC_SHA", "tls_ecdhe_rsa_with_aes_128_gcm_sha256"}
+	options.Batch.TlsCurves = []string{"P384"}
+
+	p, err = resolveTLSProfile("intermediate", true)
+	if err != nil {
+		t.Fatalf("overridden profile: %v", err)
+	}
+	if p.minVersion != tls.VersionTLS11 {
+		t.Errorf("override min version, expected %x, got %x", tls.VersionTLS11, p.minVersion)
+	}
+	if len(p.cipherSuites) != 2 || p.cipherSuites[0] != tls.TLS_RSA_WITH_AES_128_CBC_SHA {
+		t.Errorf("override ciphers, got %v", p.cipherSuites)
+	}
+	if len(p.curves) != 1 || p.curves[0] != tls.CurveP384 {
+		t.Errorf("override curves, got %v", p.curves)
+	}
+
+	// overrides don't leak into the shared profile table or the legacy listener
+	p, _ = resolveTLSProfile("intermediate", false)
+	if p.minVersion != tls.VersionTLS12 || len(p.cipherSuites) != 6 {
+		t.Errorf("profile without overrides was modified, got %x with %v suites", p.minVersion, len(p.cipherSuites))
+	}
+
+	options.Batch.TlsMaxVersion = "1.0"
+	if _, err := resolveTLSProfile("intermediate", true); err == nil {
+		t.Errorf("expected max version lower than min version to fail")
+	}
+
+	options.Batch.TlsMaxVersion = ""
+	options.Batch.TlsCipherSuites = []string{"TLS_NOT_A_SUITE"}
+	if _, err := resolveTLSProfile("intermediate", true); err == nil {
+		t.Errorf("expected unknown cipher suite to fail")
+	}
+}
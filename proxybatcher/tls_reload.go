@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// certReloader, used by startBatchModeServer()
+//
+// holds the TLS keypair for the batch endpoint and hands it to the TLS listener through tls.Config.GetCertificate, so
+// the keypair can be rotated without restarting the batcher (and losing the unsent batch table).
+//
+// 1- the cert and key files are polled for changes every batch_tls_reload_interval seconds
+// 2- a SIGHUP forces a reload regardless of the file modification times
+// 3- a new pair is only swapped in after it parses, the key matches the cert and the cert is inside its validity
+//    window, otherwise the previous pair keeps being served.
+//
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type certReloader struct {
+	mutex    sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	warnDays int
+}
+
+func newCertReloader(certFile string, keyFile string, warnDays int) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		warnDays: warnDays,
+	}
+
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cert = cert
+	c.certMod, c.keyMod = c.modTimes()
+	c.checkExpiry()
+
+	return c, nil
+}
+
+// GetCertificate is attached to tls.Config, called by the TLS listener for every handshake.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// loadCertificate reads and validates a keypair, the leaf is parsed so the expiry checks don't have to.
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	return &cert, nil
+}
+
+func (c *certReloader) modTimes() (time.Time, time.Time) {
+	var certMod, keyMod time.Time
+	if fi, err := os.Stat(c.certFile); err == nil {
+		certMod = fi.ModTime()
+	}
+	if fi, err := os.Stat(c.keyFile); err == nil {
+		keyMod = fi.ModTime()
+	}
+	return certMod, keyMod
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// reload(), called by watch()
+//
+// loads the keypair from disk and swaps it in if it validates. an expired (or not yet valid) certificate is refused,
+// rotating to it would break every router still connecting, so keep serving the old one and complain loudly instead.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (c *certReloader) reload() error {
+	certMod, keyMod := c.modTimes()
+
+	cert, err := loadCertificate(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return errors.New("certificate expired on " + cert.Leaf.NotAfter.Format(time.RFC1123))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return errors.New("certificate is not valid until " + cert.Leaf.NotBefore.Format(time.RFC1123))
+	}
+
+	c.mutex.Lock()
+	c.cert = cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.mutex.Unlock()
+
+	logger.Info("batcher tls: certificate reloaded from ", c.certFile)
+	c.checkExpiry()
+	return nil
+}
+
+// changed reports whether either file has a different modification time than the pair currently being served.
+func (c *certReloader) changed() bool {
+	certMod, keyMod := c.modTimes()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)
+}
+
+func (c *certReloader) checkExpiry() {
+	c.mutex.RLock()
+	leaf := c.cert.Leaf
+	c.mutex.RUnlock()
+
+	remaining := time.Until(leaf.NotAfter)
+	days := int(remaining.Hours() / 24)
+
+	switch {
+	case remaining <= 0:
+		logger.Error("batcher tls: certificate ", leaf.Subject.CommonName, " expired on ", leaf.NotAfter.Format(time.RFC1123))
+	case days < c.warnDays:
+		logger.Warn("batcher tls: certificate ", leaf.Subject.CommonName, " expires on ", leaf.NotAfter.Format(time.RFC1123), " (", days, " days remaining)")
+	default:
+		logger.Info("batcher tls: certificate ", leaf.Subject.CommonName, " valid until ", leaf.NotAfter.Format(time.RFC1123), " (", days, " days remaining)")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// watch(), called by startBatchModeServer()
+//
+// polls the keypair for changes, listens for SIGHUP and re-checks the expiry date once a day so the warnings keep
+// showing up in the log as the expiry date gets closer. runs until stop signal is sent.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (c *certReloader) watch(interval time.Duration, ctl chan bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+	daily := time.NewTicker(24 * time.Hour)
+	defer daily.Stop()
+
+	for {
+		select {
+		case <-ctl:
+			logger.Debug("batcher tls: certificate watcher exit..")
+			return
+		case <-hup:
+			logger.Info("batcher tls: SIGHUP received, reloading certificate")
+			if err := c.reload(); err != nil {
+				logger.Error("batcher tls: certificate reload failed, still serving the previous certificate")
+				logger.Error("batcher tls: ", err.Error())
+			}
+		case <-poll.C:
+			if !c.changed() {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				logger.Error("batcher tls: certificate changed on disk but failed to load, still serving the previous certificate")
+				logger.Error("batcher tls: ", err.Error())
+			}
+		case <-daily.C:
+			c.checkExpiry()
+		}
+	}
+}
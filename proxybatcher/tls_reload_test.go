@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a self-signed cert/key pair with the given serial and validity window
+func writeTestKeyPair(t *testing.T, certFile string, keyFile string, serial int64, notBefore time.Time, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "batcher.test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unable to write cert: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+
+	// make sure the modification time moves even on filesystems with coarse timestamps
+	mod := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher-tls")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "proxybatcher.crt")
+	keyFile := filepath.Join(dir, "proxybatcher.key")
+	now := time.Now()
+
+	writeTestKeyPair(t, certFile, keyFile, 1, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	c, err := newCertReloader(certFile, keyFile, 30)
+	if err != nil {
+		t.Fatalf("unable to load initial keypair: %v", err)
+	}
+
+	cert, _ := c.GetCertificate(nil)
+	if cert.Leaf.SerialNumber.Int64() != 1 {
+		t.Errorf("initial load, expected serial 1, got serial %v", cert.Leaf.SerialNumber)
+	}
+
+	if c.changed() {
+		t.Errorf("expected no change before the keypair is rotated")
+	}
+
+	// rotate to a new valid pair
+	writeTestKeyPair(t, certFile, keyFile, 2, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	if !c.changed() {
+		t.Errorf("expected change after the keypair is rotated")
+	}
+	if err := c.reload(); err != nil {
+		t.Errorf("reloading rotated keypair: %v", err)
+	}
+
+	cert, _ = c.GetCertificate(nil)
+	if cert.Leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("after rotation, expected serial 2, got serial %v", cert.Leaf.SerialNumber)
+	}
+
+	// expired pair must be refused
+	writeTestKeyPair(t, certFile, keyFile, 3, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+
+	if err := c.reload(); err == nil {
+		t.Errorf("expected reload of expired certificate to fail")
+	}
+
+	// half written pair must be refused
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+
+	if err := c.reload(); err == nil {
+		t.Errorf("expected reload of mismatched keypair to fail")
+	}
+
+	cert, _ = c.GetCertificate(nil)
+	if cert.Leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("after failed reloads, expected serial 2 to still be served, got serial %v", cert.Leaf.SerialNumber)
+	}
+}